@@ -0,0 +1,58 @@
+package cffuse
+
+// Sync conflict copies (see namecrypter/conflict.go) are presented with
+// the decrypted original name plus the conflict suffix of the sync client.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/internal/namecrypter"
+)
+
+// encryptConflictPath encrypts "path" which may contain presented sync conflict names.
+// Returns the cipher path and the plaintext path used for the IVs of names in it,
+// which is "path" with conflict suffixes removed, as the sync client only renamed the
+// conflicted entry itself.
+func (fs *CfcryptFS) encryptConflictPath(path string) (string, string, error) {
+	if path == "" || path == "." {
+		return path, path, nil
+	}
+	cipherPath := ""
+	ivPath := ""
+	for _, n := range strings.Split(path, "/") {
+		ivDir := ivPath
+		ivPath = filepath.Join(ivDir, n)
+		cipherName := fs.nameCrypt.EncryptName(ivPath, n)
+		for _, c := range namecrypter.ConflictCandidates(n) {
+			cname := fs.nameCrypt.EncryptName(filepath.Join(ivDir, c.Base), c.Base) + c.Suffix
+			_, err := os.Lstat(filepath.Join(fs.configs.CipherDir, cipherPath, cname))
+			if err == nil {
+				cipherName = cname
+				ivPath = filepath.Join(ivDir, c.Base)
+				break
+			}
+			if !os.IsNotExist(err) {
+				return "", "", err
+			}
+		}
+		cipherPath = filepath.Join(cipherPath, cipherName)
+	}
+	return cipherPath, ivPath, nil
+}
+
+// decryptName decrypts the cipher name of an entry in the plaintext directory "dir"
+func (fs *CfcryptFS) decryptName(dir string, name string) (string, error) {
+	if len(namecrypter.ConflictCandidates(name)) > 0 {
+		_, ivDir, err := fs.encryptConflictPath(dir)
+		if err != nil {
+			return "", err
+		}
+		base, suffix, err := fs.nameCrypt.DecryptConflictName(ivDir, name)
+		if err == nil {
+			return namecrypter.JoinConflictName(base, suffix), nil
+		}
+	}
+	return fs.nameCrypt.DecryptName(name)
+}
@@ -0,0 +1,56 @@
+package cffuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestConflictPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-conflict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := corecrypter.RandomKey(corecrypter.AES256)
+	fs := NewFS(FsConfig{
+		CipherDir: dir,
+		CryptType: corecrypter.AES256,
+		CryptKey:  key,
+		PlainBS:   4096,
+	}, nil)
+	ctx := &fuse.Context{}
+	for _, p := range []string{"report.txt", "notes-DESKTOP-1A2B3C4.txt"} {
+		f, st := fs.Create(p, uint32(os.O_WRONLY), 0644, ctx)
+		if st != fuse.OK {
+			t.Fatalf("Create %s failed: %v", p, st)
+		}
+		f.Release()
+	}
+	// The sync client renames the cipher file of report.txt
+	suffix := "-DESKTOP-1A2B3C4"
+	cname := fs.nameCrypt.EncryptPath("report.txt")
+	if err = os.Rename(filepath.Join(dir, cname), filepath.Join(dir, cname+suffix)); err != nil {
+		t.Fatal(err)
+	}
+
+	if cpath, err := fs.encryptPath("report-DESKTOP-1A2B3C4.txt"); err != nil || cpath != cname+suffix {
+		t.Errorf("Conflict copy resolved to %s: %v", cpath, err)
+	}
+	if _, st := fs.GetAttr("report-DESKTOP-1A2B3C4.txt", ctx); st != fuse.OK {
+		t.Errorf("Conflict copy not found: %v", st)
+	}
+	// An entry of the exact name is cached like any other
+	fs.encryptPath("notes-DESKTOP-1A2B3C4.txt")
+	hits, _ := fs.PathCacheStats()
+	if cpath, err := fs.encryptPath("notes-DESKTOP-1A2B3C4.txt"); err != nil || cpath != fs.nameCrypt.EncryptPath("notes-DESKTOP-1A2B3C4.txt") {
+		t.Errorf("Exact name resolved to %s: %v", cpath, err)
+	}
+	if h, _ := fs.PathCacheStats(); h != hits+1 {
+		t.Error("Exact name not cached")
+	}
+}
@@ -144,8 +144,13 @@ func (f *file) Chmod(mode uint32) fuse.Status {
 	f.ent.headerLock.Lock()
 	defer f.ent.headerLock.Unlock()
 
-	// mode here doesn't have S_IFREG bit, we should add
-	f.ent.header.Mode = mode | syscall.S_IFREG
+	// mode here doesn't have file type bits, keep the ones in the header
+	// (S_IFDIR for directory objects in the flattened layout)
+	ftype := f.ent.header.Mode & syscall.S_IFMT
+	if ftype == 0 {
+		ftype = syscall.S_IFREG
+	}
+	f.ent.header.Mode = mode&^syscall.S_IFMT | ftype
 
 	f.ent.contentLock.Lock()
 	defer f.ent.contentLock.Unlock()
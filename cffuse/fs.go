@@ -15,6 +15,7 @@ import (
 	"github.com/declan94/cfcryptfs/corecrypter"
 	"github.com/declan94/cfcryptfs/internal/contcrypter"
 	"github.com/declan94/cfcryptfs/internal/namecrypter"
+	"github.com/declan94/cfcryptfs/internal/secmem"
 	"github.com/declan94/cfcryptfs/internal/tlog"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
@@ -27,6 +28,9 @@ type CfcryptFS struct {
 	configs           FsConfig
 	contentCrypt      *contcrypter.ContentCrypter
 	nameCrypt         *namecrypter.NameCrypter
+	pathCache         *pathCache
+	lostFound         lostFound
+	objects           *objectStore
 	backingFileMode   uint32
 }
 
@@ -46,26 +50,59 @@ func NewFS(confs FsConfig, core corecrypter.CoreCrypter) *CfcryptFS {
 			return nil
 		}
 	}
-	return &CfcryptFS{
+	fs := &CfcryptFS{
 		FileSystem:      pathfs.NewLoopbackFileSystem(confs.CipherDir),
 		configs:         confs,
 		backingFileMode: confs.BackingFileMode,
 		contentCrypt:    contcrypter.NewContentCrypter(core, confs.PlainBS),
 		nameCrypt:       namecrypter.NewNameCrypter(confs.CryptKey),
 	}
+	if confs.FlatLayout {
+		if confs.LostFound {
+			tlog.Warn.Printf("lost+found is not supported in flattened layout")
+			fs.configs.LostFound = false
+		}
+		if confs.Policy != nil {
+			tlog.Warn.Printf("Selective encryption policy is not supported in flattened layout")
+			fs.configs.Policy = nil
+		}
+		fs.configs.PlainPath = false
+		fs.objects = newObjectStore(fs)
+		if err := fs.objects.init(); err != nil {
+			tlog.Fatal.Printf("Init object store failed: %v", err)
+			return nil
+		}
+	}
+	if !fs.configs.PlainPath {
+		fs.pathCache = newPathCache(confs.PathCacheSize)
+	}
+	// Unlocked by WipeKeys
+	secmem.Lock(confs.CryptKey)
+	return fs
+}
+
+// WipeKeys zeroes the keys of the filesystem after it is unmounted, it can't be used afterwards
+func (fs *CfcryptFS) WipeKeys() {
+	fs.contentCrypt.Wipe()
+	fs.nameCrypt.Wipe()
+	secmem.Wipe(fs.configs.CryptKey)
+	secmem.Unlock(fs.configs.CryptKey)
 }
 
 // Create implements pathfs.Filesystem.
 func (fs *CfcryptFS) Create(path string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, code fuse.Status) {
 
 	tlog.Debug.Printf("CfcryptFS.Create(%s, %d, %d)", path, flags, mode)
-	newFlags := fs.mangleOpenFlags(flags)
-	upath, err := fs.getUnderlyingPath(path)
-	if err != nil {
-		return nil, fuse.ToStatus(err)
+	if fs.isPassthrough(path) {
+		return fs.createPassthrough(path, flags, mode, context)
 	}
+	newFlags := fs.mangleOpenFlags(flags)
 	// Create backing file
-	fd, err := os.OpenFile(upath, newFlags|os.O_CREATE, os.FileMode(fs.backingFileMode))
+	var fd *os.File
+	err := fs.createUnderlying(path, syscall.S_IFREG, func(upath string) (err error) {
+		fd, err = os.OpenFile(upath, newFlags|os.O_CREATE, os.FileMode(fs.backingFileMode))
+		return err
+	})
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
@@ -86,7 +123,15 @@ func (fs *CfcryptFS) Create(path string, flags uint32, mode uint32, context *fus
 
 // Open implements pathfs.Filesystem.
 func (fs *CfcryptFS) Open(path string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
-	f, st := fs.open(path, flags, context)
+	var f nodefs.File
+	var st fuse.Status
+	if fs.isLostFound(path) {
+		f, st = fs.openLostFound(path, flags, context)
+	} else if fs.isPassthrough(path) {
+		f, st = fs.openPassthrough(path, flags, context)
+	} else {
+		f, st = fs.open(path, flags, context)
+	}
 	if st != fuse.OK {
 		return nil, st
 	}
@@ -107,7 +152,7 @@ func (fs *CfcryptFS) Open(path string, flags uint32, context *fuse.Context) (fus
 	return f, fuse.OK
 }
 
-func (fs *CfcryptFS) open(path string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
+func (fs *CfcryptFS) open(path string, flags uint32, context *fuse.Context) (fuseFile *file, status fuse.Status) {
 	newFlags := fs.mangleOpenFlags(flags)
 	upath, err := fs.getUnderlyingPath(path)
 	if err != nil {
@@ -140,7 +185,7 @@ func (fs *CfcryptFS) Chmod(path string, mode uint32, context *fuse.Context) (cod
 		tlog.Debug.Printf("CfcryptFS.GetAttr failed: %s", status.String())
 		return status
 	}
-	if a.IsRegular() {
+	if a.IsRegular() && !fs.isPassthrough(path) {
 		f, status := fs.open(path, uint32(os.O_RDWR), context)
 		if status != fuse.OK {
 			return status
@@ -186,6 +231,9 @@ func (fs *CfcryptFS) Chown(path string, uid uint32, gid uint32, context *fuse.Co
 // GetAttr implements pathfs.Filesystem.
 func (fs *CfcryptFS) GetAttr(path string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	tlog.Debug.Printf("CfcryptFS.GetAttr('%s')", path)
+	if fs.configs.LostFound && path == LostFoundDir {
+		return fs.FileSystem.GetAttr("", context)
+	}
 	cpath, err := fs.encryptPath(path)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
@@ -196,13 +244,17 @@ func (fs *CfcryptFS) GetAttr(path string, context *fuse.Context) (*fuse.Attr, fu
 		tlog.Debug.Printf("CfcryptFS.GetAttr failed: %s", status.String())
 		return a, status
 	}
-	if a.IsRegular() {
+	if a.IsRegular() && !fs.isPassthrough(path) {
 		f, status := fs.open(path, uint32(os.O_RDWR), context)
 		if status != fuse.OK {
 			return nil, status
 		}
 		status = f.GetAttr(a)
 		f.Release()
+		if status != fuse.OK && fs.isLostFound(path) {
+			// Broken file header, show the raw file
+			return fs.FileSystem.GetAttr(cpath, context)
+		}
 	}
 	return a, status
 }
@@ -212,6 +264,20 @@ func (fs *CfcryptFS) OpenDir(path string, context *fuse.Context) (stream []fuse.
 	// What other ways beyond O_RDONLY are there to open
 	// directories?
 	tlog.Debug.Printf("CfcryptFS.OpenDir('%s')", path)
+	if fs.isLostFound(path) {
+		return fs.openDirLostFound(path, context)
+	}
+	if fs.isPassthrough(path) {
+		cpath, err := fs.encryptPath(path)
+		if err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+		return fs.FileSystem.OpenDir(cpath, context)
+	}
+	if fs.objects != nil {
+		output, err := fs.objects.list(path)
+		return output, fuse.ToStatus(err)
+	}
 	upath, err := fs.getUnderlyingPath(path)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
@@ -230,27 +296,36 @@ func (fs *CfcryptFS) OpenDir(path string, context *fuse.Context) (stream []fuse.
 				continue
 			}
 			n := infos[i].Name()
-			if fs.isNameReserved(n) {
+			if fs.isNameReserved(n) || (path == "" && IsNameReserved(n)) {
 				continue
 			}
-			if !fs.configs.PlainPath {
-				n, err = fs.nameCrypt.DecryptName(infos[i].Name())
-				if err != nil {
-					tlog.Warn.Printf("Invalid filename: %s", infos[i].Name())
-					continue
-				}
+			var passthrough bool
+			if fs.configs.PlainPath {
+				passthrough = fs.isPassthrough(filepath.Join(path, n))
+			} else if plain, err := fs.decryptName(path, n); err == nil && !fs.isPassthrough(filepath.Join(path, plain)) {
+				n = plain
+			} else if fs.isPassthrough(filepath.Join(path, n)) {
+				// Passthrough names fail decryption, the policy only ever matches plaintext names
+				passthrough = true
+			} else {
+				tlog.Warn.Printf("Invalid filename: %s", n)
+				fs.lostFoundRecord(filepath.Join(upath, n))
+				continue
 			}
 			d := fuse.DirEntry{
 				Name: n,
 			}
-			if infos[i].Mode().IsRegular() {
+			if infos[i].Mode().IsRegular() && !passthrough {
 				f, status := fs.open(filepath.Join(path, n), uint32(os.O_RDWR), context)
 				if status != fuse.OK {
 					tlog.Warn.Printf("Open file to get mode failed: %s", infos[i].Name())
 					continue
 				}
 				var attr fuse.Attr
-				f.GetAttr(&attr)
+				if f.GetAttr(&attr) != fuse.OK {
+					// Broken file header
+					fs.lostFoundRecord(filepath.Join(upath, infos[i].Name()))
+				}
 				f.Release()
 				d.Mode = attr.Mode
 			} else {
@@ -271,6 +346,9 @@ func (fs *CfcryptFS) OpenDir(path string, context *fuse.Context) (stream []fuse.
 		}
 	}
 	f.Close()
+	if fs.configs.LostFound && path == "" {
+		output = append(output, fuse.DirEntry{Name: LostFoundDir, Mode: fuse.S_IFDIR})
+	}
 
 	return output, fuse.OK
 }
@@ -297,7 +375,13 @@ func (fs *CfcryptFS) Symlink(pointedTo string, linkName string, context *fuse.Co
 	if fs.isNameReserved(pointedTo) {
 		return fuse.EPERM
 	}
-	return fuse.ToStatus(os.Symlink(fs.nameCrypt.EncryptLink(pointedTo), fs.getUnderlyingPathUncheck(linkName)))
+	target := pointedTo
+	if !fs.isPassthrough(linkName) {
+		target = fs.nameCrypt.EncryptLink(pointedTo)
+	}
+	return fuse.ToStatus(fs.createUnderlying(linkName, syscall.S_IFLNK, func(upath string) error {
+		return os.Symlink(target, upath)
+	}))
 }
 
 // Readlink fuse implemention
@@ -306,14 +390,20 @@ func (fs *CfcryptFS) Readlink(name string, context *fuse.Context) (out string, c
 	if err != nil {
 		return "", fuse.ToStatus(err)
 	}
+	if fs.isLostFound(name) || fs.isPassthrough(name) {
+		return f, fuse.OK
+	}
 	f, err = fs.nameCrypt.DecryptLink(f)
 	return f, fuse.ToStatus(err)
 }
 
 // Mknod fuse implemention
 func (fs *CfcryptFS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (code fuse.Status) {
-	upath := fs.getUnderlyingPathUncheck(name)
-	err := syscall.Mknod(upath, mode, int(dev))
+	var upath string
+	err := fs.createUnderlying(name, mode, func(p string) error {
+		upath = p
+		return syscall.Mknod(upath, mode, int(dev))
+	})
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
@@ -325,8 +415,14 @@ func (fs *CfcryptFS) Mknod(name string, mode uint32, dev uint32, context *fuse.C
 
 // Mkdir fuse implemention
 func (fs *CfcryptFS) Mkdir(path string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	upath := fs.getUnderlyingPathUncheck(path)
-	err := os.Mkdir(upath, os.FileMode(mode))
+	var upath string
+	err := fs.createUnderlying(path, syscall.S_IFDIR, func(p string) error {
+		upath = p
+		if fs.objects != nil {
+			return fs.objects.writeDir(upath, mode, &dirListing{Entries: make(map[string]dirEntryObject)})
+		}
+		return os.Mkdir(upath, os.FileMode(mode))
+	})
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
@@ -339,39 +435,96 @@ func (fs *CfcryptFS) Mkdir(path string, mode uint32, context *fuse.Context) (cod
 // Unlink fuse implemention
 // Don't use os.Remove, it removes twice (unlink followed by rmdir).
 func (fs *CfcryptFS) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	upath, err := fs.getUnderlyingPath(name)
-	if err != nil {
-		return fuse.EPERM
+	var err error
+	var upath string
+	if fs.objects != nil {
+		err = fs.objects.remove(name, false)
+	} else {
+		if upath, err = fs.getUnderlyingPath(name); err != nil {
+			return fuse.EPERM
+		}
+		err = syscall.Unlink(upath)
 	}
-	return fuse.ToStatus(syscall.Unlink(upath))
+	if err == nil {
+		fs.pathCache.invalidate(name)
+		fs.lostFoundMoved(name, "", upath, "")
+	}
+	return fuse.ToStatus(err)
 }
 
 // Rmdir fuse implemention
 func (fs *CfcryptFS) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	upath, err := fs.getUnderlyingPath(name)
-	if err != nil {
-		return fuse.EPERM
+	var err error
+	var upath string
+	if fs.objects != nil {
+		err = fs.objects.remove(name, true)
+	} else {
+		if upath, err = fs.getUnderlyingPath(name); err != nil {
+			return fuse.EPERM
+		}
+		err = syscall.Rmdir(upath)
+	}
+	if err == nil {
+		fs.pathCache.invalidate(name)
+		fs.lostFoundMoved(name, "", upath, "")
 	}
-	return fuse.ToStatus(syscall.Rmdir(upath))
+	return fuse.ToStatus(err)
 }
 
 // Rename fuse implemention
 func (fs *CfcryptFS) Rename(oldPath string, newPath string, context *fuse.Context) (codee fuse.Status) {
+	if fs.objects != nil {
+		// Only the listings change, O(1) regardless of the size of a renamed directory
+		return fuse.ToStatus(fs.objects.rename(oldPath, newPath))
+	}
+	if fs.isPassthrough(oldPath) != fs.isPassthrough(newPath) {
+		// Stored differently, mv falls back to copying
+		return fuse.Status(syscall.EXDEV)
+	}
 	uoldpath, err := fs.getUnderlyingPath(oldPath)
 	if err != nil {
 		return fuse.EPERM
 	}
-	err = os.Rename(uoldpath, fs.getUnderlyingPathUncheck(newPath))
+	if !fs.isPassthrough(oldPath) && (fs.configs.Policy.matchesBelow(oldPath) || fs.configs.Policy.matchesBelow(newPath)) {
+		// Entries of a moved directory would change between passthrough and encrypted
+		if fi, err := os.Lstat(uoldpath); err == nil && fi.IsDir() {
+			return fuse.Status(syscall.EXDEV)
+		}
+	}
+	unewpath := fs.getUnderlyingPathUncheck(newPath)
+	if fs.isLostFound(newPath) {
+		unewpath, err = fs.lostFoundRenameTarget(oldPath, newPath)
+		if err != nil {
+			return fuse.ToStatus(err)
+		}
+	}
+	err = os.Rename(uoldpath, unewpath)
+	if err == nil {
+		fs.pathCache.invalidate(oldPath)
+		fs.pathCache.invalidate(newPath)
+		fs.lostFoundMoved(oldPath, newPath, uoldpath, unewpath)
+	}
 	return fuse.ToStatus(err)
 }
 
 // Link fuse implemention
 func (fs *CfcryptFS) Link(orig string, newName string, context *fuse.Context) (code fuse.Status) {
+	if fs.isPassthrough(orig) != fs.isPassthrough(newName) {
+		return fuse.Status(syscall.EXDEV)
+	}
 	uorig, err := fs.getUnderlyingPath(orig)
 	if err != nil {
 		return fuse.EPERM
 	}
-	return fuse.ToStatus(os.Link(uorig, fs.getUnderlyingPathUncheck(newName)))
+	var ftype uint32 = syscall.S_IFREG
+	if fs.objects != nil {
+		if ftype, err = fs.objects.fileType(orig); err != nil {
+			return fuse.ToStatus(err)
+		}
+	}
+	return fuse.ToStatus(fs.createUnderlying(newName, ftype, func(upath string) error {
+		return os.Link(uorig, upath)
+	}))
 }
 
 func (fs *CfcryptFS) access(attr *fuse.Attr, mode uint32, context *fuse.Context) bool {
@@ -466,13 +619,36 @@ func (fs *CfcryptFS) mangleOpenFlags(flags uint32) (newFlags int) {
 }
 
 func (fs *CfcryptFS) encryptPath(path string) (string, error) {
+	if fs.isLostFound(path) {
+		return fs.lostFoundPath(path)
+	}
+	if i := fs.configs.Policy.passthroughAt(path); i >= 0 {
+		return fs.encryptPassthroughPath(path, i)
+	}
 	if fs.configs.PlainPath {
 		if IsNameReserved(path) {
 			return "", os.ErrPermission
 		}
 		return path, nil
 	}
-	return fs.nameCrypt.EncryptPath(path), nil
+	if fs.objects != nil {
+		// Cached by the object store, in step with its listings
+		return fs.objects.objectPath(path)
+	}
+	if cpath, ok := fs.pathCache.get(path); ok {
+		return cpath, nil
+	}
+	cpath := fs.nameCrypt.EncryptPath(path)
+	if namecrypter.HasConflictName(path) {
+		// An entry of the exact name wins, otherwise it may be a presented sync conflict copy.
+		// Those are not cached, the sync client may create or remove them any time.
+		if _, err := os.Lstat(filepath.Join(fs.configs.CipherDir, cpath)); os.IsNotExist(err) {
+			cpath, _, err = fs.encryptConflictPath(path)
+			return cpath, err
+		}
+	}
+	fs.pathCache.add(path, cpath)
+	return cpath, nil
 }
 
 // getUnderlyingPath - get the absolute encrypted path of the backing file
@@ -486,6 +662,19 @@ func (fs *CfcryptFS) getUnderlyingPath(relPath string) (string, error) {
 	return cAbsPath, nil
 }
 
+// createUnderlying creates the backing entry of type "ftype" for the new plaintext "path"
+// by calling "create" with its absolute underlying path
+func (fs *CfcryptFS) createUnderlying(path string, ftype uint32, create func(upath string) error) error {
+	if fs.objects != nil {
+		return fs.objects.create(path, ftype, create)
+	}
+	upath, err := fs.getUnderlyingPath(path)
+	if err != nil {
+		return err
+	}
+	return create(upath)
+}
+
 func (fs *CfcryptFS) getUnderlyingPathUncheck(relPath string) string {
 	relPath, _ = fs.encryptPath(relPath)
 	cAbsPath := filepath.Join(fs.configs.CipherDir, relPath)
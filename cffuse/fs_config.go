@@ -18,4 +18,13 @@ type FsConfig struct {
 	AllowOther bool
 	// PlainPath - filepath stay plaintext (not encrypted)
 	PlainPath bool
+	// FlatLayout - store all nodes as objects under ObjectDir with directory listings
+	// 	kept in encrypted directory objects, hides the shape of the directory tree
+	FlatLayout bool
+	// PathCacheSize - count of encrypted paths to cache (default: DefaultPathCacheSize, negative disables)
+	PathCacheSize int
+	// Policy - selective encryption policy, nil encrypts everything
+	Policy *Policy
+	// LostFound - present entries which can't be decrypted in the virtual lost+found directory
+	LostFound bool
 }
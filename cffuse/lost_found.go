@@ -0,0 +1,209 @@
+package cffuse
+
+// Virtual lost+found directory presenting entries of the cipher directory
+// which can't be decrypted (invalid filename or broken file header),
+// e.g. conflicted copies created by sync clients and stray files.
+// Entries are shown with their raw cipher names and can be read, deleted
+// or renamed (moved out of lost+found to give them a proper encrypted name).
+// Entries are collected as OpenDir runs into them, so an entry shows up
+// once the directory containing it has been listed.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+const (
+	// LostFoundDir is the name of the virtual lost+found directory in the filesystem root
+	LostFoundDir = ".cfcryptfs.lost+found"
+)
+
+type lostFound struct {
+	sync.Mutex
+	// entries maps names in the lost+found directory to paths relative to the cipher directory,
+	// names maps them back. Both are filled by OpenDir as it runs into undecryptable entries.
+	entries map[string]string
+	names   map[string]string
+}
+
+// isLostFound checks whether "path" is (or is inside) the virtual lost+found directory
+func (fs *CfcryptFS) isLostFound(path string) bool {
+	if !fs.configs.LostFound {
+		return false
+	}
+	return path == LostFoundDir || strings.HasPrefix(path, LostFoundDir+"/")
+}
+
+// lostFoundPath maps a path inside the lost+found directory to the path relative to the cipher directory
+func (fs *CfcryptFS) lostFoundPath(path string) (string, error) {
+	if path == LostFoundDir {
+		// The virtual directory itself has no backing directory
+		return "", os.ErrPermission
+	}
+	parts := strings.SplitN(path[len(LostFoundDir)+1:], "/", 2)
+	fs.lostFound.Lock()
+	rel, ok := fs.lostFound.entries[parts[0]]
+	fs.lostFound.Unlock()
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	if len(parts) == 2 {
+		rel = filepath.Join(rel, parts[1])
+	}
+	return rel, nil
+}
+
+// lostFoundRecord adds the undecryptable entry at the absolute underlying path "upath" to lost+found.
+// The contents of an undecryptable directory are accessible in raw form below its entry.
+func (fs *CfcryptFS) lostFoundRecord(upath string) {
+	if !fs.configs.LostFound {
+		return
+	}
+	rel, err := filepath.Rel(fs.configs.CipherDir, upath)
+	if err != nil {
+		return
+	}
+	fs.lostFound.Lock()
+	defer fs.lostFound.Unlock()
+	fs.lostFound.add(filepath.Base(rel), rel)
+}
+
+// add records "rel" under "name", or a numbered variant of it if "name" is taken.
+// Caller must hold the lock.
+func (lf *lostFound) add(name string, rel string) {
+	if _, ok := lf.names[rel]; ok {
+		return
+	}
+	if lf.entries == nil {
+		lf.entries = make(map[string]string)
+		lf.names = make(map[string]string)
+	}
+	base := name
+	for i := 1; lf.entries[name] != ""; i++ {
+		name = fmt.Sprintf("%s.%d", base, i)
+	}
+	lf.entries[name] = rel
+	lf.names[rel] = name
+}
+
+// remove drops the entry "name". Caller must hold the lock.
+func (lf *lostFound) remove(name string) {
+	delete(lf.names, lf.entries[name])
+	delete(lf.entries, name)
+}
+
+// lostFoundMoved updates lost+found entries after "path" has been removed ("newPath" is empty)
+// or renamed to "newPath". "upath" and "unewpath" are the absolute underlying paths.
+// Renaming a directory moves the undecryptable entries inside it, an entry moved out of
+// lost+found is dropped and shows up again when its new directory is listed.
+func (fs *CfcryptFS) lostFoundMoved(path string, newPath string, upath string, unewpath string) {
+	if !fs.configs.LostFound {
+		return
+	}
+	oldRel, err := filepath.Rel(fs.configs.CipherDir, upath)
+	if err != nil {
+		return
+	}
+	var newRel string
+	if newPath != "" {
+		if newRel, err = filepath.Rel(fs.configs.CipherDir, unewpath); err != nil {
+			return
+		}
+	}
+	intoLostFound := filepath.Dir(newPath) == LostFoundDir
+	fs.lostFound.Lock()
+	defer fs.lostFound.Unlock()
+	if name, ok := fs.lostFound.names[newRel]; ok {
+		// Replaced by the rename
+		fs.lostFound.remove(name)
+	}
+	var moved []string
+	for name, rel := range fs.lostFound.entries {
+		if rel == oldRel || strings.HasPrefix(rel, oldRel+"/") {
+			moved = append(moved, name)
+		}
+	}
+	for _, name := range moved {
+		rel := fs.lostFound.entries[name]
+		fs.lostFound.remove(name)
+		if newPath == "" || (fs.isLostFound(path) && !fs.isLostFound(newPath)) {
+			continue
+		}
+		if rel == oldRel && intoLostFound {
+			name = filepath.Base(newPath)
+		}
+		fs.lostFound.add(name, newRel+rel[len(oldRel):])
+	}
+	if intoLostFound {
+		fs.lostFound.add(filepath.Base(newPath), newRel)
+	}
+}
+
+// openDirLostFound lists the virtual lost+found directory or a raw directory inside it
+func (fs *CfcryptFS) openDirLostFound(path string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if path != LostFoundDir {
+		cpath, err := fs.lostFoundPath(path)
+		if err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+		return fs.FileSystem.OpenDir(cpath, context)
+	}
+	fs.lostFound.Lock()
+	defer fs.lostFound.Unlock()
+	output := make([]fuse.DirEntry, 0, len(fs.lostFound.entries))
+	for name, rel := range fs.lostFound.entries {
+		a, status := fs.FileSystem.GetAttr(rel, context)
+		if status == fuse.ENOENT {
+			// Removed outside the mount
+			fs.lostFound.remove(name)
+			continue
+		}
+		if status != fuse.OK {
+			continue
+		}
+		output = append(output, fuse.DirEntry{Name: name, Mode: a.Mode})
+	}
+	return output, fuse.OK
+}
+
+// openLostFound opens a file inside lost+found.
+// Files with an intact header are decrypted, others are opened in raw form.
+func (fs *CfcryptFS) openLostFound(path string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	cpath, err := fs.lostFoundPath(path)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	f, status := fs.open(path, flags, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if err := f.loadHeader(); err == nil {
+		return f, fuse.OK
+	}
+	f.Release()
+	tlog.Debug.Printf("Open lost+found file %s in raw form", path)
+	return fs.FileSystem.Open(cpath, flags, context)
+}
+
+// lostFoundRenameTarget gets the underlying path for renaming to "newPath" inside lost+found.
+// Renaming between lost+found entries renames the raw entry in its cipher directory.
+func (fs *CfcryptFS) lostFoundRenameTarget(oldPath string, newPath string) (string, error) {
+	if unewpath, err := fs.getUnderlyingPath(newPath); err == nil {
+		return unewpath, nil
+	}
+	if filepath.Dir(newPath) != LostFoundDir || filepath.Dir(oldPath) != LostFoundDir {
+		return "", os.ErrPermission
+	}
+	uoldpath, err := fs.getUnderlyingPath(oldPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(uoldpath), filepath.Base(newPath)), nil
+}
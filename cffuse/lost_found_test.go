@@ -0,0 +1,109 @@
+package cffuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+	"github.com/declan94/cfcryptfs/internal/contcrypter"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestLostFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-lostfound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := corecrypter.RandomKey(corecrypter.AES256)
+	fs := NewFS(FsConfig{CipherDir: dir, CryptType: corecrypter.AES256, CryptKey: key, PlainBS: 4096, LostFound: true}, nil)
+
+	valid := fs.nameCrypt.EncryptPath("valid")
+	header := contcrypter.NewFileHeader(0600).Pack()
+	ioutil.WriteFile(filepath.Join(dir, valid), header, 0600)
+	ioutil.WriteFile(filepath.Join(dir, valid+".bak"), header, 0600)
+	ioutil.WriteFile(filepath.Join(dir, ConfFile), []byte("{}"), 0600)
+	os.Mkdir(filepath.Join(dir, fs.nameCrypt.EncryptPath("sub")), 0700)
+	ioutil.WriteFile(filepath.Join(dir, fs.nameCrypt.EncryptPath("sub/broken")), []byte("short"), 0600)
+
+	// Only the listed directories are looked at
+	fs.OpenDir("", moveContext)
+	if len(fs.lostFound.entries) != 1 {
+		t.Fatalf("Wrong lost+found entries: %v", fs.lostFound.entries)
+	}
+	fs.OpenDir("sub", moveContext)
+	fs.OpenDir("sub", moveContext)
+	if len(fs.lostFound.entries) != 2 {
+		t.Fatalf("Wrong lost+found entries: %v", fs.lostFound.entries)
+	}
+	rel, err := fs.encryptPath(LostFoundDir + "/" + valid + ".bak")
+	if err != nil || rel != valid+".bak" {
+		t.Errorf("Wrong lost+found path: %s, %v", rel, err)
+	}
+	if _, err := fs.encryptPath(LostFoundDir + "/" + valid); err != os.ErrNotExist {
+		t.Errorf("Valid entry shouldn't be in lost+found: %v", err)
+	}
+	if _, err := fs.encryptPath(LostFoundDir); err != os.ErrPermission {
+		t.Errorf("lost+found itself shouldn't have an underlying path: %v", err)
+	}
+}
+
+func TestLostFoundCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-lostfound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := corecrypter.RandomKey(corecrypter.AES256)
+	fs := NewFS(FsConfig{CipherDir: dir, CryptType: corecrypter.AES256, CryptKey: key, PlainBS: 4096, LostFound: true}, nil)
+	if st := fs.Mkdir("sub", 0700, moveContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	broken := fs.nameCrypt.EncryptPath("sub/broken")
+	ioutil.WriteFile(filepath.Join(dir, broken), []byte("short"), 0600)
+	fs.OpenDir("sub", moveContext)
+
+	lookup := func(name string) (string, error) {
+		return fs.encryptPath(LostFoundDir + "/" + name)
+	}
+	if rel, err := lookup(filepath.Base(broken)); err != nil || rel != broken {
+		t.Errorf("Wrong lost+found path: %s, %v", rel, err)
+	}
+	// Entries show up once their directory has been listed
+	ioutil.WriteFile(filepath.Join(dir, "stray"), []byte("stray"), 0600)
+	if _, err := lookup("stray"); err != os.ErrNotExist {
+		t.Errorf("Stray entry found without listing its directory: %v", err)
+	}
+	fs.OpenDir("", moveContext)
+	entries, st := fs.OpenDir(LostFoundDir, moveContext)
+	if st != fuse.OK || len(entries) != 2 {
+		t.Errorf("Wrong lost+found listing: %v, %v", entries, st)
+	}
+	if rel, err := lookup("stray"); err != nil || rel != "stray" {
+		t.Errorf("Listed stray entry not found: %s, %v", rel, err)
+	}
+	// Renaming a directory moves the entries inside it
+	if st := fs.Rename("sub", "moved", moveContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if rel, err := lookup(filepath.Base(broken)); err != nil || rel != filepath.Join(fs.nameCrypt.EncryptPath("moved"), filepath.Base(broken)) {
+		t.Errorf("Entry in renamed directory: %s, %v", rel, err)
+	}
+	// Entries removed outside the mount are dropped on listing
+	os.Remove(filepath.Join(dir, "stray"))
+	if entries, st := fs.OpenDir(LostFoundDir, moveContext); st != fuse.OK || len(entries) != 1 {
+		t.Errorf("Wrong lost+found listing: %v, %v", entries, st)
+	}
+	if _, err := lookup("stray"); err != os.ErrNotExist {
+		t.Errorf("Removed entry still found: %v", err)
+	}
+	// Moving an entry out of lost+found gives it a proper name
+	if st := fs.Rename(LostFoundDir+"/"+filepath.Base(broken), "fixed", moveContext); st != fuse.OK {
+		t.Fatal(st)
+	}
+	if len(fs.lostFound.entries) != 0 || len(fs.lostFound.names) != 0 {
+		t.Errorf("Moved entry still in lost+found: %v", fs.lostFound.entries)
+	}
+}
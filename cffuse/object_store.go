@@ -0,0 +1,468 @@
+package cffuse
+
+// Flattened storage layout
+//
+// Every node is stored as an object named by a random ID under "d/XX/YYYY..."
+// in the cipher directory. A directory is an object holding its encrypted listing
+// (name -> object ID and file type), encrypted like a regular file with the
+// directory mode in the file header. So the cipher directory reveals neither the
+// depth nor the fan-out of the plaintext tree, cipher paths have a fixed length
+// and renaming a directory only rewrites two listings.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+	"github.com/declan94/cfcryptfs/internal/contcrypter"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const (
+	// ObjectDir is the directory holding all objects in the flattened layout
+	ObjectDir    = "d"
+	objectIDLen  = 16
+	rootObjectID = "00000000000000000000000000000000"
+)
+
+// dirEntryObject is an entry in a directory listing
+type dirEntryObject struct {
+	ID string
+	// Mode only contains the file type bits
+	Mode uint32
+}
+
+// dirListing is the content of a directory object
+type dirListing struct {
+	Entries map[string]dirEntryObject
+}
+
+type cachedListing struct {
+	listing *dirListing
+	modTime time.Time
+	size    int64
+}
+
+// objectStore maps plaintext paths to objects in the flattened layout
+type objectStore struct {
+	// Serializes listing modifications
+	sync.Mutex
+	fs *CfcryptFS
+	// listings caches decrypted directory listings by object ID
+	listings map[string]cachedListing
+}
+
+func newObjectStore(fs *CfcryptFS) *objectStore {
+	return &objectStore{
+		fs:       fs,
+		listings: make(map[string]cachedListing),
+	}
+}
+
+func objectRelPath(id string) string {
+	return filepath.Join(ObjectDir, id[:2], id[2:])
+}
+
+func (s *objectStore) absPath(id string) string {
+	return filepath.Join(s.fs.configs.CipherDir, objectRelPath(id))
+}
+
+// init creates the root directory object of a new cipher directory
+func (s *objectStore) init() error {
+	upath := s.absPath(rootObjectID)
+	if _, err := os.Lstat(upath); err == nil {
+		return nil
+	}
+	tlog.Info.Printf("Create root directory object")
+	if err := os.MkdirAll(filepath.Dir(upath), 0700); err != nil {
+		return err
+	}
+	return s.writeDir(upath, 0755, &dirListing{Entries: make(map[string]dirEntryObject)})
+}
+
+// splitPath splits plaintext "path" into the parent directory and the name
+func splitPath(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
+// resolve walks through directory listings, returns the object ID and file type of "path"
+func (s *objectStore) resolve(path string) (string, uint32, error) {
+	id := rootObjectID
+	var ftype uint32 = syscall.S_IFDIR
+	if path == "" || path == "." {
+		return id, ftype, nil
+	}
+	for _, n := range strings.Split(path, "/") {
+		if ftype != syscall.S_IFDIR {
+			return "", 0, syscall.ENOTDIR
+		}
+		listing, err := s.readListing(id)
+		if err != nil {
+			return "", 0, err
+		}
+		e, ok := listing.Entries[n]
+		if !ok {
+			return "", 0, syscall.ENOENT
+		}
+		id, ftype = e.ID, e.Mode
+	}
+	return id, ftype, nil
+}
+
+// objectPath gets the object path relative to the cipher directory of "path".
+// The path cache of the filesystem is filled and invalidated only with the lock held,
+// so a lookup racing with a rename or remove can't cache the old object.
+func (s *objectStore) objectPath(path string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if cpath, ok := s.fs.pathCache.get(path); ok {
+		return cpath, nil
+	}
+	id, _, err := s.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	cpath := objectRelPath(id)
+	s.fs.pathCache.add(path, cpath)
+	return cpath, nil
+}
+
+// fileType gets the file type bits of "path"
+func (s *objectStore) fileType(path string) (uint32, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, ftype, err := s.resolve(path)
+	return ftype, err
+}
+
+// list lists the directory "path"
+func (s *objectStore) list(path string) ([]fuse.DirEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+	id, ftype, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if ftype != syscall.S_IFDIR {
+		return nil, syscall.ENOTDIR
+	}
+	listing, err := s.readListing(id)
+	if err != nil {
+		return nil, err
+	}
+	output := make([]fuse.DirEntry, 0, len(listing.Entries))
+	for name, e := range listing.Entries {
+		output = append(output, fuse.DirEntry{Name: name, Mode: e.Mode})
+	}
+	return output, nil
+}
+
+// create allocates a new object for "path" with file type "ftype".
+// "create" is called to create the object at the given absolute path,
+// then the entry is added to the parent listing.
+func (s *objectStore) create(path string, ftype uint32, create func(upath string) error) error {
+	s.Lock()
+	defer s.Unlock()
+	dir, name := splitPath(path)
+	parentID, parentType, err := s.resolve(dir)
+	if err != nil {
+		return err
+	}
+	if parentType != syscall.S_IFDIR {
+		return syscall.ENOTDIR
+	}
+	listing, err := s.readListing(parentID)
+	if err != nil {
+		return err
+	}
+	if _, ok := listing.Entries[name]; ok {
+		return syscall.EEXIST
+	}
+	id := hex.EncodeToString(corecrypter.RandBytes(objectIDLen))
+	upath := s.absPath(id)
+	if err = os.MkdirAll(filepath.Dir(upath), 0700); err != nil {
+		return err
+	}
+	if err = create(upath); err != nil {
+		return err
+	}
+	listing.Entries[name] = dirEntryObject{ID: id, Mode: ftype & syscall.S_IFMT}
+	if err = s.writeListing(parentID, listing); err != nil {
+		delete(listing.Entries, name)
+		os.Remove(upath)
+		return err
+	}
+	return nil
+}
+
+// remove removes "path" from its parent listing and deletes the object.
+// Directories must be empty.
+func (s *objectStore) remove(path string, isDir bool) error {
+	s.Lock()
+	defer s.Unlock()
+	dir, name := splitPath(path)
+	parentID, _, err := s.resolve(dir)
+	if err != nil {
+		return err
+	}
+	listing, err := s.readListing(parentID)
+	if err != nil {
+		return err
+	}
+	e, ok := listing.Entries[name]
+	if !ok {
+		return syscall.ENOENT
+	}
+	if err = s.checkRemovable(e, isDir); err != nil {
+		return err
+	}
+	delete(listing.Entries, name)
+	if err = s.writeListing(parentID, listing); err != nil {
+		listing.Entries[name] = e
+		return err
+	}
+	s.fs.pathCache.invalidate(path)
+	s.removeObject(e)
+	return nil
+}
+
+func (s *objectStore) checkRemovable(e dirEntryObject, isDir bool) error {
+	if !isDir {
+		if e.Mode == syscall.S_IFDIR {
+			return syscall.EISDIR
+		}
+		return nil
+	}
+	if e.Mode != syscall.S_IFDIR {
+		return syscall.ENOTDIR
+	}
+	listing, err := s.readListing(e.ID)
+	if err != nil {
+		return err
+	}
+	if len(listing.Entries) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	return nil
+}
+
+func (s *objectStore) removeObject(e dirEntryObject) {
+	if err := syscall.Unlink(s.absPath(e.ID)); err != nil {
+		tlog.Warn.Printf("Remove object %s failed: %v", e.ID, err)
+	}
+	delete(s.listings, e.ID)
+}
+
+// rename moves the entry "oldPath" to "newPath", replacing "newPath" if it exists.
+// Only listings are rewritten, the object itself stays untouched.
+func (s *objectStore) rename(oldPath string, newPath string) error {
+	s.Lock()
+	defer s.Unlock()
+	oldDir, oldName := splitPath(oldPath)
+	newDir, newName := splitPath(newPath)
+	oldParent, _, err := s.resolve(oldDir)
+	if err != nil {
+		return err
+	}
+	newParent, newParentType, err := s.resolve(newDir)
+	if err != nil {
+		return err
+	}
+	if newParentType != syscall.S_IFDIR {
+		return syscall.ENOTDIR
+	}
+	oldListing, err := s.readListing(oldParent)
+	if err != nil {
+		return err
+	}
+	e, ok := oldListing.Entries[oldName]
+	if !ok {
+		return syscall.ENOENT
+	}
+	newListing := oldListing
+	if newParent != oldParent {
+		if newListing, err = s.readListing(newParent); err != nil {
+			return err
+		}
+	}
+	replaced, exists := newListing.Entries[newName]
+	if exists {
+		if replaced.ID == e.ID {
+			return nil
+		}
+		if err = s.checkRemovable(replaced, e.Mode == syscall.S_IFDIR); err != nil {
+			return err
+		}
+	}
+	// The cached listings are changed in place, failed writes are undone to keep them as on disk
+	undoNew := func() {
+		if exists {
+			newListing.Entries[newName] = replaced
+		} else {
+			delete(newListing.Entries, newName)
+		}
+	}
+	// Add to the new parent first, a crash in between leaves
+	// the entry in both directories instead of losing it.
+	newListing.Entries[newName] = e
+	if newParent != oldParent {
+		if err = s.writeListing(newParent, newListing); err != nil {
+			undoNew()
+			return err
+		}
+	}
+	delete(oldListing.Entries, oldName)
+	if err = s.writeListing(oldParent, oldListing); err != nil {
+		oldListing.Entries[oldName] = e
+		if newParent == oldParent {
+			undoNew()
+			return err
+		}
+		// Like a crash, the entry is left in both directories
+		s.fs.pathCache.invalidate(newPath)
+		if exists {
+			s.removeObject(replaced)
+		}
+		return err
+	}
+	s.fs.pathCache.invalidate(oldPath)
+	s.fs.pathCache.invalidate(newPath)
+	if exists {
+		s.removeObject(replaced)
+	}
+	return nil
+}
+
+// readListing reads and decrypts the listing of directory object "id".
+// The returned listing is cached and may be modified only with the lock held.
+func (s *objectStore) readListing(id string) (*dirListing, error) {
+	upath := s.absPath(id)
+	fi, err := os.Stat(upath)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := s.listings[id]; ok && c.modTime.Equal(fi.ModTime()) && c.size == fi.Size() {
+		return c.listing, nil
+	}
+	buf, err := ioutil.ReadFile(upath)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < contcrypter.HeaderLen {
+		tlog.Warn.Printf("Directory object %s too short", id)
+		return nil, syscall.EIO
+	}
+	header, err := contcrypter.ParseHeader(buf[:contcrypter.HeaderLen])
+	if err != nil {
+		return nil, err
+	}
+	cc := s.fs.contentCrypt
+	blocks, err := cc.DecryptBlocks(buf[contcrypter.HeaderLen:], 0, header.FileID)
+	if err != nil {
+		tlog.Warn.Printf("Decrypt directory object %s failed: %v", id, err)
+		return nil, syscall.EIO
+	}
+	var js []byte
+	for _, b := range blocks {
+		js = append(js, b...)
+		cc.PBlockPool.Put(b)
+	}
+	listing := &dirListing{}
+	if err = json.Unmarshal(js, listing); err != nil {
+		tlog.Warn.Printf("Parse directory object %s failed: %v", id, err)
+		return nil, syscall.EIO
+	}
+	if listing.Entries == nil {
+		listing.Entries = make(map[string]dirEntryObject)
+	}
+	s.listings[id] = cachedListing{listing: listing, modTime: fi.ModTime(), size: fi.Size()}
+	return listing, nil
+}
+
+// writeListing encrypts and writes the listing of directory object "id", keeping its mode and owner
+func (s *objectStore) writeListing(id string, listing *dirListing) error {
+	upath := s.absPath(id)
+	buf := make([]byte, contcrypter.HeaderLen)
+	fd, err := os.Open(upath)
+	if err != nil {
+		return err
+	}
+	_, err = fd.ReadAt(buf, 0)
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	header, err := contcrypter.ParseHeader(buf)
+	if err != nil {
+		return err
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(upath, &st); err != nil {
+		return err
+	}
+	tmp := upath + ".tmp"
+	// A crash or failed write may have left it
+	if err = os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = s.writeDir(tmp, header.Mode, listing); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if s.fs.configs.AllowOther {
+		os.Lchown(tmp, int(st.Uid), int(st.Gid))
+	}
+	if err = os.Rename(tmp, upath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	delete(s.listings, id)
+	return nil
+}
+
+// writeDir writes a directory object with "mode" and "listing" to the absolute path "upath"
+func (s *objectStore) writeDir(upath string, mode uint32, listing *dirListing) error {
+	js, err := json.Marshal(listing)
+	if err != nil {
+		return err
+	}
+	cc := s.fs.contentCrypt
+	header := contcrypter.NewFileHeader(mode&^syscall.S_IFMT | syscall.S_IFDIR)
+	var blocks [][]byte
+	for len(js) > 0 {
+		n := cc.PlainBS()
+		if n > len(js) {
+			n = len(js)
+		}
+		blocks = append(blocks, js[:n])
+		js = js[n:]
+	}
+	ciphertext, err := cc.EncryptBlocks(blocks, 0, header.FileID)
+	if err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(upath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(s.fs.backingFileMode))
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(append(header.Pack(), ciphertext...))
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
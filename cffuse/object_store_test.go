@@ -0,0 +1,167 @@
+package cffuse
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestObjectStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := corecrypter.RandomKey(corecrypter.AES256)
+	fs := NewFS(FsConfig{
+		CipherDir:  dir,
+		CryptType:  corecrypter.AES256,
+		CryptKey:   key,
+		PlainBS:    4096,
+		FlatLayout: true,
+	}, nil)
+	ctx := &fuse.Context{}
+
+	if st := fs.Mkdir("a", 0755, ctx); st != fuse.OK {
+		t.Fatalf("Mkdir failed: %v", st)
+	}
+	if st := fs.Mkdir("a/b", 0700, ctx); st != fuse.OK {
+		t.Fatalf("Mkdir failed: %v", st)
+	}
+	f, st := fs.Create("a/b/file", uint32(os.O_RDWR), 0644, ctx)
+	if st != fuse.OK {
+		t.Fatalf("Create failed: %v", st)
+	}
+	f.Write([]byte("hello"), 0)
+	f.Release()
+
+	cpath, err := fs.encryptPath("a/b/file")
+	if err != nil || !strings.HasPrefix(cpath, ObjectDir+"/") || strings.Count(cpath, "/") != 2 {
+		t.Errorf("Wrong object path: %s, %v", cpath, err)
+	}
+	attr, st := fs.GetAttr("a/b", ctx)
+	if st != fuse.OK || !attr.IsDir() || attr.Mode&07777 != 0700 {
+		t.Errorf("Wrong directory attr: %v, %v", attr, st)
+	}
+
+	if st := fs.Rename("a", "c", ctx); st != fuse.OK {
+		t.Fatalf("Rename failed: %v", st)
+	}
+	attr, st = fs.GetAttr("c/b/file", ctx)
+	if st != fuse.OK || attr.Size != 5 {
+		t.Errorf("Wrong file attr after rename: %v, %v", attr, st)
+	}
+	if _, st := fs.GetAttr("a", ctx); st != fuse.ENOENT {
+		t.Errorf("Renamed directory still exists: %v", st)
+	}
+	entries, st := fs.OpenDir("", ctx)
+	if st != fuse.OK || len(entries) != 1 || entries[0].Name != "c" || entries[0].Mode != fuse.S_IFDIR {
+		t.Errorf("Wrong root listing: %v, %v", entries, st)
+	}
+
+	if st := fs.Rmdir("c/b", ctx); st != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("Removed non-empty directory: %v", st)
+	}
+	if st := fs.Unlink("c/b/file", ctx); st != fuse.OK {
+		t.Errorf("Unlink failed: %v", st)
+	}
+	if st := fs.Rmdir("c/b", ctx); st != fuse.OK {
+		t.Errorf("Rmdir failed: %v", st)
+	}
+}
+
+func newObjectTestFS(t *testing.T) (*CfcryptFS, string) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := corecrypter.RandomKey(corecrypter.AES256)
+	return NewFS(FsConfig{CipherDir: dir, CryptType: corecrypter.AES256, CryptKey: key, PlainBS: 4096, FlatLayout: true}, nil), dir
+}
+
+func TestObjectStoreStaleTmp(t *testing.T) {
+	fs, dir := newObjectTestFS(t)
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	// Left by a crash while writing the root listing
+	tmp := fs.objects.absPath(rootObjectID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if st := fs.Mkdir("a", 0755, ctx); st != fuse.OK {
+		t.Fatalf("Mkdir with a stale listing tmp failed: %v", st)
+	}
+	if _, err := os.Lstat(tmp); !os.IsNotExist(err) {
+		t.Errorf("Listing tmp left: %v", err)
+	}
+}
+
+// blockListingWrite makes writing the listing of directory "path" fail until the returned func is called
+func blockListingWrite(t *testing.T, fs *CfcryptFS, path string) func() {
+	id, _, err := fs.objects.resolve(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := fs.objects.absPath(id) + ".tmp"
+	if err = os.MkdirAll(tmp+"/block", 0700); err != nil {
+		t.Fatal(err)
+	}
+	return func() { os.RemoveAll(tmp) }
+}
+
+func TestObjectStoreRenameFailure(t *testing.T) {
+	fs, dir := newObjectTestFS(t)
+	defer os.RemoveAll(dir)
+	ctx := &fuse.Context{}
+	for _, d := range []string{"x", "y"} {
+		if st := fs.Mkdir(d, 0755, ctx); st != fuse.OK {
+			t.Fatal(st)
+		}
+	}
+	f, st := fs.Create("x/f", uint32(os.O_WRONLY), 0644, ctx)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	f.Release()
+	names := func(path string) string {
+		entries, st := fs.OpenDir(path, ctx)
+		if st != fuse.OK {
+			t.Fatalf("List %q failed: %v", path, st)
+		}
+		var n []string
+		for _, e := range entries {
+			n = append(n, e.Name)
+		}
+		sort.Strings(n)
+		return strings.Join(n, ",")
+	}
+
+	// Nothing is written when the listing of the same directory fails
+	unblock := blockListingWrite(t, fs, "")
+	if st := fs.Rename("x", "z", ctx); st == fuse.OK {
+		t.Fatal("Rename succeeded with a failing listing write")
+	}
+	if got := names(""); got != "x,y" {
+		t.Errorf("Root listing after a failed rename: %s", got)
+	}
+	unblock()
+
+	// The new parent is written first, the entry stays in both directories
+	unblock = blockListingWrite(t, fs, "x")
+	if st := fs.Rename("x/f", "y/f", ctx); st == fuse.OK {
+		t.Fatal("Rename succeeded with a failing listing write")
+	}
+	unblock()
+	if got := names("x") + ";" + names("y"); got != "f;f" {
+		t.Errorf("Listings after a failed rename: %s", got)
+	}
+	if st := fs.Rename("x", "z", ctx); st != fuse.OK {
+		t.Errorf("Rename after unblocking failed: %v", st)
+	}
+}
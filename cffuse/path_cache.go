@@ -0,0 +1,149 @@
+package cffuse
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// Caches plaintext path -> ciphertext path results of encryptPath
+// 	every FUSE call needs the encrypted path, encrypting each path component
+// 	again and again is expensive for deep directory trees.
+
+const (
+	// DefaultPathCacheSize is the number of encrypted paths cached when FsConfig.PathCacheSize is 0
+	DefaultPathCacheSize = 4096
+)
+
+type pathCache struct {
+	// hits and misses are accessed without holding any locks so atomic operations must be used.
+	// They must be the first elements of the struct to guarantee 64-bit alignment.
+	hits   uint64
+	misses uint64
+	// mu protects cache and dirs. simplelru is used instead of the thread-safe
+	// lru.Cache because its evict callback has to update dirs under the same lock.
+	mu    sync.Mutex
+	cache *simplelru.LRU
+	// dirs maps a directory to its children that are cached or have cached
+	// descendants, so invalidate only visits the affected subtree.
+	dirs map[string]map[string]struct{}
+}
+
+// newPathCache creates a path cache holding at most "size" entries.
+// Returns nil (cache disabled) if size is negative.
+func newPathCache(size int) *pathCache {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = DefaultPathCacheSize
+	}
+	pc := &pathCache{dirs: make(map[string]map[string]struct{})}
+	cache, err := simplelru.NewLRU(size, func(key interface{}, _ interface{}) {
+		pc.unlink(key.(string))
+	})
+	if err != nil {
+		tlog.Warn.Printf("New path cache failed: %v", err)
+		return nil
+	}
+	pc.cache = cache
+	return pc
+}
+
+// parentPath returns the parent of a relative plaintext path, "" is the root.
+func parentPath(path string) string {
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+func (pc *pathCache) get(path string) (string, bool) {
+	if pc == nil {
+		return "", false
+	}
+	pc.mu.Lock()
+	cpath, ok := pc.cache.Get(path)
+	pc.mu.Unlock()
+	if !ok {
+		atomic.AddUint64(&pc.misses, 1)
+		return "", false
+	}
+	atomic.AddUint64(&pc.hits, 1)
+	return cpath.(string), true
+}
+
+func (pc *pathCache) add(path string, cpath string) {
+	if pc == nil || path == "" {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.cache.Add(path, cpath)
+	// Link path into the index of each ancestor, up to the first existing link
+	for p := path; p != ""; {
+		parent := parentPath(p)
+		children, ok := pc.dirs[parent]
+		if !ok {
+			children = make(map[string]struct{})
+			pc.dirs[parent] = children
+		}
+		if _, ok := children[p]; ok {
+			break
+		}
+		children[p] = struct{}{}
+		p = parent
+	}
+}
+
+// unlink drops "path" from the directory index once it is neither cached
+// nor has cached descendants, and does the same for its ancestors.
+// Caller must hold pc.mu.
+func (pc *pathCache) unlink(path string) {
+	for p := path; p != ""; p = parentPath(p) {
+		if len(pc.dirs[p]) > 0 || pc.cache.Contains(p) {
+			return
+		}
+		delete(pc.dirs, p)
+		parent := parentPath(p)
+		delete(pc.dirs[parent], p)
+		if len(pc.dirs[parent]) == 0 {
+			delete(pc.dirs, parent)
+		}
+	}
+}
+
+// invalidate removes "path" and everything below it from the cache.
+func (pc *pathCache) invalidate(path string) {
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.removeTree(path)
+	pc.unlink(path)
+}
+
+// Caller must hold pc.mu.
+func (pc *pathCache) removeTree(path string) {
+	children := pc.dirs[path]
+	delete(pc.dirs, path)
+	for child := range children {
+		pc.removeTree(child)
+	}
+	if path != "" {
+		pc.cache.Remove(path)
+	}
+}
+
+// PathCacheStats returns hit and miss counters of the encrypted path cache.
+// Both are 0 if the cache is disabled.
+func (fs *CfcryptFS) PathCacheStats() (hits uint64, misses uint64) {
+	if fs.pathCache == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&fs.pathCache.hits), atomic.LoadUint64(&fs.pathCache.misses)
+}
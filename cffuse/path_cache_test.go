@@ -0,0 +1,110 @@
+package cffuse
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+)
+
+func newTestFS(cacheSize int) *CfcryptFS {
+	key, err := corecrypter.RandomKey(corecrypter.AES256)
+	if err != nil {
+		panic(err)
+	}
+	return NewFS(FsConfig{
+		CipherDir:     "/tmp/cfcryptfs-unused",
+		CryptType:     corecrypter.AES256,
+		CryptKey:      key,
+		PlainBS:       4096,
+		PathCacheSize: cacheSize,
+	}, nil)
+}
+
+func TestPathCache(t *testing.T) {
+	fs := newTestFS(0)
+	cpath, _ := fs.encryptPath("a/b/c")
+	if cpath != fs.nameCrypt.EncryptPath("a/b/c") {
+		t.Error("Encrypted path not matched")
+	}
+	cpath2, _ := fs.encryptPath("a/b/c")
+	if cpath2 != cpath {
+		t.Error("Cached path not matched")
+	}
+	if hits, misses := fs.PathCacheStats(); hits != 1 || misses != 1 {
+		t.Errorf("Wrong stats: hits=%d misses=%d", hits, misses)
+	}
+	fs.encryptPath("a/bc")
+	fs.pathCache.invalidate("a/b")
+	if _, ok := fs.pathCache.get("a/b/c"); ok {
+		t.Error("Child path not invalidated")
+	}
+	if _, ok := fs.pathCache.get("a/bc"); !ok {
+		t.Error("Sibling path invalidated")
+	}
+}
+
+func TestPathCacheIndex(t *testing.T) {
+	pc := newPathCache(3)
+	pc.add("a/b/c/d", "1")
+	pc.add("ab", "2")
+	pc.invalidate("a/b")
+	if _, ok := pc.get("a/b/c/d"); ok {
+		t.Error("Path below an uncached directory not invalidated")
+	}
+	if _, ok := pc.get("ab"); !ok {
+		t.Error("Path with the same prefix invalidated")
+	}
+	if len(pc.dirs) != 1 || len(pc.dirs[""]) != 1 {
+		t.Errorf("Index not cleaned up after invalidate: %v", pc.dirs)
+	}
+	pc.add("x/y", "3")
+	pc.add("x/z", "4")
+	pc.add("w", "5")
+	if pc.cache.Contains("ab") {
+		t.Error("Oldest path not evicted")
+	}
+	if _, ok := pc.dirs[""]["ab"]; ok {
+		t.Errorf("Index not cleaned up after eviction: %v", pc.dirs)
+	}
+	pc.invalidate("")
+	if pc.cache.Len() != 0 || len(pc.dirs) != 0 {
+		t.Errorf("Root not invalidated: %d %v", pc.cache.Len(), pc.dirs)
+	}
+}
+
+func TestPathCacheDisabled(t *testing.T) {
+	fs := newTestFS(-1)
+	fs.encryptPath("a/b/c")
+	fs.encryptPath("a/b/c")
+	if hits, misses := fs.PathCacheStats(); hits != 0 || misses != 0 {
+		t.Errorf("Wrong stats: hits=%d misses=%d", hits, misses)
+	}
+}
+
+func benchmarkEncryptPath(b *testing.B, cacheSize int) {
+	fs := newTestFS(cacheSize)
+	paths := make([]string, 100)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("node_modules/pkg%d/lib/internal/file%d.js", i%10, i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fs.encryptPath(paths[i%len(paths)])
+	}
+	b.StopTimer()
+	hits, misses := fs.PathCacheStats()
+	if hits+misses > 0 {
+		b.Logf("path cache hit rate: %.2f%%", float64(hits)*100/float64(hits+misses))
+	}
+}
+
+// BenchmarkEncryptPath - encrypt paths of a deep tree without cache
+func BenchmarkEncryptPath(b *testing.B) {
+	benchmarkEncryptPath(b, -1)
+}
+
+// BenchmarkEncryptPathCached - encrypt paths of a deep tree with the path cache
+func BenchmarkEncryptPathCached(b *testing.B) {
+	benchmarkEncryptPath(b, 0)
+}
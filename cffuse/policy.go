@@ -0,0 +1,226 @@
+package cffuse
+
+// Selective encryption policy
+//
+// Paths matching a passthrough pattern are stored with plaintext names and content,
+// everything else is encrypted. The policy file is authenticated with the master key,
+// so patterns can't be added behind our back to make new files stored unencrypted.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// ErrPolicyTampered is returned when the policy file fails authentication
+var ErrPolicyTampered = errors.New("policy file authentication failed")
+
+// Policy decides which plaintext paths are stored as passthrough
+type Policy struct {
+	// Passthrough - glob patterns (see filepath.Match) of paths stored with plaintext names and content.
+	// 	A pattern without "/" (a trailing one ignored) matches a name at any depth,
+	// 	otherwise the path from the root, e.g. "/public" or "build/*.tar".
+	// 	A matched directory makes its whole subtree passthrough.
+	Passthrough []string
+}
+
+// policyFile is the content of PolicyFile
+type policyFile struct {
+	Passthrough []string
+	MAC         []byte
+}
+
+func policyMAC(key []byte, patterns []string) []byte {
+	// Derive a separate key, the master key is never used directly for MACs
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("cfcryptfs policy"))
+	h = hmac.New(sha256.New, h.Sum(nil))
+	js, _ := json.Marshal(patterns)
+	h.Write(js)
+	return h.Sum(nil)
+}
+
+// LoadPolicy loads and authenticates the policy of the cipher directory.
+// Returns nil if there is no policy file.
+func LoadPolicy(cipherDir string, key []byte) (*Policy, error) {
+	js, err := ioutil.ReadFile(filepath.Join(cipherDir, PolicyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pf policyFile
+	if err = json.Unmarshal(js, &pf); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(pf.MAC, policyMAC(key, pf.Passthrough)) {
+		return nil, ErrPolicyTampered
+	}
+	return &Policy{Passthrough: pf.Passthrough}, nil
+}
+
+// ReadPolicyPatterns reads the passthrough patterns without authentication, for displaying only
+func ReadPolicyPatterns(cipherDir string) ([]string, error) {
+	js, err := ioutil.ReadFile(filepath.Join(cipherDir, PolicyFile))
+	if err != nil {
+		return nil, err
+	}
+	var pf policyFile
+	err = json.Unmarshal(js, &pf)
+	return pf.Passthrough, err
+}
+
+// SavePolicy authenticates and saves the policy of the cipher directory.
+// An empty policy removes the policy file.
+func SavePolicy(cipherDir string, key []byte, p *Policy) error {
+	path := filepath.Join(cipherDir, PolicyFile)
+	if p == nil || len(p.Passthrough) == 0 {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, pattern := range p.Passthrough {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	js, err := json.MarshalIndent(policyFile{
+		Passthrough: p.Passthrough,
+		MAC:         policyMAC(key, p.Passthrough),
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(cipherDir, PolicyFileTmp)
+	if err = ioutil.WriteFile(tmp, append(js, '\n'), 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// passthroughAt returns the index of the first component of "path" which makes it passthrough,
+// or -1 if "path" should be encrypted
+func (p *Policy) passthroughAt(path string) int {
+	if p == nil || path == "" || path == "." {
+		return -1
+	}
+	comps := strings.Split(path, "/")
+	for i, n := range comps {
+		prefix := strings.Join(comps[:i+1], "/")
+		for _, pattern := range p.Passthrough {
+			pattern = strings.TrimSuffix(pattern, "/")
+			var matched bool
+			if strings.Contains(pattern, "/") {
+				matched, _ = filepath.Match(strings.TrimPrefix(pattern, "/"), prefix)
+			} else {
+				matched, _ = filepath.Match(pattern, n)
+			}
+			if matched {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// matchesBelow checks whether a pattern from the root may match a path below the directory "dir".
+// Renaming such a directory would change which of its entries are passthrough.
+func (p *Policy) matchesBelow(dir string) bool {
+	if p == nil || dir == "" {
+		return false
+	}
+	comps := strings.Split(dir, "/")
+	for _, pattern := range p.Passthrough {
+		pattern = strings.TrimPrefix(strings.TrimSuffix(pattern, "/"), "/")
+		pcomps := strings.Split(pattern, "/")
+		if len(pcomps) <= len(comps) {
+			continue
+		}
+		matched := true
+		for i, n := range comps {
+			if ok, _ := filepath.Match(pcomps[i], n); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *CfcryptFS) isPassthrough(path string) bool {
+	return fs.configs.Policy.passthroughAt(path) >= 0
+}
+
+// encryptPassthroughPath gets the cipher path of passthrough "path" whose "i"th component matched.
+// The components before are encrypted as usual, the rest stays plaintext.
+func (fs *CfcryptFS) encryptPassthroughPath(path string, i int) (string, error) {
+	comps := strings.Split(path, "/")
+	if i == 0 && IsNameReserved(comps[0]) {
+		return "", os.ErrPermission
+	}
+	cpath, err := fs.encryptPath(strings.Join(comps[:i], "/"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{cpath}, comps[i:]...)...), nil
+}
+
+// isPassthroughCipher checks whether the cipher path "rel" belongs to a passthrough path
+func (fs *CfcryptFS) isPassthroughCipher(rel string) bool {
+	if fs.configs.Policy == nil {
+		return false
+	}
+	comps := strings.Split(rel, "/")
+	if !fs.configs.PlainPath {
+		for i, n := range comps {
+			// Passthrough names fail decryption and stay as they are
+			if plain, err := fs.nameCrypt.DecryptName(n); err == nil {
+				comps[i] = plain
+			}
+		}
+	}
+	return fs.isPassthrough(strings.Join(comps, "/"))
+}
+
+// openPassthrough opens the passthrough file "path" without decryption
+func (fs *CfcryptFS) openPassthrough(path string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	cpath, err := fs.encryptPath(path)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return fs.FileSystem.Open(cpath, flags, context)
+}
+
+// createPassthrough creates the passthrough file "path" without file header
+func (fs *CfcryptFS) createPassthrough(path string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	upath, err := fs.getUnderlyingPath(path)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	fd, err := os.OpenFile(upath, int(flags)|os.O_CREATE, os.FileMode(mode))
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	if fs.configs.AllowOther {
+		if err = fd.Chown(int(context.Uid), int(context.Gid)); err != nil {
+			tlog.Warn.Printf("Create: fd.Chown failed: %v", err)
+		}
+	}
+	return nodefs.NewLoopbackFile(fd), fuse.OK
+}
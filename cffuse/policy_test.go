@@ -0,0 +1,171 @@
+package cffuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newTestFS(0)
+	fs.configs.CipherDir = dir
+	key := fs.configs.CryptKey
+
+	err = SavePolicy(dir, key, &Policy{Passthrough: []string{"/public/", "*.iso"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, PolicyFileTmp)); !os.IsNotExist(err) {
+		t.Errorf("Policy tmp file left: %v", err)
+	}
+	policy, err := LoadPolicy(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.configs.Policy = policy
+
+	cases := map[string]int{
+		"public":           0,
+		"public/a/b":       0,
+		"secrets/a.iso":    1,
+		"secrets/a.iso/b":  1,
+		"secrets/public":   -1,
+		"secrets/file.key": -1,
+	}
+	for path, i := range cases {
+		if at := policy.passthroughAt(path); at != i {
+			t.Errorf("Wrong passthrough index of %s: %d != %d", path, at, i)
+		}
+	}
+	rooted := &Policy{Passthrough: []string{"/public/", "*.iso", "build/*/*.tar"}}
+	for dir, below := range map[string]bool{
+		"build":       true,
+		"build/x":     true,
+		"build/x/y":   false,
+		"public":      false,
+		"src":         false,
+		"src/build/x": false,
+	} {
+		if rooted.matchesBelow(dir) != below {
+			t.Errorf("Wrong matchesBelow(%s): %v", dir, !below)
+		}
+	}
+	cpath, _ := fs.encryptPath("secrets/a.iso")
+	if cpath != fs.nameCrypt.EncryptPath("secrets")+"/a.iso" {
+		t.Errorf("Wrong passthrough cipher path: %s", cpath)
+	}
+	if !fs.isPassthroughCipher(cpath) {
+		t.Errorf("Passthrough cipher path not recognized: %s", cpath)
+	}
+
+	js, _ := ioutil.ReadFile(filepath.Join(dir, PolicyFile))
+	ioutil.WriteFile(filepath.Join(dir, PolicyFile), []byte(strings.Replace(string(js), "*.iso", "*", 1)), 0600)
+	if _, err := LoadPolicy(dir, key); err != ErrPolicyTampered {
+		t.Errorf("Tampered policy loaded: %v", err)
+	}
+}
+
+func TestPolicyRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := corecrypter.RandomKey(corecrypter.AES256)
+	fs := NewFS(FsConfig{
+		CipherDir: dir,
+		CryptType: corecrypter.AES256,
+		CryptKey:  key,
+		PlainBS:   4096,
+		Policy:    &Policy{Passthrough: []string{"/public/", "build/*.tar"}},
+	}, nil)
+	ctx := &fuse.Context{}
+	for _, d := range []string{"public", "build", "dist"} {
+		if st := fs.Mkdir(d, 0755, ctx); st != fuse.OK {
+			t.Fatalf("Mkdir %s failed: %v", d, st)
+		}
+	}
+	for _, p := range []string{"secret.txt", "public/readme"} {
+		f, st := fs.Create(p, uint32(os.O_WRONLY), 0644, ctx)
+		if st != fuse.OK {
+			t.Fatalf("Create %s failed: %v", p, st)
+		}
+		f.Write([]byte("content"), 0)
+		f.Release()
+	}
+
+	exdev := fuse.Status(syscall.EXDEV)
+	cases := []struct {
+		op       func(string, string, *fuse.Context) fuse.Status
+		from, to string
+		st       fuse.Status
+	}{
+		{fs.Rename, "secret.txt", "public/secret.txt", exdev},
+		{fs.Rename, "public/readme", "readme", exdev},
+		{fs.Link, "secret.txt", "public/link", exdev},
+		{fs.Rename, "secret.txt", "other.txt", fuse.OK},
+		{fs.Rename, "public/readme", "public/guide", fuse.OK},
+		{fs.Rename, "build", "out", exdev},
+		{fs.Rename, "dist", "build", exdev},
+		{fs.Rename, "dist", "build/dist", fuse.OK},
+	}
+	for _, c := range cases {
+		if st := c.op(c.from, c.to, ctx); st != c.st {
+			t.Errorf("%s -> %s: got %v, want %v", c.from, c.to, st, c.st)
+		}
+	}
+	attr, st := fs.GetAttr("public/guide", ctx)
+	if st != fuse.OK || attr.Size != 7 {
+		t.Errorf("Renamed passthrough file broken: %v, %v", attr, st)
+	}
+}
+
+func TestPolicyOpenDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := corecrypter.RandomKey(corecrypter.AES256)
+	// Matches the encrypted names but none of the plaintext ones
+	long := strings.Repeat("?", 20) + "*"
+	fs := NewFS(FsConfig{
+		CipherDir: dir,
+		CryptType: corecrypter.AES256,
+		CryptKey:  key,
+		PlainBS:   4096,
+		Policy:    &Policy{Passthrough: []string{long, "*.iso"}},
+	}, nil)
+	ctx := &fuse.Context{}
+	for _, p := range []string{"secret.txt", "image.iso"} {
+		f, st := fs.Create(p, uint32(os.O_WRONLY), 0644, ctx)
+		if st != fuse.OK {
+			t.Fatalf("Create %s failed: %v", p, st)
+		}
+		f.Release()
+	}
+	entries, st := fs.OpenDir("", ctx)
+	if st != fuse.OK {
+		t.Fatal(st)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "image.iso,secret.txt" {
+		t.Errorf("Wrong listing: %v", names)
+	}
+}
@@ -0,0 +1,169 @@
+package cffuse
+
+// Moving the nodes of a filesystem into another one, used to re-encrypt a cipher directory
+// under a new master key: the source and destination are the same tree encrypted with different keys.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// moveChunk is the size of the plaintext read and written at once
+const moveChunk = fuse.MAX_KERNEL_WRITE
+
+// moveContext acts as root, so modes don't stop reading and writing
+var moveContext = &fuse.Context{}
+
+// MoveTree moves every node of the filesystem `src` into `dst`. A node is removed from src after it is
+// written to dst, so an interrupted move resumes by calling MoveTree again.
+// `moved` is called with the path of every moved node, an error returned by it stops the move.
+// Hard links become separate files.
+func MoveTree(src *CfcryptFS, dst *CfcryptFS, moved func(path string) error) error {
+	return moveDir(src, dst, "", moved)
+}
+
+func moveDir(src *CfcryptFS, dst *CfcryptFS, dir string, moved func(path string) error) error {
+	entries, st := src.OpenDir(dir, moveContext)
+	if st != fuse.OK {
+		return fmt.Errorf("List %q failed: %v", dir, st)
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name)
+		attr, st := src.GetAttr(path, moveContext)
+		if st != fuse.OK {
+			return fmt.Errorf("Stat %q failed: %v", path, st)
+		}
+		var err error
+		switch e.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			err = moveDirNode(src, dst, path, attr, moved)
+		case syscall.S_IFREG, 0:
+			err = moveFile(src, dst, path, attr)
+		case syscall.S_IFLNK:
+			err = moveLink(src, dst, path, attr)
+		default:
+			dst.Unlink(path, moveContext)
+			if err = fuseErr("Create", path, dst.Mknod(path, attr.Mode, attr.Rdev, moveContext)); err == nil {
+				moveOwner(dst, path, attr)
+			}
+		}
+		if err == nil && !attr.IsDir() {
+			err = fuseErr("Remove", path, src.Unlink(path, moveContext))
+		}
+		if err == nil {
+			err = moved(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fuseErr(op string, path string, st fuse.Status) error {
+	if st == fuse.OK {
+		return nil
+	}
+	return fmt.Errorf("%s %q failed: %v", op, path, st)
+}
+
+func moveDirNode(src *CfcryptFS, dst *CfcryptFS, path string, attr *fuse.Attr, moved func(path string) error) error {
+	// Writable until filled, the mode is restored afterwards
+	if st := dst.Mkdir(path, 0700, moveContext); st != fuse.OK && st != fuse.Status(syscall.EEXIST) {
+		return fuseErr("Create", path, st)
+	}
+	if err := moveDir(src, dst, path, moved); err != nil {
+		return err
+	}
+	if st := src.Rmdir(path, moveContext); st != fuse.OK {
+		return fmt.Errorf("Remove %q failed: %v, entries which can't be decrypted are left in it", path, st)
+	}
+	moveOwner(dst, path, attr)
+	if err := fuseErr("Chmod", path, dst.Chmod(path, attr.Mode&07777, moveContext)); err != nil {
+		return err
+	}
+	atime, mtime := attr.AccessTime(), attr.ModTime()
+	return fuseErr("Utimens", path, dst.Utimens(path, &atime, &mtime, moveContext))
+}
+
+func moveFile(src *CfcryptFS, dst *CfcryptFS, path string, attr *fuse.Attr) error {
+	var sf nodefs.File
+	var st fuse.Status
+	if src.isPassthrough(path) {
+		sf, st = src.openPassthrough(path, uint32(os.O_RDONLY), moveContext)
+	} else {
+		sf, st = src.open(path, uint32(os.O_RDONLY), moveContext)
+	}
+	if st != fuse.OK {
+		return fuseErr("Open", path, st)
+	}
+	defer sf.Release()
+	// A partial copy is left by an interrupted move
+	dst.Unlink(path, moveContext)
+	// Writes don't check the mode, so read-only files are created with their mode as well
+	df, st := dst.Create(path, uint32(os.O_WRONLY|os.O_TRUNC), attr.Mode, moveContext)
+	if st != fuse.OK {
+		return fuseErr("Create", path, st)
+	}
+	buf := make([]byte, moveChunk)
+	for off := int64(0); off < int64(attr.Size); {
+		res, st := sf.Read(buf, off)
+		if st != fuse.OK {
+			df.Release()
+			return fuseErr("Read", path, st)
+		}
+		data, _ := res.Bytes(buf)
+		if len(data) == 0 {
+			break
+		}
+		if _, st = df.Write(data, off); st != fuse.OK {
+			df.Release()
+			return fuseErr("Write", path, st)
+		}
+		off += int64(len(data))
+	}
+	st = df.Fsync(0)
+	df.Release()
+	if st != fuse.OK {
+		return fuseErr("Fsync", path, st)
+	}
+	moveOwner(dst, path, attr)
+	if attr.Mode&(syscall.S_ISUID|syscall.S_ISGID) != 0 {
+		// Cleared by chown
+		if err := fuseErr("Chmod", path, dst.Chmod(path, attr.Mode&07777, moveContext)); err != nil {
+			return err
+		}
+	}
+	atime, mtime := attr.AccessTime(), attr.ModTime()
+	return fuseErr("Utimens", path, dst.Utimens(path, &atime, &mtime, moveContext))
+}
+
+func moveLink(src *CfcryptFS, dst *CfcryptFS, path string, attr *fuse.Attr) error {
+	target, st := src.Readlink(path, moveContext)
+	if st != fuse.OK {
+		return fuseErr("Readlink", path, st)
+	}
+	dst.Unlink(path, moveContext)
+	if err := fuseErr("Create", path, dst.Symlink(target, path, moveContext)); err != nil {
+		return err
+	}
+	moveOwner(dst, path, attr)
+	return nil
+}
+
+// moveOwner gives the moved node the owner in "attr", it is created owned by the user running the move.
+// A failed chown only warns, like Create under AllowOther.
+func moveOwner(dst *CfcryptFS, path string, attr *fuse.Attr) {
+	if cur, st := dst.GetAttr(path, moveContext); st == fuse.OK && cur.Uid == attr.Uid && cur.Gid == attr.Gid {
+		return
+	}
+	if st := dst.Chown(path, attr.Uid, attr.Gid, moveContext); st != fuse.OK {
+		tlog.Warn.Printf("Move: chown %q failed: %v", path, st)
+	}
+}
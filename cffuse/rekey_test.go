@@ -0,0 +1,208 @@
+package cffuse
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+func newRekeyTestFS(t *testing.T, dir string, flat bool, policy *Policy) (*CfcryptFS, []byte) {
+	key, err := corecrypter.RandomKey(corecrypter.AES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openRekeyTestFS(t, dir, key, flat, policy), key
+}
+
+func openRekeyTestFS(t *testing.T, dir string, key []byte, flat bool, policy *Policy) *CfcryptFS {
+	fs := NewFS(FsConfig{
+		CipherDir:  dir,
+		CryptType:  corecrypter.AES256,
+		CryptKey:   key,
+		PlainBS:    4096,
+		FlatLayout: flat,
+		Policy:     policy,
+	}, nil)
+	if fs == nil {
+		t.Fatalf("NewFS %s failed", dir)
+	}
+	return fs
+}
+
+func writeTestFile(t *testing.T, fs *CfcryptFS, path string, content string, mode uint32) {
+	f, st := fs.Create(path, uint32(os.O_WRONLY), mode, moveContext)
+	if st != fuse.OK {
+		t.Fatalf("Create %s failed: %v", path, st)
+	}
+	defer f.Release()
+	for off := 0; off < len(content); off += moveChunk {
+		end := off + moveChunk
+		if end > len(content) {
+			end = len(content)
+		}
+		if _, st = f.Write([]byte(content[off:end]), int64(off)); st != fuse.OK {
+			t.Fatalf("Write %s failed: %v", path, st)
+		}
+	}
+}
+
+// populateRekeyTree creates directories, files bigger than a move chunk, read-only nodes and a symlink
+func populateRekeyTree(t *testing.T, fs *CfcryptFS) {
+	for _, d := range []string{"a", "a/b", "public", "public/docs"} {
+		if st := fs.Mkdir(d, 0755, moveContext); st != fuse.OK {
+			t.Fatalf("Mkdir %s failed: %v", d, st)
+		}
+	}
+	writeTestFile(t, fs, "top.txt", "hello world", 0644)
+	writeTestFile(t, fs, "empty", "", 0600)
+	writeTestFile(t, fs, "a/ro.txt", "readonly", 0400)
+	writeTestFile(t, fs, "a/b/big.bin", strings.Repeat("0123456789abcdef", 3*moveChunk/16+100), 0600)
+	writeTestFile(t, fs, "public/readme", "plain text", 0644)
+	writeTestFile(t, fs, "public/docs/guide", "more plain text", 0644)
+	if st := fs.Symlink("a/ro.txt", "link", moveContext); st != fuse.OK {
+		t.Fatalf("Symlink failed: %v", st)
+	}
+	if st := fs.Chmod("a/b", 0550, moveContext); st != fuse.OK {
+		t.Fatalf("Chmod failed: %v", st)
+	}
+	if os.Geteuid() == 0 {
+		// Nodes of other users, as in a cipher directory mounted with AllowOther
+		for _, p := range []string{"a", "a/ro.txt", "public/readme", "link"} {
+			if st := fs.Chown(p, 1234, 5678, moveContext); st != fuse.OK {
+				t.Fatalf("Chown %s failed: %v", p, st)
+			}
+		}
+		writeTestFile(t, fs, "a/setuid", "#!/bin/true", 0755)
+		fs.Chown("a/setuid", 1234, 5678, moveContext)
+		if st := fs.Chmod("a/setuid", 04755, moveContext); st != fuse.OK {
+			t.Fatalf("Chmod failed: %v", st)
+		}
+	}
+}
+
+// dumpTree describes every node of fs by its path
+func dumpTree(t *testing.T, fs *CfcryptFS, dir string, out map[string]string) {
+	entries, st := fs.OpenDir(dir, moveContext)
+	if st != fuse.OK {
+		t.Fatalf("List %q failed: %v", dir, st)
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name)
+		attr, st := fs.GetAttr(path, moveContext)
+		if st != fuse.OK {
+			t.Fatalf("Stat %s failed: %v", path, st)
+		}
+		owner := fmt.Sprintf("%d:%d", attr.Uid, attr.Gid)
+		switch attr.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			out[path] = fmt.Sprintf("dir %o %s", attr.Mode&07777, owner)
+			dumpTree(t, fs, path, out)
+		case syscall.S_IFLNK:
+			target, _ := fs.Readlink(path, moveContext)
+			out[path] = "link " + target + " " + owner
+		default:
+			f, st := fs.Open(path, uint32(os.O_RDONLY), moveContext)
+			if st != fuse.OK {
+				t.Fatalf("Open %s failed: %v", path, st)
+			}
+			var content []byte
+			buf := make([]byte, moveChunk)
+			for off := int64(0); off < int64(attr.Size); {
+				res, st := f.Read(buf, off)
+				if st != fuse.OK {
+					t.Fatalf("Read %s failed: %v", path, st)
+				}
+				data, _ := res.Bytes(buf)
+				if len(data) == 0 {
+					break
+				}
+				content = append(content, data...)
+				off += int64(len(data))
+			}
+			f.Release()
+			out[path] = fmt.Sprintf("file %o %s %d %x", attr.Mode&07777, owner, attr.Size, sha256.Sum256(content))
+		}
+	}
+}
+
+func TestMoveTreeResume(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		flat   bool
+		policy *Policy
+	}{
+		{"encrypted", false, nil},
+		{"flat", true, nil},
+		{"passthrough", false, &Policy{Passthrough: []string{"/public/"}}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "cfcryptfs-rekey")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			srcDir, dstDir := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+			os.Mkdir(srcDir, 0700)
+			os.Mkdir(dstDir, 0700)
+			src, oldKey := newRekeyTestFS(t, srcDir, c.flat, c.policy)
+			populateRekeyTree(t, src)
+			want := map[string]string{}
+			dumpTree(t, src, "", want)
+
+			dst, newKey := newRekeyTestFS(t, dstDir, c.flat, c.policy)
+			// A partial copy left by a crash while writing
+			writeTestFile(t, dst, "top.txt", "hel", 0644)
+
+			// Every run is interrupted after moving one node and resumed by a new process
+			var moveErr error
+			runs := 0
+			for moveErr = errInterrupted; moveErr == errInterrupted; runs++ {
+				if runs > 2*len(want) {
+					t.Fatalf("Move doesn't finish")
+				}
+				src = openRekeyTestFS(t, srcDir, oldKey, c.flat, c.policy)
+				dst = openRekeyTestFS(t, dstDir, newKey, c.flat, c.policy)
+				moveErr = MoveTree(src, dst, func(path string) error {
+					return errInterrupted
+				})
+			}
+			if moveErr != nil {
+				t.Fatal(moveErr)
+			}
+			if runs < len(want) {
+				t.Errorf("Only %d runs for %d nodes", runs, len(want))
+			}
+
+			got := map[string]string{}
+			dumpTree(t, openRekeyTestFS(t, dstDir, newKey, c.flat, c.policy), "", got)
+			if len(got) != len(want) {
+				t.Errorf("Moved %d nodes, want %d", len(got), len(want))
+			}
+			for path, desc := range want {
+				if got[path] != desc {
+					t.Errorf("%s: got %q, want %q", path, got[path], desc)
+				}
+			}
+			if entries, st := openRekeyTestFS(t, srcDir, oldKey, c.flat, c.policy).OpenDir("", moveContext); st != fuse.OK || len(entries) != 0 {
+				t.Errorf("Source not empty: %v, %v", entries, st)
+			}
+			if c.policy != nil {
+				data, err := ioutil.ReadFile(filepath.Join(dstDir, "public", "docs", "guide"))
+				if err != nil || string(data) != "more plain text" {
+					t.Errorf("Passthrough file not stored in plaintext: %q, %v", data, err)
+				}
+			}
+		})
+	}
+}
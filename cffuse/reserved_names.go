@@ -3,10 +3,30 @@ package cffuse
 const (
 	// ConfFile save configurations
 	ConfFile = ".cfcryptfs.cfg"
+	// ConfFileTmp is used when writing the config file
+	ConfFileTmp = ".cfcryptfs.cfg.tmp"
 	// KeyFile save encrypted key
 	KeyFile = ".cfcryptfs.key"
-	// KeyFileTmp is used when changing pwd
+	// KeyFileTmp is used when writing the key file
 	KeyFileTmp = ".cfcryptfs.key.tmp"
+	// RecipientKeyFile save the key encrypted to public key recipients
+	RecipientKeyFile = ".cfcryptfs.age"
+	// RecipientKeyFileTmp is used when writing the recipient key file
+	RecipientKeyFileTmp = ".cfcryptfs.age.tmp"
+	// SSHKeyFile save the key wrapped with ssh-agent signatures
+	SSHKeyFile = ".cfcryptfs.ssh"
+	// SSHKeyFileTmp is used when writing the ssh key file
+	SSHKeyFileTmp = ".cfcryptfs.ssh.tmp"
+	// PolicyFile save the selective encryption policy
+	PolicyFile = ".cfcryptfs.policy"
+	// PolicyFileTmp is used when writing the policy file
+	PolicyFileTmp = ".cfcryptfs.policy.tmp"
+	// RekeyDir holds the cipher directory re-encrypted under a new master key during a rekey
+	RekeyDir = ".cfcryptfs.rekey"
+	// RekeyJournal records the progress of a rekey
+	RekeyJournal = ".cfcryptfs.rekey.journal"
+	// RekeyJournalTmp is used when writing the rekey journal
+	RekeyJournalTmp = ".cfcryptfs.rekey.journal.tmp"
 )
 
 // ReservedNames stores names reserved for filesystem
@@ -16,11 +36,21 @@ var ReservedNames []string
 var ReservedNameMap map[string]bool
 
 func init() {
-	ReservedNames = []string{ConfFile, KeyFile, KeyFileTmp}
+	ReservedNames = []string{ConfFile, ConfFileTmp, KeyFile, KeyFileTmp, RecipientKeyFile, RecipientKeyFileTmp, SSHKeyFile, SSHKeyFileTmp, PolicyFile, PolicyFileTmp, RekeyDir, RekeyJournal, RekeyJournalTmp}
 	ReservedNameMap = map[string]bool{
-		ConfFile:   true,
-		KeyFile:    true,
-		KeyFileTmp: true,
+		ConfFile:            true,
+		ConfFileTmp:         true,
+		KeyFile:             true,
+		KeyFileTmp:          true,
+		RecipientKeyFile:    true,
+		RecipientKeyFileTmp: true,
+		SSHKeyFile:          true,
+		SSHKeyFileTmp:       true,
+		PolicyFile:          true,
+		PolicyFileTmp:       true,
+		RekeyDir:            true,
+		RekeyJournal:        true,
+		RekeyJournalTmp:     true,
 	}
 }
 
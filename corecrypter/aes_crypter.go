@@ -88,3 +88,12 @@ func (ac *AesCrypter) Decrypt(dest, src []byte) error {
 	}
 	return nil
 }
+
+// Wipe zeroes the key. The key schedule inside the cipher package can't be reached,
+// it is dropped, so using the crypter afterwards panics instead of encrypting with a zero key.
+func (ac *AesCrypter) Wipe() {
+	for i := range ac.key {
+		ac.key[i] = 0
+	}
+	ac.cipherBlock = nil
+}
@@ -18,6 +18,12 @@ type CoreCrypter interface {
 	Decrypt(dest, src []byte) error
 }
 
+// Wiper is implemented by core crypters that can zero their key
+type Wiper interface {
+	// Wipe zeroes the key, the crypter can't be used afterwards
+	Wipe()
+}
+
 // RandomBytes generate a random bytes
 func RandomBytes(len int) ([]byte, error) {
 	data := make([]byte, len)
@@ -81,3 +81,12 @@ func (dc *DesCrypter) Decrypt(dest, src []byte) error {
 	}
 	return nil
 }
+
+// Wipe zeroes the key. The key schedule inside the cipher package can't be reached,
+// it is dropped, so using the crypter afterwards panics instead of encrypting with a zero key.
+func (dc *DesCrypter) Wipe() {
+	for i := range dc.key {
+		dc.key[i] = 0
+	}
+	dc.cipherBlock = nil
+}
@@ -8,31 +8,62 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/declan94/cfcryptfs/cffuse"
 	"github.com/declan94/cfcryptfs/internal/exitcode"
 	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/declan94/cfcryptfs/keycrypter"
+	"github.com/declan94/cfcryptfs/readpwd"
 )
 
 var flagSet *flag.FlagSet
 
 // Args contains cli args value
 type Args struct {
-	CipherDir  string
-	MountPoint string
-	PwdFile    string
-	Password   string
-	Emergency  string
-	KeyFiles   string
-	DebugFuse  bool
-	Debug      bool
-	Init       bool
-	Info       bool
-	ChangePwd  bool
-	Export     bool
-	Recover    bool
-	Foreground bool
-	AllowOther bool
-	ParentPid  int
+	CipherDir    string
+	MountPoint   string
+	PwdFile      string
+	Password     string
+	Extpass      string
+	Pinentry     string
+	EnvFile      string
+	Emergency    string
+	KeyFiles     string
+	Policy       string
+	KeyFile      string
+	NewKeyFile   string
+	Slot         string
+	SlotID       int
+	SlotLabel    string
+	DebugFuse    bool
+	Debug        bool
+	Init         bool
+	Info         bool
+	ChangePwd    bool
+	Export       bool
+	Recover      bool
+	Conflicts    bool
+	Convert      bool
+	Reshare      bool
+	Rekey        bool
+	Foreground   bool
+	AllowOther   bool
+	LostFound    bool
+	MlockAll     bool
+	Calibrate    bool
+	PurgeKeys    bool
+	Paper        string
+	Identity     string
+	Recipients   stringList
+	RecipientCmd string
+	KeyGen       string
+	UnlockTime   time.Duration
+	// Options are the flags set on the command line by name, for the key providers
+	Options map[string]string
+	// KDF - kdf parameters for new key files, unset costs take the defaults
+	KDF       keycrypter.KDFParams
+	ParentPid int
 }
 
 func printMyFlagSet(avoid map[string]bool) {
@@ -52,8 +83,17 @@ func printMyFlagSet(avoid map[string]bool) {
 
 func usage() {
 	fmt.Printf("Usage: %s [options] CIPHERDIR MOUNTPOINT\n", path.Base(os.Args[0]))
-	fmt.Printf("   or: %s -init|-info|-chpwd|-export CIPHERDIR\n", path.Base(os.Args[0]))
-	fmt.Printf("   or: %s -export|-recover [-emergency_file FILE] CIPHERDIR\n", path.Base(os.Args[0]))
+	fmt.Printf("   or: %s -init|-info|-chpwd|-export|-conflicts|-convert|-reshare|-rekey CIPHERDIR\n", path.Base(os.Args[0]))
+	fmt.Printf("   or: %s -init [-init_spec FILE] [-json] [-cipher ...] [-protection ...] CIPHERDIR\n", path.Base(os.Args[0]))
+	fmt.Printf("   or: %s -export [-recipient age1...] [-emergency_file FILE] CIPHERDIR\n", path.Base(os.Args[0]))
+	fmt.Printf("   or: %s -recover [-identity FILE] [-emergency_file FILE] CIPHERDIR\n", path.Base(os.Args[0]))
+	fmt.Printf("   or: %s -policy PATTERNFILE CIPHERDIR\n", path.Base(os.Args[0]))
+	fmt.Printf("   or: %s -slot add|list|test|remove [-slot_id ID] [-slot_label LABEL] [-new_keyfile FILE] CIPHERDIR\n", path.Base(os.Args[0]))
+	fmt.Printf("   or: %s -calibrate [-kdf KDF] [-unlock_time TIME] [-kdf_memory MiB]\n", path.Base(os.Args[0]))
+	fmt.Printf("   or: %s -recipients add|list|remove [-recipient age1...] [-identity FILE] CIPHERDIR\n", path.Base(os.Args[0]))
+	fmt.Printf("   or: %s -paper KEYFILE|EMERGENCYFILE\n", path.Base(os.Args[0]))
+	fmt.Printf("   or: %s -keygen IDENTITYFILE\n", path.Base(os.Args[0]))
+	fmt.Printf("   or: %s -purge_keys [CIPHERDIR]\n", path.Base(os.Args[0]))
 	fmt.Printf("\noptions:\n")
 	printMyFlagSet(map[string]bool{
 		"debug":      true,
@@ -66,10 +106,19 @@ func usage() {
 func ParseArgs() (args Args) {
 	flagSet = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 
-	flagSet.StringVar(&args.Emergency, "emergency_file", "", "Emergency mode. Specify the emergency filepath.")
+	flagSet.StringVar(&args.Emergency, "emergency_file", "", "Emergency mode. Specify the emergency filepath, - to type in a paper backup.")
 	flagSet.StringVar(&args.PwdFile, "passfile", "", "Password file path.")
 	flagSet.StringVar(&args.Password, "password", "", "Specify password.")
-	flagSet.StringVar(&args.KeyFiles, "keys", "", "Specify split keyfiles separated by comma. (In multiple keyfiles mode)")
+	flagSet.StringVar(&args.Extpass, "extpass", "", "Read passwords from the first output line of this command. \n$"+readpwd.EnvPurpose+" is \"unlock\", or \"new\" for -init/-chpwd.")
+	flagSet.StringVar(&args.Pinentry, "pinentry", "", "Prompt for passwords with this pinentry program (e.g. pinentry-gnome3), no terminal needed.")
+	flagSet.StringVar(&args.EnvFile, "env_file", "", "Read the password from "+readpwd.EnvPassword+"=... in this environment file, \nand a new password for -init/-chpwd from "+readpwd.EnvNewPassword+" if set. \nWithout these flags the systemd credential "+readpwd.CredentialName+" (or "+readpwd.NewCredentialName+") \nin $CREDENTIALS_DIRECTORY is used if present.")
+	flagSet.StringVar(&args.KeyFiles, "keys", "", "Specify split keyfiles separated by comma, - to type in a paper backup. (In multiple keyfiles mode) \nor the keyfile of the password in password and keyfile mode.")
+	flagSet.StringVar(&args.KeyFile, "keyfile", "", "Unlock with a keyfile slot instead of password.")
+	flagSet.StringVar(&args.Slot, "slot", "", "Manage key slots of a password protected cipher directory: add/list/test/remove.")
+	flagSet.IntVar(&args.SlotID, "slot_id", -1, "Key slot to remove.")
+	flagSet.StringVar(&args.SlotLabel, "slot_label", "", "Label of the key slot to add.")
+	flagSet.StringVar(&args.NewKeyFile, "new_keyfile", "", "Add a keyfile slot with this keyfile instead of a password slot, \nor the keyfile of -init with password and keyfile protection (created if it doesn't exist).")
+	flagSet.StringVar(&args.Policy, "policy", "", "Set the selective encryption policy from a file of glob patterns (one per line) \nof paths stored unencrypted. An empty file encrypts everything.")
 	flagSet.BoolVar(&args.DebugFuse, "debugfuse", false, "Show fuse Debug messages.")
 	flagSet.BoolVar(&args.Debug, "debug", false, "Debug mode - internal use")
 	flagSet.BoolVar(&args.Init, "init", false, "Initialize a cipher directory.")
@@ -77,18 +126,109 @@ func ParseArgs() (args Args) {
 	flagSet.BoolVar(&args.ChangePwd, "chpwd", false, "Change password of a cipher directory.")
 	flagSet.BoolVar(&args.Export, "export", false, "Export configs and key for emergency usage.")
 	flagSet.BoolVar(&args.Recover, "recover", false, "Recover cipher directory's config and key.")
+	flagSet.BoolVar(&args.Conflicts, "conflicts", false, "List sync conflict copies in a cipher directory and resolve them.")
+	flagSet.BoolVar(&args.Convert, "convert", false, "Switch the key protection between password and multiple keyfiles.")
+	flagSet.BoolVar(&args.Reshare, "reshare", false, "Split the key into a new set of keyfiles given by `-shares` and `-threshold`, the keyfiles given by `-keys` stop working.")
+	flagSet.BoolVar(&args.Rekey, "rekey", false, "Re-encrypt a cipher directory under a new master key, run it again to resume after an interruption. \nThe cipher directory must not be mounted.")
 	flagSet.BoolVar(&args.Foreground, "f", false, "Run in the Foreground.")
 	flagSet.BoolVar(&args.AllowOther, "allow_other", false, "Allow other users to access the filesystem. \nOnly works if user_allow_other is set in /etc/fuse.conf.")
+	flagSet.BoolVar(&args.LostFound, "lost_found", false, "Show entries that can't be decrypted (e.g. sync conflict copies) with their raw names \nin the virtual directory "+cffuse.LostFoundDir+" under the mountpoint.")
+	flagSet.BoolVar(&args.MlockAll, "mlockall", false, "Lock all memory of the mounted filesystem into RAM, so no plaintext is swapped out. \nNeeds a large enough \"ulimit -l\".")
+	flagSet.BoolVar(&args.Calibrate, "calibrate", false, "Benchmark this machine and propose kdf parameters for the target unlock time.")
+	flagSet.Var(&args.Recipients, "recipient", "Age recipient (age1...) of the key for -init/-convert/-recover/-recipients, \nor of the emergency file for -export instead of a passphrase. May be repeated.")
+	flagSet.StringVar(&args.Identity, "identity", "", "Age identity file to unlock a public key protected cipher directory, \nor an emergency file encrypted to recipients.")
+	flagSet.StringVar(&args.RecipientCmd, "recipients", "", "Manage recipients of a public key protected cipher directory: add/list/remove.")
+	flagSet.StringVar(&args.KeyGen, "keygen", "", "Generate an age identity file and print its public key.")
+	flagSet.StringVar(&args.Paper, "paper", "", "Print a paper backup of a split keyfile or an emergency file.")
+	flagSet.DurationVar(&args.UnlockTime, "unlock_time", time.Second, "Target unlock time for -calibrate.")
+	var keyring string
+	var keyringTimeout time.Duration
+	flagSet.StringVar(&keyring, "keyring", "", "Cache the unlocked key in the kernel keyring (user/session), \nlater mounts of the same cipher directory in this session reuse it. (Linux)")
+	flagSet.DurationVar(&keyringTimeout, "keyring_timeout", DefaultKeyringTimeout, "Expiry of the key cached with -keyring, 0 keeps it until purged.")
+	flagSet.BoolVar(&args.PurgeKeys, "purge_keys", false, "Remove the cached key of a cipher directory from the kernel keyring, \nor all cached keys without CIPHERDIR.")
+	var initSpec string
+	// The choices of -init are read from the options
+	flagSet.String("cipher", "", "Encryption type of -init (DES/AES128/AES192/AES256).")
+	flagSet.String("block_size", "", "Plaintext block size of -init in bytes or with a K suffix, a power of 2 from 512 to 128K.")
+	flagSet.String("path_mode", "", "Path mode of -init: encrypted, plain or flat (hides the directory structure).")
+	flagSet.String("protection", "", "Key protection of -init by provider name: password, sss, age, ssh, kms, 2fa, or a custom one.")
+	flagSet.String("shares", "", "Paths of the split keyfiles of -init with sss protection, separated by comma.")
+	flagSet.Int("threshold", 0, "Count of split keyfiles needed to unlock, for -init with sss protection.")
+	flagSet.String("kms_address", "", "KMS address (https) of -init and of unlocking with kms protection, $VAULT_ADDR by default.")
+	flagSet.String("kms_mount", "", "Transit mount of -init with kms protection.")
+	flagSet.String("kms_key", "", "Transit key name of -init with kms protection.")
+	flagSet.String("ssh_keys", "", "SHA256 fingerprints of the ssh-agent keys of -init with ssh protection, separated by comma.")
+	flagSet.StringVar(&initSpec, "init_spec", "", "JSON file with the choices of -init, flags given on the command line take precedence. \nChoices missing in it take defaults instead of being asked for.")
+	flagSet.Bool("json", false, "Print the result of -init as JSON, choices not given by flags take defaults instead of being asked for.")
+	var minPwdScore int
+	var pwdDenylist string
+	var allowWeakPwd bool
+	flagSet.IntVar(&minPwdScore, "min_pwd_score", readpwd.DefaultMinScore, fmt.Sprintf("Minimum strength score (0-%d) of new passwords for -init/-chpwd/-slot add.", readpwd.MaxScore))
+	flagSet.StringVar(&pwdDenylist, "pwd_denylist", "", "File of passwords to reject in addition to common ones, one per line.")
+	flagSet.BoolVar(&allowWeakPwd, "allow_weak_password", false, "Accept any new password, e.g. for scripted test vaults.")
+	var kdf string
+	var kdfMemory int
+	flagSet.StringVar(&kdf, "kdf", "argon2id", "Key derivation function for -init/-chpwd (argon2id/scrypt).")
+	flagSet.IntVar(&args.KDF.Time, "kdf_time", 0, "Argon2id time cost (passes) for -init/-chpwd.")
+	flagSet.IntVar(&kdfMemory, "kdf_memory", 0, "Argon2id memory cost in MiB for -init/-chpwd, maximum memory for -calibrate.")
+	flagSet.IntVar(&args.KDF.Threads, "kdf_threads", 0, "Argon2id parallelism for -init/-chpwd.")
+	flagSet.IntVar(&args.KDF.N, "scrypt_n", 0, "scrypt cost N (power of 2) for -init/-chpwd.")
+	flagSet.IntVar(&args.KDF.R, "scrypt_r", 0, "scrypt block size r for -init/-chpwd.")
+	flagSet.IntVar(&args.KDF.P, "scrypt_p", 0, "scrypt parallelism p for -init/-chpwd.")
 	flagSet.IntVar(&args.ParentPid, "parent_pid", 0, "Parent process pid - internal use")
 
 	flagSet.Usage = usage
 	flagSet.Parse(os.Args[1:])
+	if initSpec != "" {
+		if err := applyInitSpec(initSpec); err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcode.Usage)
+		}
+	}
+	if keyring != "" && keyring != keycrypter.KeyringUser && keyring != keycrypter.KeyringSession {
+		tlog.Fatal.Printf("Unknown keyring %q, use %s or %s", keyring, keycrypter.KeyringUser, keycrypter.KeyringSession)
+		os.Exit(exitcode.Usage)
+	}
+	if minPwdScore < 0 || minPwdScore > readpwd.MaxScore {
+		tlog.Fatal.Printf("-min_pwd_score must be 0 to %d", readpwd.MaxScore)
+		os.Exit(exitcode.Usage)
+	}
+	args.Options = map[string]string{}
+	flagSet.Visit(func(f *flag.Flag) {
+		args.Options[f.Name] = f.Value.String()
+	})
+
+	var err error
+	if args.KDF.KDF, err = keycrypter.ParseKDF(kdf); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcode.Usage)
+	}
+	args.KDF.Memory = kdfMemory * 1024
+	for _, r := range args.Recipients {
+		if _, err = keycrypter.ParseAgeRecipient(r); err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcode.Usage)
+		}
+	}
+	if args.PurgeKeys && flagSet.NArg() == 0 {
+		return args
+	}
+	if args.Calibrate || args.Paper != "" || args.KeyGen != "" {
+		if flagSet.NArg() != 0 {
+			usage()
+		}
+		return args
+	}
+	args.KDF = withDefaultCosts(args.KDF)
+	if err = args.KDF.Validate(); err != nil {
+		tlog.Fatal.Printf("Invalid kdf parameters: %v", err)
+		os.Exit(exitcode.Usage)
+	}
 
 	if flagSet.NArg() < 1 {
 		usage()
 	}
 	// check directories
-	var err error
 	args.CipherDir, err = filepath.Abs(flagSet.Arg(0))
 	if err != nil {
 		tlog.Fatal.Printf("Invalid cipherdir: %v", err)
@@ -107,7 +247,7 @@ func ParseArgs() (args Args) {
 			tlog.Fatal.Printf("Invalid cipherdir: %v", err)
 			os.Exit(exitcode.CipherDir)
 		}
-	} else if args.Info || args.ChangePwd || args.Export || args.Recover {
+	} else if args.Info || args.ChangePwd || args.Export || args.Recover || args.Conflicts || args.Convert || args.Reshare || args.Rekey || args.PurgeKeys || args.Policy != "" || args.Slot != "" || args.RecipientCmd != "" {
 		if flagSet.NArg() != 1 {
 			usage()
 		}
@@ -135,6 +275,32 @@ func ParseArgs() (args Args) {
 	return args
 }
 
+// stringList is a flag that may be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// withDefaultCosts fills unset costs of kp with the defaults of its kdf
+func withDefaultCosts(kp keycrypter.KDFParams) keycrypter.KDFParams {
+	def := keycrypter.DefaultKDFParams(kp.KDF)
+	for _, c := range []struct{ v, d *int }{
+		{&kp.N, &def.N}, {&kp.R, &def.R}, {&kp.P, &def.P},
+		{&kp.Time, &def.Time}, {&kp.Memory, &def.Memory}, {&kp.Threads, &def.Threads},
+	} {
+		if *c.v == 0 {
+			*c.v = *c.d
+		}
+	}
+	return kp
+}
+
 // checkDirEmpty - check if "dir" exists and is an empty directory
 func checkDirEmpty(dir string) error {
 	err := checkDir(dir)
@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/declan94/cfcryptfs/keycrypter"
+)
+
+const defaultCalibrateMemory = 256 * 1024
+
+// CalibrateKDF benchmarks this machine and prints kdf parameters for unlocking in about "target" time.
+// maxMemory is in KiB, 0 means 256MiB.
+func CalibrateKDF(kdf int, target time.Duration, maxMemory int) {
+	if maxMemory == 0 {
+		maxMemory = defaultCalibrateMemory
+	}
+	fmt.Printf("Benchmarking, target unlock time %v...\n", target)
+	kp, d, err := keycrypter.Calibrate(kdf, target, maxMemory)
+	if err != nil {
+		tlog.Fatal.Printf("Calibrate failed: %v", err)
+		os.Exit(exitcode.Usage)
+	}
+	fmt.Printf("Proposed: %s, estimated unlock time %v\n", kp, d.Round(time.Millisecond))
+	switch kdf {
+	case keycrypter.KDFScrypt:
+		fmt.Printf("Use with -init/-chpwd: -kdf scrypt -scrypt_n %d -scrypt_r %d -scrypt_p %d\n", kp.N, kp.R, kp.P)
+	default:
+		fmt.Printf("Use with -init/-chpwd: -kdf argon2id -kdf_time %d -kdf_memory %d -kdf_threads %d\n", kp.Time, kp.Memory/1024, kp.Threads)
+	}
+}
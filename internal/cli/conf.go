@@ -8,7 +8,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"os/exec"
 	"os/user"
 
 	"github.com/declan94/cfcryptfs/cffuse"
@@ -16,7 +15,6 @@ import (
 	"github.com/declan94/cfcryptfs/internal/exitcode"
 	"github.com/declan94/cfcryptfs/internal/tlog"
 	"github.com/declan94/cfcryptfs/keycrypter"
-	"github.com/declan94/cfcryptfs/readpwd"
 )
 
 const currentVersion = 0
@@ -27,8 +25,27 @@ const (
 	KeyCryptTypePWD = 0
 	// KeyCryptTypeSSS key crypt using Shamir's Secret Sharing scheme
 	KeyCryptTypeSSS = 1
+	// KeyCryptTypeAGE key crypt to public key recipients in age format
+	KeyCryptTypeAGE = 2
+	// KeyCryptTypeSSH key crypt with ssh-agent signatures
+	KeyCryptTypeSSH = 3
+	// KeyCryptTypeKMS key wrapped by a remote KMS (Vault transit API)
+	KeyCryptTypeKMS = 4
+	// KeyCryptType2FA key crypt using password and the content of a keyfile together
+	KeyCryptType2FA = 5
+	// KeyCryptTypeCustom key protected by the key provider in CipherConfig.KeyProvider
+	KeyCryptTypeCustom = -1
 )
 
+var keyCryptTypeNames = map[int]string{
+	KeyCryptTypePWD: "password",
+	KeyCryptTypeSSS: "multiple keyfiles",
+	KeyCryptTypeAGE: "public key recipients",
+	KeyCryptTypeSSH: "ssh-agent",
+	KeyCryptTypeKMS: "remote KMS",
+	KeyCryptType2FA: "password and keyfile",
+}
+
 // CipherConfig is the content of a config file.
 type CipherConfig struct {
 	Version      int
@@ -37,18 +54,51 @@ type CipherConfig struct {
 	PlainBS      int
 	KeyCryptType int
 	PlainPath    bool
+	FlatLayout   bool
+	// VaultID identifies the cipher directory in its split keyfiles
+	VaultID string
+	// SplitEpoch is increased every time the key is split into new keyfiles,
+	// keyfiles of an older split are rejected
+	SplitEpoch uint32
+	// SplitShares keyfiles were created, SplitThreshold of them unlock the key
+	SplitShares    int
+	SplitThreshold int
+	// KeyProvider names the registered key provider of KeyCryptTypeCustom
+	KeyProvider string `json:",omitempty"`
+	// KeyParams are the parameters of the key provider
+	KeyParams map[string]string `json:",omitempty"`
 }
 
 func (cfg *CipherConfig) String() string {
-	return fmt.Sprintf("On-disk Version: %d\nEncryption Type: %s\nPlaintext Block Size: %.2fKB\nEncrypt Filepath: %v\n",
-		cfg.Version, cfg.CryptTypeStr, float32(cfg.PlainBS)/1024, !cfg.PlainPath)
+	return fmt.Sprintf("On-disk Version: %d\nEncryption Type: %s\nPlaintext Block Size: %.2fKB\nEncrypt Filepath: %v\nFlattened Layout: %v\n",
+		cfg.Version, cfg.CryptTypeStr, float32(cfg.PlainBS)/1024, !cfg.PlainPath, cfg.FlatLayout)
 }
 
-// InitCipherDir initialize a cipher directory
-func InitCipherDir(cipherDir string) {
+// InitCipherDir initialize a cipher directory, a password protected key is derived with kdf parameters kp,
+// the key provider gets the command line options `opts`.
+// Choices given by the options "cipher", "block_size", "path_mode" and "protection" are not asked for,
+// in batch mode (-init_spec or -json) missing ones take defaults and option "json" prints the result as JSON.
+func InitCipherDir(cipherDir string, kp keycrypter.KDFParams, opts map[string]string) {
+	stdout := os.Stdout
+	if opts["json"] == "true" {
+		// Only the result goes to stdout
+		os.Stdout = os.Stderr
+		tlog.Info.SetOutput(os.Stderr)
+	}
+	batch := batchInit(opts)
 	var input string
 	var conf CipherConfig
 	conf.Version = currentVersion
+	conf.VaultID = keycrypter.NewVaultID()
+	if opts["cipher"] == "" && batch {
+		opts["cipher"] = "AES256"
+	}
+	if opts["cipher"] != "" {
+		conf.CryptTypeStr = strings.ToUpper(opts["cipher"])
+		if conf.CryptType = str2CryptType(conf.CryptTypeStr); conf.CryptType == 0 {
+			os.Exit(exitcode.Usage)
+		}
+	}
 	for conf.CryptType == 0 {
 		fmt.Printf("Choose an encryption type (DES/AES128/AES192/AES256): ")
 		input = ""
@@ -56,17 +106,42 @@ func InitCipherDir(cipherDir string) {
 		conf.CryptTypeStr = input
 		conf.CryptType = str2CryptType(input)
 	}
+	if opts["block_size"] == "" && batch {
+		conf.PlainBS = blockSize(1)
+	}
+	if opts["block_size"] != "" {
+		var err error
+		if conf.PlainBS, err = parseBlockSize(opts["block_size"]); err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcode.Usage)
+		}
+	}
 	for conf.PlainBS == 0 {
 		fmt.Printf("Choose a block size(1: 4KB; 2: 8KB; 3: 16KB; 4:32KB): ")
 		fmt.Scanf("%d\n", &conf.PlainBS)
 		conf.PlainBS = blockSize(conf.PlainBS)
 	}
 
-	fmt.Printf("Whether encrypt filepath? (Y/n)")
-	input = ""
-	fmt.Scanln(&input)
-	input = strings.Trim(input, " \t")
-	conf.PlainPath = (strings.ToUpper(input) == "N")
+	switch opts["path_mode"] {
+	case PathModeFlat:
+		conf.FlatLayout = true
+	case PathModePlain:
+		conf.PlainPath = true
+	case PathModeEncrypted:
+	case "":
+		if batch {
+			break
+		}
+		// The flattened layout is only chosen by -path_mode, a prompt would shift piped answers
+		fmt.Printf("Whether encrypt filepath? (Y/n)")
+		input = ""
+		fmt.Scanln(&input)
+		input = strings.Trim(input, " \t")
+		conf.PlainPath = (strings.ToUpper(input) == "N")
+	default:
+		tlog.Fatal.Printf("Unknown path mode %q, use %s, %s or %s", opts["path_mode"], PathModeEncrypted, PathModePlain, PathModeFlat)
+		os.Exit(exitcode.Usage)
+	}
 
 	// Genreate a random key
 	key, err := corecrypter.RandomKey(conf.CryptType)
@@ -75,23 +150,19 @@ func InitCipherDir(cipherDir string) {
 		os.Exit(exitcode.KeyFile)
 	}
 
-	for {
-		var t int
-		fmt.Printf("Choose a key protection type (1: Password, 2: Multi Key File): ")
-		fmt.Scanf("%d\n", &t)
-		if t == 1 || t == 2 {
-			conf.KeyCryptType = t - 1
-			break
-		}
+	protection := opts["protection"]
+	if protection == "" && batch {
+		protection = builtinProviders[KeyCryptTypePWD]
 	}
-
-	switch conf.KeyCryptType {
-	case KeyCryptTypePWD:
-		SaveKey(cipherDir, key)
-	case KeyCryptTypeSSS:
-		SaveKeySSS(cipherDir, key)
-	default:
+	if protection == "" {
+		protection = askKeyProvider("Choose a key protection type", "")
+	} else if _, err = keycrypter.LookupKeyProvider(protection); err != nil || protection == EmergencyProvider {
+		tlog.Fatal.Printf("Unknown key protection %q, choose from: %s", protection, strings.Join(keyProviderChoices(), ", "))
+		os.Exit(exitcode.Usage)
 	}
+	setProvider(&conf, protection)
+
+	saveKeyProtection(cipherDir, key, &conf, kp, opts)
 
 	err = SaveConf(filepath.Join(cipherDir, cffuse.ConfFile), conf)
 	if err != nil {
@@ -101,40 +172,51 @@ func InitCipherDir(cipherDir string) {
 
 	fmt.Printf("\nInitialize directory finished: %s", cipherDir)
 	fmt.Printf(conf.String())
+	if opts["json"] == "true" {
+		fmt.Fprintln(stdout, tlog.JSONDump(newInitResult(cipherDir, &conf, opts)))
+	}
 }
 
-// ChangeCipherPwd changes password
-func ChangeCipherPwd(cipherDir string) {
-	key := LoadKey(cipherDir, "", "")
-	var pwd string
-	var err error
-	for {
-		fmt.Println("Enter your new password")
-		pwd, err = readpwd.Twice("")
-		if err != nil {
-			tlog.Warn.Println(err)
-		} else {
-			break
-		}
+// ChangeCipherPwd changes the password of the key slot unlocked by the current password.
+// The slot is re-encrypted with kdf parameters kp, so old scrypt key files are upgraded
+// while the master key stays the same. Other slots are untouched.
+// A two-factor protected key changes its password or keyfile, the current keyfile is given in `opts`.
+func ChangeCipherPwd(cipherDir string, kp keycrypter.KDFParams, opts map[string]string) {
+	conf := LoadConf(cipherDir)
+	if conf.KeyCryptType == KeyCryptType2FA {
+		changeTwoFactor(cipherDir, kp, opts)
+		return
 	}
-	exec.Command("rm", filepath.Join(cipherDir, cffuse.KeyFileTmp)).Run()
-	err = exec.Command("mv", filepath.Join(cipherDir, cffuse.KeyFile), filepath.Join(cipherDir, cffuse.KeyFileTmp)).Run()
+	if conf.KeyCryptType != KeyCryptTypePWD {
+		tlog.Fatal.Printf("This cipher directory is protected by %s, use `-convert` to switch to password protection", protectionName(&conf))
+		os.Exit(exitcode.Usage)
+	}
+	path := filepath.Join(cipherDir, cffuse.KeyFile)
+	ks := readKeySlots(cipherDir)
+	key, id, err := ks.UnlockWith("", "", "")
 	if err != nil {
-		tlog.Fatal.Printf("Backup old keyfile failed: %v", err)
+		tlog.Fatal.Println(err)
 		os.Exit(exitcode.KeyFile)
 	}
-	err = keycrypter.StoreKey(filepath.Join(cipherDir, cffuse.KeyFile), pwd, key)
+	oldKDF := ks.Slot(id).KDF()
+	fmt.Println("Enter your new password")
+	pwd, err := askNewPassword(opts)
 	if err != nil {
-		tlog.Fatal.Printf("Store new keyfile failed: %v\n", err)
-		err = exec.Command("mv", filepath.Join(cipherDir, cffuse.KeyFileTmp), filepath.Join(cipherDir, cffuse.KeyFile)).Run()
-		if err != nil {
-			tlog.Fatal.Printf("Recover old keyfile failed: %v", err)
-			tlog.Info.Printf("You may need to use emergency mode")
-		}
+		tlog.Fatal.Println(err)
+		os.Exit(keyProviderExit(err))
+	}
+	if err = ks.Update(id, []byte(pwd), key, kp); err != nil {
+		tlog.Fatal.Printf("Encrypt key failed: %v", err)
 		os.Exit(exitcode.KeyFile)
 	}
-	exec.Command("rm", filepath.Join(cipherDir, cffuse.KeyFileTmp)).Run()
-	fmt.Printf("\nPassword changed: %s\n", cipherDir)
+	if err = ks.Write(path); err != nil {
+		tlog.Fatal.Printf("Store new keyfile failed: %v", err)
+		os.Exit(exitcode.KeyFile)
+	}
+	fmt.Printf("\nPassword of key slot %d changed: %s\n", id, cipherDir)
+	if newKDF := ks.Slot(id).KDF(); newKDF != oldKDF {
+		fmt.Printf("Key derivation upgraded: %s -> %s\n", oldKDF, newKDF)
+	}
 }
 
 // InfoCipherDir print information about a cipher directory
@@ -142,6 +224,23 @@ func InfoCipherDir(cipherDir string) {
 	conf := LoadConf(cipherDir)
 	fmt.Printf("Cipher Directory: %s", cipherDir)
 	fmt.Printf(conf.String())
+	if conf.VaultID != "" {
+		fmt.Printf("Vault ID: %s\n", conf.VaultID)
+	}
+	if conf.KeyCryptType == KeyCryptTypeCustom {
+		fmt.Printf("Key Provider: %s\n", conf.KeyProvider)
+	}
+	if p, err := keycrypter.LookupKeyProvider(providerName(&conf)); err == nil {
+		for _, line := range p.Describe(newKeyEnv(cipherDir, &conf, nil, keycrypter.KDFParams{})) {
+			fmt.Println(line)
+		}
+	}
+	if patterns, err := cffuse.ReadPolicyPatterns(cipherDir); err == nil {
+		fmt.Printf("Unencrypted Paths: %s\n", strings.Join(patterns, ", "))
+	}
+	if rekeyInProgress(cipherDir) {
+		fmt.Printf("Rekey: in progress, run -rekey to resume\n")
+	}
 }
 
 // LoadConf load config of the cipher directory
@@ -183,12 +282,8 @@ func ReadConf(path string) (cf CipherConfig) {
 	return
 }
 
-// SaveConf save cipher conf file to disk
+// SaveConf save cipher conf file to disk, the old file is replaced atomically
 func SaveConf(path string, cf CipherConfig) error {
-	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
 	js, err := json.MarshalIndent(cf, "", "\t")
 	if err != nil {
 		tlog.Fatal.Printf("Failed to marshal configs")
@@ -196,8 +291,23 @@ func SaveConf(path string, cf CipherConfig) error {
 	}
 	// For convenience for the user, add a newline at the end.
 	js = append(js, '\n')
+	tmp := path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
 	_, err = fd.Write(js)
-	return err
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
 }
 
 // String get string value of crypttype
@@ -0,0 +1,160 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/namecrypter"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+)
+
+// syncConflict is a conflicted copy created by a sync client in the cipher directory
+type syncConflict struct {
+	// plainPath is the presented plaintext path of the conflicted copy
+	plainPath string
+	// origPlainPath is the plaintext path of the original entry
+	origPlainPath string
+	// cipherPath is the absolute path of the conflicted copy
+	cipherPath string
+	// origCipherPath is the absolute path of the original entry
+	origCipherPath string
+	// newCipherPath is the absolute path for keeping the conflicted copy with its presented name
+	newCipherPath string
+	isDir         bool
+}
+
+// ResolveConflicts lists sync conflict copies in a cipher directory and asks how to resolve each of them,
+// the key is unlocked with the command line options `opts` when names are encrypted
+func ResolveConflicts(cipherDir string, opts map[string]string) {
+	conf := LoadConf(cipherDir)
+	if conf.FlatLayout {
+		fmt.Println("Sync conflicts are not supported in flattened layout.")
+		return
+	}
+	var nc *namecrypter.NameCrypter
+	if !conf.PlainPath {
+		nc = namecrypter.NewNameCrypter(LoadMasterKey(cipherDir, &conf, opts))
+	}
+	var conflicts []syncConflict
+	err := findConflicts(nc, cipherDir, "", "", "", &conflicts)
+	if err != nil {
+		tlog.Fatal.Printf("Read cipher directory failed: %v", err)
+		os.Exit(exitcode.CipherDir)
+	}
+	if len(conflicts) == 0 {
+		fmt.Println("No sync conflicts found.")
+		return
+	}
+	fmt.Printf("Found %d sync conflicts:\n", len(conflicts))
+	for i, c := range conflicts {
+		fmt.Printf("\t[%d] %s (conflicted copy of %s)\n", i+1, c.plainPath, c.origPlainPath)
+	}
+	fmt.Printf("Resolve them now? (y/N)")
+	var input string
+	fmt.Scanln(&input)
+	if strings.ToUpper(strings.Trim(input, " \t")) != "Y" {
+		return
+	}
+	for i, c := range conflicts {
+		fmt.Printf("\n[%d] %s\n", i+1, c.plainPath)
+		if c.isDir {
+			fmt.Println("Directory skipped, move its contents in the mounted filesystem.")
+			continue
+		}
+		if _, err := os.Lstat(c.origCipherPath); err != nil {
+			fmt.Printf("Original %s does not exist.\n", c.origPlainPath)
+		}
+		resolveConflict(c)
+	}
+}
+
+func resolveConflict(c syncConflict) {
+	for {
+		fmt.Printf("Keep (c)urrent version, use (t)he conflicted copy, keep (b)oth or (s)kip? ")
+		var input string
+		fmt.Scanln(&input)
+		var err error
+		switch strings.ToLower(strings.Trim(input, " \t")) {
+		case "c":
+			err = os.Remove(c.cipherPath)
+		case "t":
+			err = os.Rename(c.cipherPath, c.origCipherPath)
+		case "b":
+			if c.newCipherPath != c.cipherPath {
+				err = os.Rename(c.cipherPath, c.newCipherPath)
+			}
+		case "s":
+		default:
+			continue
+		}
+		if err != nil {
+			tlog.Warn.Printf("Resolve conflict failed: %v", err)
+		}
+		return
+	}
+}
+
+// findConflicts collects sync conflicts in the cipher directory "rel" recursively.
+// nc is nil in plaintext path mode. plainDir is the presented plaintext path of the directory,
+// ivDir is the plaintext path used for name IVs (without conflict suffixes).
+func findConflicts(nc *namecrypter.NameCrypter, cipherDir string, rel string, plainDir string, ivDir string, conflicts *[]syncConflict) error {
+	infos, err := ioutil.ReadDir(filepath.Join(cipherDir, rel))
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if rel == "" && cffuse.IsNameReserved(name) {
+			continue
+		}
+		var c *syncConflict
+		childPlain := filepath.Join(plainDir, name)
+		childIV := filepath.Join(ivDir, name)
+		if nc == nil {
+			for _, cand := range namecrypter.ConflictCandidates(name) {
+				if _, err := os.Lstat(filepath.Join(cipherDir, rel, cand.Base)); err == nil {
+					c = &syncConflict{
+						plainPath:      childPlain,
+						origPlainPath:  filepath.Join(plainDir, cand.Base),
+						origCipherPath: filepath.Join(cipherDir, rel, cand.Base),
+					}
+					break
+				}
+			}
+		} else if base, suffix, err := nc.DecryptConflictName(ivDir, name); err == nil {
+			presented := namecrypter.JoinConflictName(base, suffix)
+			childPlain = filepath.Join(plainDir, presented)
+			childIV = filepath.Join(ivDir, base)
+			c = &syncConflict{
+				plainPath:      childPlain,
+				origPlainPath:  filepath.Join(plainDir, base),
+				origCipherPath: filepath.Join(cipherDir, rel, nc.EncryptName(childIV, base)),
+				newCipherPath:  filepath.Join(cipherDir, rel, nc.EncryptName(filepath.Join(ivDir, presented), presented)),
+			}
+		} else if plain, err := nc.DecryptName(name); err == nil {
+			childPlain = filepath.Join(plainDir, plain)
+			childIV = filepath.Join(ivDir, plain)
+		} else {
+			continue
+		}
+		if c != nil {
+			c.cipherPath = filepath.Join(cipherDir, rel, name)
+			if c.newCipherPath == "" {
+				c.newCipherPath = c.cipherPath
+			}
+			c.isDir = info.IsDir()
+			*conflicts = append(*conflicts, *c)
+		}
+		if info.IsDir() {
+			if err := findConflicts(nc, cipherDir, filepath.Join(rel, name), childPlain, childIV, conflicts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package cli
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -16,22 +17,49 @@ import (
 	"github.com/declan94/cfcryptfs/internal/exitcode"
 	"github.com/declan94/cfcryptfs/internal/tlog"
 	"github.com/declan94/cfcryptfs/keycrypter"
+	"github.com/declan94/cfcryptfs/readpwd"
 )
 
 // EmergencyConfig is the content of a emergency file.
+// EmergencyKey is the master key encrypted in age format to recipients or with a passphrase, base64 encoded.
+// Emergency files exported before are encrypted with the built-in emergencyPassword.
 type EmergencyConfig struct {
 	CipherConfig
 	EmergencyKey string
 }
 
 // ExportEmergencyFile read information and key of a cipher directory
-// 	save them to an outer file specified by user
-func ExportEmergencyFile(cipherDir, outpath string) {
+// 	save them to an outer file specified by user.
+// The key is unlocked with the command line options `opts` and exported by the emergency key provider.
+func ExportEmergencyFile(cipherDir string, opts map[string]string) {
 	conf := LoadConf(cipherDir)
-	key := LoadKey(cipherDir, "", "")
-	cipherKey, err := keycrypter.EncryptKey(key, emergencyPassword)
+	key := LoadMasterKey(cipherDir, &conf, opts)
+	if err := lookupProvider(EmergencyProvider).Protect(newKeyEnv(cipherDir, &conf, opts, keycrypter.KDFParams{}), key); err != nil {
+		tlog.Fatal.Printf("Export emergency file failed: %v", err)
+		os.Exit(keyProviderExit(err))
+	}
+}
+
+// exportEmergencyFile saves conf and key to the emergency file `outpath`, asked for when empty.
+// The key is encrypted to the age recipients, or with a passphrase asked for when there are none.
+func exportEmergencyFile(cipherDir, outpath string, conf CipherConfig, key []byte, recipients []string) error {
+	var cipherKey []byte
+	var err error
+	if len(recipients) > 0 {
+		cipherKey, err = keycrypter.EncryptAge(key, recipients)
+	} else {
+		var pwd string
+		for {
+			fmt.Println("Enter a passphrase for the emergency file.")
+			if pwd, err = readpwd.Twice(""); err == nil {
+				break
+			}
+			tlog.Warn.Println(err)
+		}
+		cipherKey, err = keycrypter.EncryptAgePassphrase(key, pwd)
+	}
 	if err != nil {
-		tlog.Fatal.Printf("Encryption key faild: %v", err)
+		return fmt.Errorf("Encryption key faild: %v", err)
 	}
 	encKey := base64.StdEncoding.EncodeToString(cipherKey)
 	econf := EmergencyConfig{
@@ -40,8 +68,7 @@ func ExportEmergencyFile(cipherDir, outpath string) {
 	}
 	js, err := json.MarshalIndent(econf, "", "\t")
 	if err != nil {
-		tlog.Fatal.Printf("Failed to marshal emergency configs")
-		os.Exit(exitcode.Config)
+		return keyErrorf(exitcode.Config, "Failed to marshal emergency configs")
 	}
 	js = append(js, '\n')
 	if outpath == "" {
@@ -69,56 +96,91 @@ func ExportEmergencyFile(cipherDir, outpath string) {
 	}
 	fd, err := os.OpenFile(outpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		tlog.Fatal.Printf("Error open file [%s]: %v", outpath, err)
-		os.Exit(exitcode.Config)
+		return keyErrorf(exitcode.Config, "Error open file [%s]: %v", outpath, err)
 	}
 	_, err = fd.Write(js)
+	fd.Close()
 	if err != nil {
-		tlog.Fatal.Printf("Error write file [%s]: %v", outpath, err)
-		os.Exit(exitcode.Config)
+		return keyErrorf(exitcode.Config, "Error write file [%s]: %v", outpath, err)
 	}
 	fmt.Printf("Emergency file exported: %s\n", outpath)
 	fmt.Println("Make sure you keep it SAFE and SECRET")
 	fmt.Printf("Use `%scfcryptfs -emergency_file THIS_FILE CIPHERDIR MOUNTPOINT%s`"+
 		" when config or keyfile are damaged or you forget passowrd.\n", tlog.ColorGreen, tlog.ColorReset)
+	if len(recipients) > 0 {
+		fmt.Println("It is unlocked with `-identity FILE` holding the secret key of a recipient.")
+	}
+	return nil
 }
 
-// LoadEmergencyFile load conf and key from a emergency file
-func LoadEmergencyFile(path string) (CipherConfig, []byte) {
+// LoadEmergencyFile load conf and key from a emergency file or its paper backup, "-" reads one typed in.
+// The key is decrypted with the age identities in `identityFile`, or a passphrase asked for.
+func LoadEmergencyFile(path string, identityFile string) (CipherConfig, []byte, error) {
+	var cf CipherConfig
 	// Read from disk
-	js, err := ioutil.ReadFile(path)
+	js, err := readPaperOrFile(path, keycrypter.PaperEmergency)
 	if err != nil {
-		tlog.Fatal.Printf("Read from config file error: %v", err)
-		os.Exit(exitcode.Config)
+		return cf, nil, keyErrorf(exitcode.Config, "Read from emergency file error: %v", err)
 	}
 	// Unmarshal
 	var ecf EmergencyConfig
 	err = json.Unmarshal(js, &ecf)
 	if err != nil {
-		tlog.Fatal.Printf("Failed to parse emergency file")
-		os.Exit(exitcode.Config)
+		return cf, nil, keyErrorf(exitcode.Config, "Failed to parse emergency file")
 	}
-	cf := ecf.CipherConfig
+	cf = ecf.CipherConfig
 	cf.CryptType = str2CryptType(cf.CryptTypeStr)
 	if cf.CryptType == 0 {
-		tlog.Fatal.Printf("Wrong crypt type: %s", cf.CryptTypeStr)
-		os.Exit(exitcode.Config)
+		return cf, nil, keyErrorf(exitcode.Config, "Wrong crypt type: %s", cf.CryptTypeStr)
 	}
 	cipherKey, err := base64.StdEncoding.DecodeString(ecf.EmergencyKey)
 	if err != nil {
-		tlog.Fatal.Printf("Decode emergency key failed: %v", err)
-		os.Exit(exitcode.Config)
+		return cf, nil, keyErrorf(exitcode.Config, "Decode emergency key failed: %v", err)
 	}
-	key, err := keycrypter.DecrytKey(cipherKey, emergencyPassword)
+	key, err := decryptEmergencyKey(cipherKey, identityFile)
 	if err != nil {
-		tlog.Fatal.Printf("Decrypt emergency key failed.")
-		os.Exit(exitcode.Config)
+		return cf, nil, fmt.Errorf("Decrypt emergency key failed: %v", err)
 	}
-	return cf, key
+	return cf, key, nil
 }
 
-// RecoverCipherDir recovers the cipher dir using emergency file
-func RecoverCipherDir(cipherDir, emerFile string) {
+func decryptEmergencyKey(cipherKey []byte, identityFile string) ([]byte, error) {
+	if !keycrypter.IsAge(cipherKey) {
+		tlog.Warn.Println("This emergency file is protected by the built-in password only, export a new one and destroy it.")
+		return keycrypter.DecrytKey(cipherKey, emergencyPassword)
+	}
+	if keycrypter.AgeNeedsPassphrase(cipherKey) {
+		fmt.Println("Enter the passphrase of the emergency file.")
+		pwd, err := readpwd.Once("")
+		if err != nil {
+			return nil, err
+		}
+		return keycrypter.DecryptAge(cipherKey, nil, pwd)
+	}
+	if identityFile == "" {
+		return nil, errors.New("the emergency file is encrypted to recipients, specify an identity file with `-identity`")
+	}
+	ids, err := readIdentities(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	return keycrypter.DecryptAge(cipherKey, ids, "")
+}
+
+// readIdentities reads the age identities in `path`
+func readIdentities(path string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Read identity file failed: %v", err)
+	}
+	return keycrypter.ParseAgeIdentities(data)
+}
+
+// RecoverCipherDir recovers the cipher dir using emergency file, unlocked like LoadEmergencyFile.
+// The key is protected again by the key provider of the emergency file with the command line options `opts`,
+// a password protected key is derived with kdf parameters kp.
+func RecoverCipherDir(cipherDir string, kp keycrypter.KDFParams, opts map[string]string) {
+	emerFile := opts["emergency_file"]
 	if emerFile == "" {
 		for true {
 			emerFile = ""
@@ -133,7 +195,11 @@ func RecoverCipherDir(cipherDir, emerFile string) {
 			break
 		}
 	}
-	conf, key := LoadEmergencyFile(emerFile)
+	conf, key, err := LoadEmergencyFile(emerFile, opts["identity"])
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(keyProviderExit(err))
+	}
 	fmt.Printf("You'd better use `%scfcryptfs -emergency_file %s %s MOUNTPOINT%s`"+
 		" to check if everything works well.\n", tlog.ColorGreen, emerFile, cipherDir, tlog.ColorReset)
 	fmt.Printf("Are you sure to recover [%s] with the emergency file [%s]? (y/N)", cipherDir, emerFile)
@@ -145,12 +211,13 @@ func RecoverCipherDir(cipherDir, emerFile string) {
 	}
 	exec.Command("cp", filepath.Join(cipherDir, cffuse.ConfFile), "/tmp/.cfcryptfs.cfg.bk").Run()
 	exec.Command("cp", filepath.Join(cipherDir, cffuse.KeyFile), "/tmp/.cfcryptfs.key.bk").Run()
-	err := SaveConf(filepath.Join(cipherDir, cffuse.ConfFile), conf)
+	promptKeyProtection(cipherDir, &conf, opts)
+	saveKeyProtection(cipherDir, key, &conf, kp, opts)
+	// The split parameters are recorded by SaveKeySSS
+	err = SaveConf(filepath.Join(cipherDir, cffuse.ConfFile), conf)
 	if err != nil {
 		tlog.Fatal.Printf("Save config file failed: %v", err)
 		os.Exit(exitcode.Config)
 	}
-	fmt.Println("Set new password")
-	SaveKey(cipherDir, key)
 	fmt.Printf("\nCipher directory recovered: %s\n", cipherDir)
 }
@@ -0,0 +1,227 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/keycrypter"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const (
+	// PathModeEncrypted encrypts the names of files and directories
+	PathModeEncrypted = "encrypted"
+	// PathModePlain keeps the names of files and directories in plaintext
+	PathModePlain = "plain"
+	// PathModeFlat stores all files flat in the object directory, hiding the directory structure
+	PathModeFlat = "flat"
+
+	minBlockSize = 512
+)
+
+// InitSpec describes all choices of -init, for provisioning cipher directories without prompts.
+// It is read from the JSON file of -init_spec, every field sets the flag of the same meaning
+// unless the flag is given on the command line.
+type InitSpec struct {
+	// Cipher is DES, AES128, AES192 or AES256
+	Cipher string `json:"cipher"`
+	// BlockSize is the plaintext block size in bytes, or with a K suffix
+	BlockSize interface{} `json:"block_size"`
+	// PathMode is "encrypted", "plain" or "flat"
+	PathMode string `json:"path_mode"`
+	// Protection is the name of the key provider, e.g. "password" or "sss"
+	Protection string `json:"protection"`
+	KDF        struct {
+		KDF       string `json:"kdf"`
+		Time      int    `json:"time"`
+		MemoryMiB int    `json:"memory_mib"`
+		Threads   int    `json:"threads"`
+		ScryptN   int    `json:"scrypt_n"`
+		ScryptR   int    `json:"scrypt_r"`
+		ScryptP   int    `json:"scrypt_p"`
+	} `json:"kdf"`
+	// Password is where the new password is read from
+	Password struct {
+		Passfile string `json:"passfile"`
+		Extpass  string `json:"extpass"`
+		EnvFile  string `json:"env_file"`
+		Pinentry string `json:"pinentry"`
+	} `json:"password"`
+	MinPwdScore       *int `json:"min_pwd_score"`
+	AllowWeakPassword bool `json:"allow_weak_password"`
+	// Shares are the paths of the split keyfiles, Threshold of them unlock the key
+	Shares    []string `json:"shares"`
+	Threshold int      `json:"threshold"`
+	// Recipients are the age recipients of public key protection
+	Recipients []string `json:"recipients"`
+	// Keyfile is the keyfile of password and keyfile protection, created if it doesn't exist
+	Keyfile string `json:"keyfile"`
+	KMS     struct {
+		Address string `json:"address"`
+		Mount   string `json:"mount"`
+		Key     string `json:"key"`
+	} `json:"kms"`
+	// SSHKeys are the SHA256 fingerprints of the ssh-agent keys wrapping the key
+	SSHKeys []string `json:"ssh_keys"`
+}
+
+// flags returns the flag names and values set by the spec, in order
+func (s *InitSpec) flags() [][2]string {
+	var fl [][2]string
+	add := func(name string, value string) {
+		if value != "" && value != "0" {
+			fl = append(fl, [2]string{name, value})
+		}
+	}
+	add("cipher", s.Cipher)
+	if s.BlockSize != nil {
+		add("block_size", fmt.Sprint(s.BlockSize))
+	}
+	add("path_mode", s.PathMode)
+	add("protection", s.Protection)
+	add("kdf", s.KDF.KDF)
+	add("kdf_time", strconv.Itoa(s.KDF.Time))
+	add("kdf_memory", strconv.Itoa(s.KDF.MemoryMiB))
+	add("kdf_threads", strconv.Itoa(s.KDF.Threads))
+	add("scrypt_n", strconv.Itoa(s.KDF.ScryptN))
+	add("scrypt_r", strconv.Itoa(s.KDF.ScryptR))
+	add("scrypt_p", strconv.Itoa(s.KDF.ScryptP))
+	add("passfile", s.Password.Passfile)
+	add("extpass", s.Password.Extpass)
+	add("env_file", s.Password.EnvFile)
+	add("pinentry", s.Password.Pinentry)
+	if s.MinPwdScore != nil {
+		fl = append(fl, [2]string{"min_pwd_score", strconv.Itoa(*s.MinPwdScore)})
+	}
+	if s.AllowWeakPassword {
+		add("allow_weak_password", "true")
+	}
+	add("shares", strings.Join(s.Shares, ","))
+	add("threshold", strconv.Itoa(s.Threshold))
+	for _, r := range s.Recipients {
+		add("recipient", r)
+	}
+	add("new_keyfile", s.Keyfile)
+	add("kms_address", s.KMS.Address)
+	add("kms_mount", s.KMS.Mount)
+	add("kms_key", s.KMS.Key)
+	add("ssh_keys", strings.Join(s.SSHKeys, ","))
+	return fl
+}
+
+// applyInitSpec sets the flags of the init spec at `path` which are not given on the command line
+func applyInitSpec(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var spec InitSpec
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&spec); err != nil {
+		return fmt.Errorf("Parse init spec failed: %v", err)
+	}
+	given := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for _, fl := range spec.flags() {
+		if given[fl[0]] {
+			continue
+		}
+		if err = flagSet.Set(fl[0], fl[1]); err != nil {
+			return fmt.Errorf("Init spec %s: %v", fl[0], err)
+		}
+	}
+	return nil
+}
+
+// batchInit reports whether -init runs without prompts, with -init_spec or -json
+func batchInit(opts map[string]string) bool {
+	return opts["init_spec"] != "" || opts["json"] == "true"
+}
+
+// needOption fails when `what` can't be asked for in batch mode, the option `name` gives it
+func needOption(opts map[string]string, name string, what string) error {
+	if batchInit(opts) {
+		return keyErrorf(exitcode.Usage, "Missing %s, give it with -%s", what, name)
+	}
+	return nil
+}
+
+// parseBlockSize parses a plaintext block size in bytes or with a K suffix,
+// a power of 2 which divides the largest FUSE write
+func parseBlockSize(s string) (int, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := 1
+	if strings.HasSuffix(s, "K") {
+		s, mult = s[:len(s)-1], 1024
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid block size %q", s)
+	}
+	n *= mult
+	if n < minBlockSize || n > fuse.MAX_KERNEL_WRITE || n&(n-1) != 0 {
+		return 0, fmt.Errorf("Block size must be a power of 2 from %d to %d bytes", minBlockSize, fuse.MAX_KERNEL_WRITE)
+	}
+	return n, nil
+}
+
+// initResult is printed by -init -json
+type initResult struct {
+	CipherDir  string   `json:"cipher_dir"`
+	VaultID    string   `json:"vault_id"`
+	Cipher     string   `json:"cipher"`
+	BlockSize  int      `json:"block_size"`
+	PathMode   string   `json:"path_mode"`
+	Protection string   `json:"protection"`
+	KDF        string   `json:"kdf,omitempty"`
+	Files      []string `json:"files"`
+	Shares     []string `json:"shares,omitempty"`
+	Threshold  int      `json:"threshold,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+}
+
+// newInitResult describes the cipher directory created with config conf and command line options `opts`
+func newInitResult(cipherDir string, conf *CipherConfig, opts map[string]string) *initResult {
+	r := &initResult{
+		CipherDir:  cipherDir,
+		VaultID:    conf.VaultID,
+		Cipher:     conf.CryptTypeStr,
+		BlockSize:  conf.PlainBS,
+		PathMode:   PathModeEncrypted,
+		Protection: providerName(conf),
+		Files:      []string{filepath.Join(cipherDir, cffuse.ConfFile)},
+	}
+	if conf.FlatLayout {
+		r.PathMode = PathModeFlat
+	} else if conf.PlainPath {
+		r.PathMode = PathModePlain
+	}
+	for _, f := range lookupProvider(r.Protection).KeyFiles() {
+		r.Files = append(r.Files, filepath.Join(cipherDir, f))
+	}
+	switch conf.KeyCryptType {
+	case KeyCryptTypePWD, KeyCryptType2FA:
+		if ks, err := keycrypter.ReadKeySlots(filepath.Join(cipherDir, cffuse.KeyFile)); err == nil && len(ks.Slots) > 0 {
+			r.KDF = ks.Slots[0].KDF()
+		}
+	case KeyCryptTypeSSS:
+		for _, p := range optionList(opts, "shares") {
+			r.Shares = append(r.Shares, expandPath(p))
+		}
+		r.Threshold = conf.SplitThreshold
+	case KeyCryptTypeAGE:
+		r.Recipients = optionList(opts, "recipient")
+	}
+	return r
+}
@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+	"github.com/declan94/cfcryptfs/keycrypter"
+)
+
+func TestParseBlockSize(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want int
+	}{
+		{"4096", 4096},
+		{"8K", 8192},
+		{" 16kb ", 16384},
+		{"512", 512},
+		{"128K", 131072},
+		{"256", 0},
+		{"3000", 0},
+		{"256K", 0},
+		{"4M", 0},
+		{"", 0},
+		{"-4K", 0},
+	} {
+		n, err := parseBlockSize(c.in)
+		if c.want == 0 {
+			if err == nil {
+				t.Errorf("parseBlockSize(%q) = %d, want an error", c.in, n)
+			}
+		} else if err != nil || n != c.want {
+			t.Errorf("parseBlockSize(%q) = %d, %v, want %d", c.in, n, err, c.want)
+		}
+	}
+}
+
+func TestInitSpecFlags(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		spec string
+		want [][2]string
+	}{
+		{"empty", `{}`, nil},
+		{"number block size", `{"cipher": "AES128", "block_size": 8192}`, [][2]string{{"cipher", "AES128"}, {"block_size", "8192"}}},
+		{"string block size", `{"block_size": "16K", "path_mode": "flat"}`, [][2]string{{"block_size", "16K"}, {"path_mode", "flat"}}},
+		{"kdf", `{"kdf": {"kdf": "scrypt", "scrypt_n": 16384, "scrypt_r": 8}}`, [][2]string{{"kdf", "scrypt"}, {"scrypt_n", "16384"}, {"scrypt_r", "8"}}},
+		{"password", `{"protection": "password", "password": {"passfile": "/run/pwd"}, "min_pwd_score": 0, "allow_weak_password": true}`,
+			[][2]string{{"protection", "password"}, {"passfile", "/run/pwd"}, {"min_pwd_score", "0"}, {"allow_weak_password", "true"}}},
+		{"sss", `{"protection": "sss", "shares": ["/a", "/b", "/c"], "threshold": 2}`,
+			[][2]string{{"protection", "sss"}, {"shares", "/a,/b,/c"}, {"threshold", "2"}}},
+		{"age", `{"recipients": ["age1a", "age1b"]}`, [][2]string{{"recipient", "age1a"}, {"recipient", "age1b"}}},
+		{"kms", `{"kms": {"address": "https://vault", "key": "k"}}`, [][2]string{{"kms_address", "https://vault"}, {"kms_key", "k"}}},
+	} {
+		var spec InitSpec
+		if err := json.Unmarshal([]byte(c.spec), &spec); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := spec.flags(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// newInitTestFlags replaces the command line flags with the -init flags used by the tests
+func newInitTestFlags(t *testing.T, args ...string) (cipher *string, threshold *int, recipients *stringList) {
+	flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+	cipher = flagSet.String("cipher", "", "")
+	flagSet.String("block_size", "", "")
+	flagSet.String("protection", "", "")
+	flagSet.String("shares", "", "")
+	threshold = flagSet.Int("threshold", 0, "")
+	recipients = &stringList{}
+	flagSet.Var(recipients, "recipient", "")
+	if err := flagSet.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestApplyInitSpec(t *testing.T) {
+	defer func(fs *flag.FlagSet) { flagSet = fs }(flagSet)
+	dir, err := ioutil.TempDir("", "cfcryptfs-initspec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(spec string) string {
+		path := filepath.Join(dir, "spec.json")
+		if err := ioutil.WriteFile(path, []byte(spec), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	spec := write(`{"cipher": "AES256", "block_size": "8K", "protection": "sss", "shares": ["/a", "/b", "/c"], "threshold": 2, "recipients": ["age1a"]}`)
+
+	// Flags given on the command line take precedence
+	cipher, threshold, recipients := newInitTestFlags(t, "-cipher", "AES128", "-threshold", "3")
+	if err := applyInitSpec(spec); err != nil {
+		t.Fatal(err)
+	}
+	if *cipher != "AES128" || *threshold != 3 {
+		t.Errorf("Spec overrode the command line: cipher %s, threshold %d", *cipher, *threshold)
+	}
+	for name, want := range map[string]string{"block_size": "8K", "protection": "sss", "shares": "/a,/b,/c"} {
+		if got := flagSet.Lookup(name).Value.String(); got != want {
+			t.Errorf("-%s: got %q, want %q", name, got, want)
+		}
+	}
+	if !reflect.DeepEqual(*recipients, stringList{"age1a"}) {
+		t.Errorf("Wrong recipients: %v", *recipients)
+	}
+	// Repeated flags given on the command line are not extended by the spec
+	_, _, recipients = newInitTestFlags(t, "-recipient", "age1cli")
+	if err := applyInitSpec(spec); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*recipients, stringList{"age1cli"}) {
+		t.Errorf("Wrong recipients: %v", *recipients)
+	}
+
+	for _, bad := range []string{`{"cipher": "AES256", "unknown": 1}`, `{"threshold": "two"}`, `not json`} {
+		newInitTestFlags(t)
+		if err := applyInitSpec(write(bad)); err == nil {
+			t.Errorf("Applied bad spec %s", bad)
+		}
+	}
+	newInitTestFlags(t)
+	if err := applyInitSpec(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Applied missing spec")
+	}
+}
+
+func TestNewInitResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-initresult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := keycrypter.StoreKeyParams(filepath.Join(dir, cffuse.KeyFile), "password", key, keycrypter.DefaultKDFParams(keycrypter.KDFScrypt)); err != nil {
+		t.Fatal(err)
+	}
+	conf := func(keyCryptType int, plainPath bool, flat bool) *CipherConfig {
+		return &CipherConfig{CryptTypeStr: "AES256", PlainBS: 4096, KeyCryptType: keyCryptType, PlainPath: plainPath, FlatLayout: flat,
+			VaultID: "vault", SplitShares: 3, SplitThreshold: 2}
+	}
+	confFile := filepath.Join(dir, cffuse.ConfFile)
+	for _, c := range []struct {
+		name string
+		conf *CipherConfig
+		opts map[string]string
+		want initResult
+	}{
+		{"password", conf(KeyCryptTypePWD, false, true), nil, initResult{PathMode: PathModeFlat, Protection: "password",
+			Files: []string{confFile, filepath.Join(dir, cffuse.KeyFile)}}},
+		{"sss", conf(KeyCryptTypeSSS, false, false), map[string]string{"shares": "/a,/b,/c"}, initResult{PathMode: PathModeEncrypted, Protection: "sss",
+			Files: []string{confFile}, Shares: []string{"/a", "/b", "/c"}, Threshold: 2}},
+		{"age", conf(KeyCryptTypeAGE, true, false), map[string]string{"recipient": "age1a,age1b"}, initResult{PathMode: PathModePlain, Protection: "age",
+			Files: []string{confFile, filepath.Join(dir, cffuse.RecipientKeyFile)}, Recipients: []string{"age1a", "age1b"}}},
+	} {
+		r := newInitResult(dir, c.conf, c.opts)
+		if c.name == "password" {
+			if !strings.HasPrefix(r.KDF, "scrypt") {
+				t.Errorf("%s: wrong kdf %q", c.name, r.KDF)
+			}
+			r.KDF = ""
+		}
+		c.want.CipherDir, c.want.VaultID, c.want.Cipher, c.want.BlockSize = dir, "vault", "AES256", 4096
+		if !reflect.DeepEqual(*r, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, *r, c.want)
+		}
+	}
+
+	// Fields of other protections are left out of the JSON
+	data, err := json.Marshal(newInitResult(dir, conf(KeyCryptTypeSSS, false, false), map[string]string{"shares": "/a,/b"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cipher_dir", "vault_id", "cipher", "block_size", "path_mode", "protection", "files", "shares", "threshold"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("%s missing in %s", name, data)
+		}
+	}
+	for _, name := range []string{"kdf", "recipients"} {
+		if _, ok := fields[name]; ok {
+			t.Errorf("%s set in %s", name, data)
+		}
+	}
+}
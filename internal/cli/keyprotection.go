@@ -2,114 +2,308 @@ package cli
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/declan94/cfcryptfs/cffuse"
 	"github.com/declan94/cfcryptfs/internal/exitcode"
 	"github.com/declan94/cfcryptfs/internal/tlog"
 	"github.com/declan94/cfcryptfs/keycrypter"
-	"github.com/declan94/cfcryptfs/readpwd"
 )
 
-// SaveKey ask for password, encrypted key using the password and then save to file
-func SaveKey(cipherDir string, key []byte) {
-	var err error
-	var pwd string
-	for true {
-		pwd, err = readpwd.Twice("")
-		if err != nil {
-			tlog.Warn.Println(err)
-		} else {
-			break
-		}
-	}
-	err = keycrypter.StoreKey(filepath.Join(cipherDir, cffuse.KeyFile), pwd, key)
+// SaveKey ask for password, encrypted key using the password and then save to file.
+// The password must satisfy the password policy of `opts`.
+func SaveKey(cipherDir string, key []byte, kp keycrypter.KDFParams, opts map[string]string) error {
+	pwd, err := askNewPassword(opts)
 	if err != nil {
-		tlog.Fatal.Printf("Store key failed: %v\n", err)
-		os.Exit(exitcode.KeyFile)
+		return err
 	}
+	return keycrypter.StoreKeyParams(filepath.Join(cipherDir, cffuse.KeyFile), pwd, key, kp)
 }
 
 // LoadKey load encryption key of the cipher directory
-func LoadKey(cipherDir string, pwdfile string, password string) []byte {
-	key, err := keycrypter.LoadKey(filepath.Join(cipherDir, cffuse.KeyFile), pwdfile, password)
+func LoadKey(cipherDir string, pwdfile string, password string) ([]byte, error) {
+	return keycrypter.LoadKey(filepath.Join(cipherDir, cffuse.KeyFile), pwdfile, password)
+}
+
+// LoadMasterKey load encryption key of the cipher directory with the key provider of conf,
+// which gets the command line options `opts`
+func LoadMasterKey(cipherDir string, conf *CipherConfig, opts map[string]string) []byte {
+	key, err := lookupProvider(providerName(conf)).Unlock(newKeyEnv(cipherDir, conf, opts, keycrypter.KDFParams{}))
 	if err != nil {
-		tlog.Fatal.Println(err)
-		os.Exit(exitcode.KeyFile)
+		tlog.Fatal.Printf("Unlock key failed: %v", err)
+		os.Exit(keyProviderExit(err))
 	}
 	return key
 }
 
-// SaveKeySSS ask sss params and place to save then save keyshares
-func SaveKeySSS(cipherDir string, key []byte) {
+// UnlockCipherDir load config and encryption key of the cipher directory,
+// from the emergency file when option "emergency_file" is set.
+// A key cached in the kernel keyring is used without unlocking, option "keyring" caches the unlocked key.
+func UnlockCipherDir(cipherDir string, opts map[string]string) (CipherConfig, []byte) {
+	var conf CipherConfig
+	if opts["emergency_file"] != "" {
+		key, err := lookupProvider(EmergencyProvider).Unlock(newKeyEnv(cipherDir, &conf, opts, keycrypter.KDFParams{}))
+		if err != nil {
+			tlog.Fatal.Printf("Unlock key failed: %v", err)
+			os.Exit(keyProviderExit(err))
+		}
+		return conf, key
+	}
+	if rekeyInProgress(cipherDir) {
+		tlog.Fatal.Printf("A rekey of the cipher directory is in progress, run -rekey to finish it")
+		os.Exit(exitcode.CipherDir)
+	}
+	conf = LoadConf(cipherDir)
+	if key := cachedMasterKey(&conf); key != nil {
+		return conf, key
+	}
+	key := LoadMasterKey(cipherDir, &conf, opts)
+	if opts["keyring"] != "" {
+		cacheMasterKey(&conf, key, opts)
+	}
+	return conf, key
+}
+
+// keyProviderChoices returns the names of the key providers which can protect a cipher directory
+func keyProviderChoices() []string {
+	var names []string
+	for _, name := range keycrypter.KeyProviders() {
+		if name != EmergencyProvider {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// askKeyProvider asks for a key provider other than `exclude`
+func askKeyProvider(prompt string, exclude string) string {
+	names := keyProviderChoices()
+	var choices []string
+	for i, name := range names {
+		choices = append(choices, fmt.Sprintf("%d: %s", i+1, providerTitle(name)))
+	}
+	for {
+		var t int
+		fmt.Printf("%s (%s): ", prompt, strings.Join(choices, ", "))
+		fmt.Scanf("%d\n", &t)
+		if t >= 1 && t <= len(names) && names[t-1] != exclude {
+			return names[t-1]
+		}
+	}
+}
+
+// saveKeyProtection stores the key protected by the key provider of conf, which gets the command line options `opts`.
+// The provider's parameters are recorded in conf.
+func saveKeyProtection(cipherDir string, key []byte, conf *CipherConfig, kp keycrypter.KDFParams, opts map[string]string) {
+	if err := lookupProvider(providerName(conf)).Protect(newKeyEnv(cipherDir, conf, opts, kp), key); err != nil {
+		tlog.Fatal.Printf("Store key failed: %v", err)
+		os.Exit(keyProviderExit(err))
+	}
+}
+
+// keyProviderFiles returns the key files in the cipher directory of the key provider
+func keyProviderFiles(cipherDir string, name string) map[string]bool {
+	files := map[string]bool{}
+	for _, f := range lookupProvider(name).KeyFiles() {
+		files[filepath.Join(cipherDir, f)] = true
+	}
+	return files
+}
+
+// SaveKeySSS ask sss params and place to save then save keyshares of split epoch conf.SplitEpoch.
+// The paths and threshold may be given by the options "shares" and "threshold" of `opts`.
+// With the option "share_suffix" every keyshare is written to its path plus the suffix, for the caller
+// to move in place, and the paths are recorded in the option "staged_shares".
+// The split parameters are recorded in conf, a vault ID is assigned when it has none.
+func SaveKeySSS(cipherDir string, key []byte, conf *CipherConfig, opts map[string]string) error {
 	var n, k int
-	for true {
+	suffix := opts["share_suffix"]
+	paths := optionList(opts, "shares")
+	if len(paths) == 0 {
+		if err := needOption(opts, "shares", "the paths of the split keyfiles"); err != nil {
+			return err
+		}
+	} else if n = len(paths); n < 2 || n > 255 {
+		return keyErrorf(exitcode.Usage, "2~255 split keyfiles are needed, -shares gives %d", n)
+	}
+	if opts["threshold"] != "" {
+		k, _ = strconv.Atoi(opts["threshold"])
+		if n > 0 && (k < 2 || k > n) {
+			return keyErrorf(exitcode.Usage, "-threshold must be 2~%d", n)
+		}
+	} else if n > 2 {
+		if err := needOption(opts, "threshold", "the count of keyfiles to unlock"); err != nil {
+			return err
+		}
+	}
+	for n == 0 {
 		fmt.Printf("Count of split keys (2~255): ")
 		fmt.Scanf("%d\n", &n)
-		if n >= 2 && n <= 255 {
-			break
+		if n < 2 || n > 255 {
+			n = 0
 		}
 	}
 	if n == 2 {
 		k = 2
 	} else {
-		for true {
+		for k < 2 || k > n {
 			fmt.Printf("Sufficent count to decrypt (2~%d): ", n)
 			fmt.Scanf("%d\n", &k)
-			if k >= 2 && k <= n {
-				break
-			}
 		}
 	}
-	shares, err := keycrypter.EncryptKeySSS(key, byte(n), byte(k))
+	if conf.VaultID == "" {
+		conf.VaultID = keycrypter.NewVaultID()
+	}
+	vaultID, err := keycrypter.ParseVaultID(conf.VaultID)
 	if err != nil {
-		tlog.Fatal.Printf("Encrypt key failed: %v", err)
-		os.Exit(exitcode.KeyFile)
-	}
-	paths := make([]string, n)
-	for i := 0; i < n; i++ {
-		for true {
-			var p string
-			fmt.Printf("Path to store split key #%d: ", i+1)
-			fmt.Scanln(&p)
-			p = strings.Trim(p, " \t")
-			p = expandPath(p)
-			fd, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-			if err != nil {
-				tlog.Warn.Printf("Open key file [%s] failed: %v", p, err)
-				continue
+		return keyErrorf(exitcode.Config, "%v", err)
+	}
+	shares, err := keycrypter.EncryptKeySSSSplit(key, keycrypter.Split{VaultID: vaultID, N: byte(n), K: byte(k), Epoch: conf.SplitEpoch})
+	if err != nil {
+		return fmt.Errorf("Encrypt key failed: %v", err)
+	}
+	if len(paths) > 0 {
+		for i, p := range paths {
+			paths[i] = expandPath(strings.Trim(p, " \t"))
+			if err = ioutil.WriteFile(paths[i]+suffix, shares[i], 0600); err != nil {
+				return fmt.Errorf("Write key file [%s] failed: %v", paths[i]+suffix, err)
 			}
-			_, err = fd.Write(shares[i])
-			if err != nil {
-				tlog.Warn.Printf("Write key file [%s] failed: %s", p, err)
-				continue
+		}
+	} else {
+		paths = make([]string, n)
+		for i := 0; i < n; i++ {
+			for true {
+				var p string
+				fmt.Printf("Path to store split key #%d: ", i+1)
+				fmt.Scanln(&p)
+				p = strings.Trim(p, " \t")
+				p = expandPath(p)
+				fd, err := os.OpenFile(p+suffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+				if err != nil {
+					tlog.Warn.Printf("Open key file [%s] failed: %v", p, err)
+					continue
+				}
+				_, err = fd.Write(shares[i])
+				if err != nil {
+					tlog.Warn.Printf("Write key file [%s] failed: %s", p, err)
+					continue
+				}
+				paths[i] = p
+				break
 			}
-			paths[i] = p
-			break
 		}
 	}
+	conf.SplitShares, conf.SplitThreshold = n, k
+	if suffix != "" {
+		opts["staged_shares"] = strings.Join(paths, ",")
+		return nil
+	}
 	fmt.Println("Split keyfiles stored in:")
 	for _, path := range paths {
 		fmt.Printf("\t%s\n", path)
 	}
+	return nil
 }
 
-// LoadKeySSS load encryption key using sss
-func LoadKeySSS(pathsStr string) []byte {
+// LoadKeySSS load encryption key using sss, the keyfiles must be of the vault and split epoch of conf
+func LoadKeySSS(pathsStr string, conf CipherConfig) ([]byte, error) {
 	if pathsStr == "" {
-		tlog.Fatal.Println("This cipher directory is protected by multiple keyfile, you should specify keyfiles with `-keys`")
-		os.Exit(exitcode.Usage)
+		return nil, keyErrorf(exitcode.Usage, "This cipher directory is protected by multiple keyfile, you should specify keyfiles with `-keys`")
 	}
 	paths := strings.Split(pathsStr, ",")
 	if len(paths) == 1 {
 		paths = strings.Split(pathsStr, ";")
 	}
-	key, err := keycrypter.LoadKeySSS(paths)
+	var err error
+	expect := &keycrypter.Split{Epoch: conf.SplitEpoch}
+	if conf.VaultID != "" {
+		if expect.VaultID, err = keycrypter.ParseVaultID(conf.VaultID); err != nil {
+			return nil, keyErrorf(exitcode.Config, "%v", err)
+		}
+	}
+	key, _, err := keycrypter.LoadKeySSSSplit(paths, expect)
+	return key, err
+}
+
+// ReshareKeys combines the current keyfiles and splits the key into a new set with new count and threshold.
+// The data is not re-encrypted, the split epoch is increased so the old keyfiles can't unlock anymore.
+// The new keyfiles and threshold are taken from `opts` like on -init.
+func ReshareKeys(cipherDir string, keyFiles string, opts map[string]string) {
+	conf := LoadConf(cipherDir)
+	if conf.KeyCryptType != KeyCryptTypeSSS {
+		tlog.Fatal.Printf("This cipher directory is protected by %s, only split keyfiles can be reshared", protectionName(&conf))
+		os.Exit(exitcode.Usage)
+	}
+	key, err := LoadKeySSS(keyFiles, conf)
 	if err != nil {
 		tlog.Fatal.Println(err)
-		os.Exit(exitcode.KeyFile)
+		os.Exit(keyProviderExit(err))
+	}
+	conf.SplitEpoch++
+	fmt.Println("Split the key into new keyfiles")
+	if err = SaveKeySSS(cipherDir, key, &conf, opts); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(keyProviderExit(err))
+	}
+	if err = SaveConf(filepath.Join(cipherDir, cffuse.ConfFile), conf); err != nil {
+		tlog.Fatal.Printf("Write conf file failed: %v", err)
+		fmt.Println("The old keyfiles still unlock the cipher directory, the new ones don't.")
+		os.Exit(exitcode.Config)
+	}
+	fmt.Printf("\nKeyfiles reshared: %s\n", cipherDir)
+	fmt.Println("The old keyfiles are rejected now, but still contain the key, destroy them.")
+}
+
+// ConvertKeyProtection unlocks the key with the current protection and re-protects it with another key provider.
+// The config is switched atomically after the new key material is stored.
+func ConvertKeyProtection(cipherDir string, kp keycrypter.KDFParams, opts map[string]string) {
+	conf := LoadConf(cipherDir)
+	key := LoadMasterKey(cipherDir, &conf, opts)
+	oldType, oldName := conf.KeyCryptType, providerName(&conf)
+	setProvider(&conf, askKeyProvider("Convert to", oldName))
+	fmt.Printf("Convert to %s protection\n", protectionName(&conf))
+	conf.KeyParams = nil
+	promptKeyProtection(cipherDir, &conf, opts)
+	oldFiles := keyProviderFiles(cipherDir, oldName)
+	newFiles := keyProviderFiles(cipherDir, providerName(&conf))
+	// Key files shared by both providers (e.g. password and KMS) are kept to restore on failure
+	oldData := map[string][]byte{}
+	for f := range oldFiles {
+		if newFiles[f] {
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				tlog.Fatal.Printf("Read key file failed: %v", err)
+				os.Exit(exitcode.KeyFile)
+			}
+			oldData[f] = data
+		}
+	}
+	saveKeyProtection(cipherDir, key, &conf, kp, opts)
+	if err := SaveConf(filepath.Join(cipherDir, cffuse.ConfFile), conf); err != nil {
+		tlog.Fatal.Printf("Write conf file failed: %v", err)
+		for f := range newFiles {
+			if data, ok := oldData[f]; ok {
+				ioutil.WriteFile(f, data, 0600)
+			} else {
+				os.Remove(f)
+			}
+		}
+		os.Exit(exitcode.Config)
+	}
+	for f := range oldFiles {
+		if newFiles[f] {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			tlog.Warn.Printf("Remove old key file failed: %v", err)
+		}
+	}
+	fmt.Printf("\nKey protection converted to %s: %s\n", protectionName(&conf), cipherDir)
+	if oldType == KeyCryptTypeSSS {
+		fmt.Println("The old split keyfiles still contain the key, destroy them.")
 	}
-	return key
 }
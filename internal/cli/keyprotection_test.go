@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+	"github.com/declan94/cfcryptfs/keycrypter"
+)
+
+// fileProvider stores the key unprotected in a file of the cipher directory
+type fileProvider struct{}
+
+const fileProviderKey = "file-test.key"
+
+func init() {
+	keycrypter.RegisterKeyProvider("file-test", fileProvider{})
+}
+
+func (fileProvider) Protect(env *keycrypter.KeyEnv, key []byte) error {
+	return ioutil.WriteFile(filepath.Join(env.CipherDir, fileProviderKey), key, 0600)
+}
+
+func (fileProvider) Unlock(env *keycrypter.KeyEnv) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(env.CipherDir, fileProviderKey))
+}
+
+func (fileProvider) KeyFiles() []string {
+	return []string{fileProviderKey}
+}
+
+func (fileProvider) Describe(env *keycrypter.KeyEnv) []string {
+	return nil
+}
+
+func (fileProvider) Prompt(env *keycrypter.KeyEnv) string {
+	return ""
+}
+
+// withStdin runs f reading `input` from stdin
+func withStdin(t *testing.T, input string, f func()) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString(input)
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() {
+		os.Stdin = stdin
+		r.Close()
+	}()
+	f()
+}
+
+func TestConvertKeyProtection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cipherDir := filepath.Join(dir, "cipher")
+	os.Mkdir(cipherDir, 0700)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	conf := CipherConfig{CryptTypeStr: "AES256", PlainBS: 4096, Version: currentVersion}
+	setProvider(&conf, "file-test")
+	if err := ioutil.WriteFile(filepath.Join(cipherDir, fileProviderKey), key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveConf(filepath.Join(cipherDir, cffuse.ConfFile), conf); err != nil {
+		t.Fatal(err)
+	}
+	var choice int
+	for i, name := range keyProviderChoices() {
+		if name == "sss" {
+			choice = i + 1
+		}
+	}
+	shares := filepath.Join(dir, "a") + "," + filepath.Join(dir, "b")
+	opts := map[string]string{"shares": shares, "threshold": "2"}
+	withStdin(t, fmt.Sprintf("%d\n", choice), func() {
+		ConvertKeyProtection(cipherDir, keycrypter.DefaultKDFParams(keycrypter.KDFScrypt), opts)
+	})
+
+	conf = LoadConf(cipherDir)
+	if conf.KeyCryptType != KeyCryptTypeSSS || conf.KeyProvider != "" || conf.SplitShares != 2 {
+		t.Errorf("Wrong converted config: %+v", conf)
+	}
+	if _, err := os.Stat(filepath.Join(cipherDir, fileProviderKey)); !os.IsNotExist(err) {
+		t.Errorf("Old key file not removed: %v", err)
+	}
+	if k := LoadMasterKey(cipherDir, &conf, map[string]string{"keys": shares}); !bytes.Equal(k, key) {
+		t.Error("Converted protection unlocks a different key")
+	}
+}
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/declan94/cfcryptfs/keycrypter"
+)
+
+// DefaultKeyringTimeout is how long a key cached in the kernel keyring stays usable
+const DefaultKeyringTimeout = time.Hour
+
+// cachedMasterKey returns the key of the cipher directory cached in the kernel keyring by this session,
+// nil if there is none
+func cachedMasterKey(conf *CipherConfig) []byte {
+	if conf.VaultID == "" {
+		return nil
+	}
+	key, err := keycrypter.CachedKey(conf.VaultID)
+	if err != nil {
+		if err != keycrypter.ErrNotCached && err != keycrypter.ErrKeyringUnsupported {
+			tlog.Warn.Printf("Read kernel keyring failed: %v", err)
+		}
+		return nil
+	}
+	tlog.Info.Printf("Using the key cached in the kernel keyring")
+	return key
+}
+
+// cacheMasterKey caches the key of the cipher directory in the kernel keyring of option "keyring",
+// for the duration of option "keyring_timeout". Failures only warn, the key is unlocked already.
+func cacheMasterKey(conf *CipherConfig, key []byte, opts map[string]string) {
+	if conf.VaultID == "" {
+		tlog.Warn.Printf("The cipher directory has no vault ID, its key can't be cached")
+		return
+	}
+	timeout := DefaultKeyringTimeout
+	if opts["keyring_timeout"] != "" {
+		var err error
+		if timeout, err = time.ParseDuration(opts["keyring_timeout"]); err != nil {
+			tlog.Warn.Printf("Invalid keyring timeout: %v", err)
+			return
+		}
+	}
+	if err := keycrypter.CacheKey(opts["keyring"], conf.VaultID, key, timeout); err != nil {
+		tlog.Warn.Printf("Cache key in the kernel keyring failed: %v", err)
+	}
+}
+
+// PurgeCachedKeys removes the key of the cipher directory from the kernel keyring,
+// or all cached keys if cipherDir is empty
+func PurgeCachedKeys(cipherDir string) {
+	var vaultID string
+	if cipherDir != "" {
+		conf := LoadConf(cipherDir)
+		if conf.VaultID == "" {
+			fmt.Println("The cipher directory has no vault ID, its key is never cached.")
+			return
+		}
+		vaultID = conf.VaultID
+	}
+	n, err := keycrypter.PurgeCachedKeys(vaultID)
+	if err != nil {
+		tlog.Fatal.Printf("Purge cached keys failed: %v", err)
+		os.Exit(exitcode.KeyFile)
+	}
+	fmt.Printf("%d cached keys purged.\n", n)
+}
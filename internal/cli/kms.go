@@ -0,0 +1,129 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/declan94/cfcryptfs/keycrypter"
+)
+
+// kmsToken returns the Vault token from $VAULT_TOKEN, or the file $VAULT_TOKEN_FILE (default ~/.vault-token)
+func kmsToken() (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	path := os.Getenv("VAULT_TOKEN_FILE")
+	if path == "" {
+		path = expandPath("~/.vault-token")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", keyErrorf(exitcode.KMS, "Read KMS token failed: %v", err)
+	}
+	return "", keyErrorf(exitcode.KMS, "No KMS token, set VAULT_TOKEN or VAULT_TOKEN_FILE")
+}
+
+// kmsAddress returns the KMS address of the option "kms_address" or $VAULT_ADDR, "" if neither is set
+func kmsAddress(opts map[string]string) string {
+	if opts["kms_address"] != "" {
+		return opts["kms_address"]
+	}
+	return os.Getenv("VAULT_ADDR")
+}
+
+func checkKMSAddress(address string) error {
+	if err := keycrypter.CheckKMSAddress(address); err != nil {
+		return keyErrorf(exitcode.Usage, "%v", err)
+	}
+	return nil
+}
+
+// askKMSConfig asks for the transit key wrapping the key, the address defaults to $VAULT_ADDR.
+// The options "kms_address", "kms_mount" and "kms_key" give it without asking.
+func askKMSConfig(opts map[string]string) (keycrypter.KMSConfig, error) {
+	var conf keycrypter.KMSConfig
+	if opts["kms_key"] != "" {
+		conf = keycrypter.KMSConfig{Address: kmsAddress(opts), Mount: opts["kms_mount"], KeyName: opts["kms_key"]}
+		if conf.Address == "" {
+			return conf, keyErrorf(exitcode.Usage, "No KMS address, give it with -kms_address or set VAULT_ADDR")
+		}
+		return conf, checkKMSAddress(conf.Address)
+	}
+	if err := needOption(opts, "kms_key", "the transit key name"); err != nil {
+		return conf, err
+	}
+	for conf.Address == "" {
+		if addr := os.Getenv("VAULT_ADDR"); addr != "" {
+			fmt.Printf("KMS address (%s): ", addr)
+			conf.Address = addr
+		} else {
+			fmt.Printf("KMS address (e.g. https://vault.example.com:8200): ")
+		}
+		var input string
+		fmt.Scanln(&input)
+		if input = strings.Trim(input, " \t"); input != "" {
+			conf.Address = input
+		}
+		if err := keycrypter.CheckKMSAddress(conf.Address); err != nil {
+			tlog.Warn.Println(err)
+			conf.Address = ""
+		}
+	}
+	fmt.Printf("Transit mount (%s): ", keycrypter.DefaultKMSMount)
+	fmt.Scanln(&conf.Mount)
+	conf.Mount = strings.Trim(conf.Mount, " \t")
+	for conf.KeyName == "" {
+		fmt.Printf("Transit key name: ")
+		fmt.Scanln(&conf.KeyName)
+		conf.KeyName = strings.Trim(conf.KeyName, " \t")
+	}
+	return conf, nil
+}
+
+// SaveKeyKMS wraps the key with a transit key of the KMS, given by `opts` or asked for
+func SaveKeyKMS(cipherDir string, key []byte, opts map[string]string) error {
+	conf, err := askKMSConfig(opts)
+	if err != nil {
+		return err
+	}
+	token, err := kmsToken()
+	if err != nil {
+		return err
+	}
+	return keycrypter.StoreKeyKMS(filepath.Join(cipherDir, cffuse.KeyFile), key, keycrypter.NewKMSClient(conf, token))
+}
+
+// LoadKeyKMS load encryption key of the cipher directory unwrapped by the KMS at the address given by `opts`.
+// The address recorded in the key file isn't used, the cipher directory is untrusted.
+func LoadKeyKMS(cipherDir string, opts map[string]string) ([]byte, error) {
+	path := filepath.Join(cipherDir, cffuse.KeyFile)
+	kf, err := keycrypter.ReadKMSKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	address := kmsAddress(opts)
+	if address == "" {
+		return nil, keyErrorf(exitcode.Usage, "No KMS address, give it with -kms_address or set VAULT_ADDR (the key was wrapped by %s)", kf.KMS.Address)
+	}
+	if err = checkKMSAddress(address); err != nil {
+		return nil, err
+	}
+	token, err := kmsToken()
+	if err != nil {
+		return nil, err
+	}
+	key, err := keycrypter.LoadKeyKMS(path, keycrypter.NewKMSClient(keycrypter.KMSConfig{Address: address}, token))
+	if err != nil {
+		return nil, keyErrorf(exitcode.KMS, "%v", err)
+	}
+	return key, nil
+}
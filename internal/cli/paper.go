@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/declan94/cfcryptfs/keycrypter"
+)
+
+// readPaperOrFile reads the file at `path`, a paper backup of `kind` is decoded.
+// "-" reads a paper backup typed in.
+func readPaperOrFile(path string, kind string) ([]byte, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		fmt.Println("Type in the paper backup, ending with its END line:")
+		data, err = keycrypter.ReadPaper(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil || !keycrypter.IsPaper(data) {
+		return data, err
+	}
+	k, data, err := keycrypter.DecodePaper(data)
+	if err == nil && k != kind {
+		err = fmt.Errorf("Paper backup of %s, expected %s", k, kind)
+	}
+	return data, err
+}
+
+// PrintPaper prints a paper backup of a split keyfile or an emergency file
+func PrintPaper(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		tlog.Fatal.Printf("Read file failed: %v", err)
+		os.Exit(exitcode.Usage)
+	}
+	if keycrypter.IsPaper(data) {
+		tlog.Fatal.Printf("%s is a paper backup already", path)
+		os.Exit(exitcode.Usage)
+	}
+	var econf EmergencyConfig
+	if err = json.Unmarshal(data, &econf); err == nil && econf.EmergencyKey != "" {
+		// Compact json keeps the paper short
+		js, err := json.Marshal(econf)
+		if err != nil {
+			tlog.Fatal.Printf("Failed to marshal emergency configs")
+			os.Exit(exitcode.Config)
+		}
+		title := "cfcryptfs emergency file"
+		if econf.VaultID != "" {
+			title += ", vault " + econf.VaultID
+		}
+		fmt.Print(keycrypter.EncodePaper(keycrypter.PaperEmergency, js, title,
+			"Type in with `cfcryptfs -emergency_file - ...`, keep it SAFE and SECRET"))
+		return
+	}
+	info, err := keycrypter.ParseShareInfo(data)
+	if err != nil {
+		tlog.Fatal.Printf("%s is neither a split keyfile nor an emergency file: %v", path, err)
+		os.Exit(exitcode.Usage)
+	}
+	fmt.Print(keycrypter.EncodePaper(keycrypter.PaperShare, data,
+		"cfcryptfs split keyfile, "+info.String(),
+		"Type in with `cfcryptfs -keys -,... ...`"))
+}
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+)
+
+// SetPolicy sets the selective encryption policy of a cipher directory.
+// patternFile contains one passthrough pattern per line, "#" starts a comment line.
+// An empty pattern file removes the policy. The key is unlocked with the command line options `opts`.
+func SetPolicy(cipherDir string, opts map[string]string, patternFile string) {
+	conf := LoadConf(cipherDir)
+	if conf.FlatLayout {
+		tlog.Fatal.Printf("Selective encryption policy is not supported in flattened layout")
+		os.Exit(exitcode.Config)
+	}
+	fd, err := os.Open(patternFile)
+	if err != nil {
+		tlog.Fatal.Printf("Read pattern file failed: %v", err)
+		os.Exit(exitcode.Usage)
+	}
+	var patterns []string
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	fd.Close()
+	if err = scanner.Err(); err != nil {
+		tlog.Fatal.Printf("Read pattern file failed: %v", err)
+		os.Exit(exitcode.Usage)
+	}
+	key := LoadMasterKey(cipherDir, &conf, opts)
+	tlog.Warn.Printf("Existing files are not converted, files whose policy changes become inaccessible until moved in and out with the old policy.")
+	err = cffuse.SavePolicy(cipherDir, key, &cffuse.Policy{Passthrough: patterns})
+	if err != nil {
+		tlog.Fatal.Printf("Save policy failed: %v", err)
+		os.Exit(exitcode.Config)
+	}
+	if len(patterns) == 0 {
+		fmt.Println("Policy removed, everything is encrypted.")
+		return
+	}
+	fmt.Printf("Policy saved, paths stored unencrypted:\n")
+	for _, p := range patterns {
+		fmt.Printf("\t%s\n", p)
+	}
+}
+
+// LoadPolicy load the selective encryption policy of the cipher directory
+func LoadPolicy(cipherDir string, key []byte) *cffuse.Policy {
+	policy, err := cffuse.LoadPolicy(cipherDir, key)
+	if err != nil {
+		tlog.Fatal.Printf("Load policy failed: %v", err)
+		os.Exit(exitcode.Config)
+	}
+	return policy
+}
@@ -0,0 +1,360 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/declan94/cfcryptfs/keycrypter"
+)
+
+// EmergencyProvider is the name of the key provider unlocking emergency files,
+// it can't be chosen to protect a cipher directory
+const EmergencyProvider = "emergency"
+
+// builtinProviders are the names of the built-in key providers, indexed by their KeyCryptType
+var builtinProviders = []string{"password", "sss", "age", "ssh", "kms", "2fa"}
+
+// providerTitles are shown when choosing a key protection, other providers show their names
+var providerTitles = map[string]string{
+	"password": "Password",
+	"sss":      "Multi Key File",
+	"age":      "Public Key Recipients",
+	"ssh":      "SSH Agent",
+	"kms":      "Remote KMS",
+	"2fa":      "Password + Key File",
+}
+
+func init() {
+	keycrypter.RegisterKeyProvider("password", passwordProvider{})
+	keycrypter.RegisterKeyProvider("sss", sssProvider{})
+	keycrypter.RegisterKeyProvider("age", ageProvider{})
+	keycrypter.RegisterKeyProvider("ssh", sshProvider{})
+	keycrypter.RegisterKeyProvider("kms", kmsProvider{})
+	keycrypter.RegisterKeyProvider("2fa", twoFactorProvider{})
+	keycrypter.RegisterKeyProvider(EmergencyProvider, emergencyProvider{})
+}
+
+// providerName returns the name of the key provider of conf
+func providerName(conf *CipherConfig) string {
+	if conf.KeyCryptType == KeyCryptTypeCustom {
+		return conf.KeyProvider
+	}
+	if conf.KeyCryptType >= 0 && conf.KeyCryptType < len(builtinProviders) {
+		return builtinProviders[conf.KeyCryptType]
+	}
+	return ""
+}
+
+// setProvider makes the key provider `name` protect the key of conf
+func setProvider(conf *CipherConfig, name string) {
+	for i, n := range builtinProviders {
+		if n == name {
+			conf.KeyCryptType, conf.KeyProvider = i, ""
+			return
+		}
+	}
+	conf.KeyCryptType, conf.KeyProvider = KeyCryptTypeCustom, name
+}
+
+// protectionName describes the key protection of conf
+func protectionName(conf *CipherConfig) string {
+	if name, ok := keyCryptTypeNames[conf.KeyCryptType]; ok {
+		return name
+	}
+	return conf.KeyProvider
+}
+
+func providerTitle(name string) string {
+	if title, ok := providerTitles[name]; ok {
+		return title
+	}
+	return name
+}
+
+func lookupProvider(name string) keycrypter.KeyProvider {
+	p, err := keycrypter.LookupKeyProvider(name)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcode.Config)
+	}
+	return p
+}
+
+func newKeyEnv(cipherDir string, conf *CipherConfig, opts map[string]string, kp keycrypter.KDFParams) *keycrypter.KeyEnv {
+	if conf.KeyParams == nil {
+		conf.KeyParams = map[string]string{}
+	}
+	return &keycrypter.KeyEnv{CipherDir: cipherDir, Options: opts, KDF: kp, Params: conf.KeyParams, Config: conf}
+}
+
+// promptKeyProtection prepares protecting the key of conf in the cipher directory again
+// and tells what the user is asked for
+func promptKeyProtection(cipherDir string, conf *CipherConfig, opts map[string]string) {
+	msg := lookupProvider(providerName(conf)).Prompt(newKeyEnv(cipherDir, conf, opts, keycrypter.KDFParams{}))
+	if msg == "" {
+		msg = fmt.Sprintf("Protect the key with %s", protectionName(conf))
+	}
+	fmt.Println(msg)
+}
+
+// keyError is a failure of a built-in key provider with the exit code of the command line
+type keyError struct {
+	code int
+	msg  string
+}
+
+func (e *keyError) Error() string {
+	return e.msg
+}
+
+func keyErrorf(code int, format string, a ...interface{}) error {
+	return &keyError{code: code, msg: fmt.Sprintf(format, a...)}
+}
+
+// keyProviderExit returns the exit code of a key provider failure
+func keyProviderExit(err error) int {
+	switch e := err.(type) {
+	case *keyError:
+		return e.code
+	case *keycrypter.KMSError:
+		return exitcode.KMS
+	}
+	return exitcode.KeyFile
+}
+
+// optionList splits an option that may be repeated
+func optionList(opts map[string]string, name string) []string {
+	if opts[name] == "" {
+		return nil
+	}
+	return strings.Split(opts[name], ",")
+}
+
+func envConfig(env *keycrypter.KeyEnv) (*CipherConfig, error) {
+	conf, ok := env.Config.(*CipherConfig)
+	if !ok {
+		return nil, keyErrorf(exitcode.Config, "Key provider got a config of %T", env.Config)
+	}
+	return conf, nil
+}
+
+// The built-in providers return their failures as keyError, the command line exits with its code
+
+type passwordProvider struct{}
+
+func (passwordProvider) Protect(env *keycrypter.KeyEnv, key []byte) error {
+	return SaveKey(env.CipherDir, key, env.KDF, env.Options)
+}
+
+func (passwordProvider) Unlock(env *keycrypter.KeyEnv) ([]byte, error) {
+	if env.Options["keyfile"] != "" {
+		return LoadKeyWithKeyFile(env.CipherDir, env.Options["keyfile"])
+	}
+	return LoadKey(env.CipherDir, env.Options["passfile"], env.Options["password"])
+}
+
+func (passwordProvider) KeyFiles() []string {
+	return []string{cffuse.KeyFile}
+}
+
+func (passwordProvider) Describe(env *keycrypter.KeyEnv) []string {
+	ks, err := keycrypter.ReadKeySlots(filepath.Join(env.CipherDir, cffuse.KeyFile))
+	if err != nil {
+		return nil
+	}
+	return []string{fmt.Sprintf("Key Slots: %d", len(ks.Slots))}
+}
+
+func (passwordProvider) Prompt(env *keycrypter.KeyEnv) string {
+	if ks, err := keycrypter.ReadKeySlots(filepath.Join(env.CipherDir, cffuse.KeyFile)); err == nil && len(ks.Slots) > 1 {
+		tlog.Warn.Printf("Only one password slot is created for the new key, add the other slots again with -slot add")
+	}
+	return "Set new password"
+}
+
+type sssProvider struct{}
+
+func (sssProvider) Protect(env *keycrypter.KeyEnv, key []byte) error {
+	conf, err := envConfig(env)
+	if err != nil {
+		return err
+	}
+	return SaveKeySSS(env.CipherDir, key, conf, env.Options)
+}
+
+func (sssProvider) Unlock(env *keycrypter.KeyEnv) ([]byte, error) {
+	conf, err := envConfig(env)
+	if err != nil {
+		return nil, err
+	}
+	return LoadKeySSS(env.Options["keys"], *conf)
+}
+
+func (sssProvider) KeyFiles() []string {
+	return nil
+}
+
+func (sssProvider) Describe(env *keycrypter.KeyEnv) []string {
+	conf, err := envConfig(env)
+	if err != nil || conf.SplitThreshold == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("Split Keyfiles: %d of %d needed", conf.SplitThreshold, conf.SplitShares)}
+}
+
+// Prompt starts a new split, so the old keyfiles are rejected
+func (sssProvider) Prompt(env *keycrypter.KeyEnv) string {
+	if conf, err := envConfig(env); err == nil {
+		conf.SplitEpoch++
+	}
+	return "Create new split keyfiles, the old ones can't unlock the cipher directory afterwards"
+}
+
+type ageProvider struct{}
+
+func (ageProvider) Protect(env *keycrypter.KeyEnv, key []byte) error {
+	return SaveKeyAge(env.CipherDir, key, env.Options)
+}
+
+func (ageProvider) Unlock(env *keycrypter.KeyEnv) ([]byte, error) {
+	return LoadKeyAge(env.CipherDir, env.Options["identity"])
+}
+
+func (ageProvider) KeyFiles() []string {
+	return []string{cffuse.RecipientKeyFile}
+}
+
+func (ageProvider) Describe(env *keycrypter.KeyEnv) []string {
+	kf, err := keycrypter.ReadAgeKeyFile(filepath.Join(env.CipherDir, cffuse.RecipientKeyFile))
+	if err != nil {
+		return nil
+	}
+	return []string{fmt.Sprintf("Recipients: %d", len(kf.Recipients))}
+}
+
+// Prompt keeps the current recipients unless others are given with -recipient
+func (ageProvider) Prompt(env *keycrypter.KeyEnv) string {
+	if env.Options["recipient"] == "" {
+		if kf, err := keycrypter.ReadAgeKeyFile(filepath.Join(env.CipherDir, cffuse.RecipientKeyFile)); err == nil {
+			env.Options["recipient"] = strings.Join(kf.Recipients, ",")
+			return fmt.Sprintf("Encrypt to the %d current recipients", len(kf.Recipients))
+		}
+	}
+	return "Set recipients"
+}
+
+type sshProvider struct{}
+
+func (sshProvider) Protect(env *keycrypter.KeyEnv, key []byte) error {
+	return SaveKeySSH(env.CipherDir, key, env.Options)
+}
+
+func (sshProvider) Unlock(env *keycrypter.KeyEnv) ([]byte, error) {
+	return LoadKeySSH(env.CipherDir)
+}
+
+func (sshProvider) KeyFiles() []string {
+	return []string{cffuse.SSHKeyFile}
+}
+
+func (sshProvider) Describe(env *keycrypter.KeyEnv) []string {
+	kf, err := keycrypter.ReadSSHKeyFile(filepath.Join(env.CipherDir, cffuse.SSHKeyFile))
+	if err != nil {
+		return nil
+	}
+	return []string{fmt.Sprintf("SSH Keys: %d", len(kf.Slots))}
+}
+
+func (sshProvider) Prompt(env *keycrypter.KeyEnv) string {
+	return "Choose ssh keys"
+}
+
+type kmsProvider struct{}
+
+func (kmsProvider) Protect(env *keycrypter.KeyEnv, key []byte) error {
+	return SaveKeyKMS(env.CipherDir, key, env.Options)
+}
+
+func (kmsProvider) Unlock(env *keycrypter.KeyEnv) ([]byte, error) {
+	return LoadKeyKMS(env.CipherDir, env.Options)
+}
+
+func (kmsProvider) KeyFiles() []string {
+	return []string{cffuse.KeyFile}
+}
+
+func (kmsProvider) Describe(env *keycrypter.KeyEnv) []string {
+	kf, err := keycrypter.ReadKMSKeyFile(filepath.Join(env.CipherDir, cffuse.KeyFile))
+	if err != nil {
+		return nil
+	}
+	return []string{fmt.Sprintf("KMS Key: %s/v1/%s/keys/%s", kf.KMS.Address, kf.KMS.Mount, kf.KMS.KeyName)}
+}
+
+func (kmsProvider) Prompt(env *keycrypter.KeyEnv) string {
+	return "Set the KMS key"
+}
+
+type twoFactorProvider struct{}
+
+func (twoFactorProvider) Protect(env *keycrypter.KeyEnv, key []byte) error {
+	return SaveKeyTwoFactor(env.CipherDir, key, env.KDF, env.Options)
+}
+
+func (twoFactorProvider) Unlock(env *keycrypter.KeyEnv) ([]byte, error) {
+	return LoadKeyTwoFactor(env.CipherDir, env.Options)
+}
+
+func (twoFactorProvider) KeyFiles() []string {
+	return []string{cffuse.KeyFile}
+}
+
+func (twoFactorProvider) Describe(env *keycrypter.KeyEnv) []string {
+	return nil
+}
+
+func (twoFactorProvider) Prompt(env *keycrypter.KeyEnv) string {
+	return "Set new password and keyfile"
+}
+
+// emergencyProvider exports the config and key to the emergency file of option "emergency_file",
+// unlocking one fills the config of the env
+type emergencyProvider struct{}
+
+func (emergencyProvider) Protect(env *keycrypter.KeyEnv, key []byte) error {
+	conf, err := envConfig(env)
+	if err != nil {
+		return err
+	}
+	return exportEmergencyFile(env.CipherDir, env.Options["emergency_file"], *conf, key, optionList(env.Options, "recipient"))
+}
+
+func (emergencyProvider) Unlock(env *keycrypter.KeyEnv) ([]byte, error) {
+	conf, err := envConfig(env)
+	if err != nil {
+		return nil, err
+	}
+	ecf, key, err := LoadEmergencyFile(env.Options["emergency_file"], env.Options["identity"])
+	if err != nil {
+		return nil, err
+	}
+	*conf = ecf
+	return key, nil
+}
+
+func (emergencyProvider) KeyFiles() []string {
+	return nil
+}
+
+func (emergencyProvider) Describe(env *keycrypter.KeyEnv) []string {
+	return nil
+}
+
+func (emergencyProvider) Prompt(env *keycrypter.KeyEnv) string {
+	return ""
+}
@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/keycrypter"
+)
+
+func TestProviderErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-providers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", "")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	batch := map[string]string{"json": "true"}
+	for _, c := range []struct {
+		name     string
+		provider string
+		protect  bool
+		opts     map[string]string
+		config   bool
+		code     int
+	}{
+		{"sss without keyfiles", "sss", false, map[string]string{}, true, exitcode.Usage},
+		{"sss without config", "sss", false, map[string]string{"keys": "/a,/b"}, false, exitcode.Config},
+		{"sss with one share", "sss", true, map[string]string{"shares": "/a"}, true, exitcode.Usage},
+		{"sss in batch mode", "sss", true, batch, true, exitcode.Usage},
+		{"age without identity", "age", false, map[string]string{}, true, exitcode.Usage},
+		{"age in batch mode", "age", true, batch, true, exitcode.Usage},
+		{"2fa without keyfile", "2fa", false, map[string]string{}, true, exitcode.Usage},
+		{"kms over http", "kms", true, map[string]string{"kms_key": "k", "kms_address": "http://vault"}, true, exitcode.Usage},
+		{"kms in batch mode", "kms", true, batch, true, exitcode.Usage},
+		{"ssh without agent", "ssh", false, map[string]string{}, true, exitcode.KeyFile},
+		{"missing emergency file", EmergencyProvider, false, map[string]string{"emergency_file": filepath.Join(dir, "missing")}, true, exitcode.Config},
+	} {
+		p, err := keycrypter.LookupKeyProvider(c.provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf := &CipherConfig{}
+		env := newKeyEnv(dir, conf, c.opts, keycrypter.KDFParams{})
+		if !c.config {
+			env.Config = nil
+		}
+		if c.protect {
+			err = p.Protect(env, key)
+		} else {
+			_, err = p.Unlock(env)
+		}
+		if err == nil {
+			t.Errorf("%s: no error", c.name)
+		} else if code := keyProviderExit(err); code != c.code {
+			t.Errorf("%s: exit code %d, want %d (%v)", c.name, code, c.code, err)
+		}
+	}
+}
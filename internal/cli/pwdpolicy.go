@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"strconv"
+
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/declan94/cfcryptfs/readpwd"
+)
+
+// pwdPolicy returns the password policy of the command line options "min_pwd_score" and "pwd_denylist",
+// nil if option "allow_weak_password" turns it off
+func pwdPolicy(opts map[string]string) (*readpwd.Policy, error) {
+	if opts["allow_weak_password"] == "true" {
+		return nil, nil
+	}
+	policy := &readpwd.Policy{MinScore: readpwd.DefaultMinScore}
+	if opts["min_pwd_score"] != "" {
+		policy.MinScore, _ = strconv.Atoi(opts["min_pwd_score"])
+	}
+	if opts["pwd_denylist"] != "" {
+		words, err := readpwd.ReadDenylist(opts["pwd_denylist"])
+		if err != nil {
+			return nil, keyErrorf(exitcode.Usage, "Read password denylist failed: %v", err)
+		}
+		policy.Denylist = words
+	}
+	return policy, nil
+}
+
+// askNewPassword asks for a new password until one satisfies the password policy of `opts`.
+// A password from a configured source can't be asked again, a rejected one is returned as error.
+func askNewPassword(opts map[string]string) (string, error) {
+	policy, err := pwdPolicy(opts)
+	if err != nil {
+		return "", err
+	}
+	for {
+		pwd, err := readpwd.Twice("")
+		if err == nil && policy != nil {
+			err = policy.Check(pwd)
+			if err != nil && !readpwd.Interactive() {
+				tlog.Info.Printf("Use -allow_weak_password for test vaults")
+				return "", keyErrorf(exitcode.WeakPassword, "%v", err)
+			}
+		}
+		if err == nil {
+			return pwd, nil
+		}
+		tlog.Warn.Println(err)
+	}
+}
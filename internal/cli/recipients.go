@@ -0,0 +1,158 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/declan94/cfcryptfs/keycrypter"
+)
+
+// GenerateIdentity generates an age identity, writes it to `path` and prints its recipient
+func GenerateIdentity(path string) string {
+	recipient, err := generateIdentity(path)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcode.KeyFile)
+	}
+	return recipient
+}
+
+func generateIdentity(path string) (string, error) {
+	identity, recipient, err := keycrypter.GenerateAgeIdentity()
+	if err != nil {
+		return "", fmt.Errorf("Generate identity failed: %v", err)
+	}
+	content := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), recipient, identity)
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		_, err = fd.WriteString(content)
+		fd.Close()
+	}
+	if err != nil {
+		return "", fmt.Errorf("Write identity file failed: %v", err)
+	}
+	fmt.Printf("Identity stored in %s, keep it SECRET\n", path)
+	fmt.Printf("Public key: %s\n", recipient)
+	return recipient, nil
+}
+
+// askRecipients asks for recipients, a key pair is generated for "new"
+func askRecipients() []string {
+	var recipients []string
+	for {
+		fmt.Printf("Recipient (age1..., `new` to generate a key pair, empty to finish): ")
+		var r string
+		fmt.Scanln(&r)
+		r = strings.Trim(r, " \t")
+		switch {
+		case r == "" && len(recipients) > 0:
+			return recipients
+		case r == "":
+			tlog.Warn.Println("At least one recipient is needed")
+		case r == "new":
+			fmt.Printf("Path to store the identity: ")
+			var p string
+			fmt.Scanln(&p)
+			r, err := generateIdentity(expandPath(strings.Trim(p, " \t")))
+			if err != nil {
+				tlog.Warn.Println(err)
+				continue
+			}
+			recipients = append(recipients, r)
+		default:
+			if _, err := keycrypter.ParseAgeRecipient(r); err != nil {
+				tlog.Warn.Println(err)
+				continue
+			}
+			recipients = append(recipients, r)
+		}
+	}
+}
+
+// SaveKeyAge encrypts the key to the recipients of option "recipient", which are asked for when there are none
+func SaveKeyAge(cipherDir string, key []byte, opts map[string]string) error {
+	recipients := optionList(opts, "recipient")
+	if len(recipients) == 0 {
+		if err := needOption(opts, "recipient", "a recipient"); err != nil {
+			return err
+		}
+		recipients = askRecipients()
+	}
+	return keycrypter.StoreKeyAge(filepath.Join(cipherDir, cffuse.RecipientKeyFile), key, recipients)
+}
+
+// LoadKeyAge load encryption key of the cipher directory with the identities in `identityFile`
+func LoadKeyAge(cipherDir string, identityFile string) ([]byte, error) {
+	if identityFile == "" {
+		return nil, keyErrorf(exitcode.Usage, "This cipher directory is unlocked with a private key, you should specify an identity file with `-identity`")
+	}
+	ids, err := readIdentities(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	return keycrypter.LoadKeyAge(filepath.Join(cipherDir, cffuse.RecipientKeyFile), ids)
+}
+
+// RecipientCommand runs the recipient command (add/list/remove) in args.RecipientCmd
+func RecipientCommand(args Args) {
+	conf := LoadConf(args.CipherDir)
+	if conf.KeyCryptType != KeyCryptTypeAGE {
+		tlog.Fatal.Printf("Recipients only work with public key protected key")
+		os.Exit(exitcode.Usage)
+	}
+	path := filepath.Join(args.CipherDir, cffuse.RecipientKeyFile)
+	kf, err := keycrypter.ReadAgeKeyFile(path)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcode.KeyFile)
+	}
+	switch args.RecipientCmd {
+	case "list":
+		for _, r := range kf.Recipients {
+			fmt.Println(r)
+		}
+		return
+	case "add", "remove":
+	default:
+		tlog.Fatal.Printf("Unknown recipient command: %s (add/list/remove)", args.RecipientCmd)
+		os.Exit(exitcode.Usage)
+	}
+	if len(args.Recipients) == 0 {
+		tlog.Fatal.Printf("Specify recipients with `-recipient`")
+		os.Exit(exitcode.Usage)
+	}
+	key, err := LoadKeyAge(args.CipherDir, args.Identity)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(keyProviderExit(err))
+	}
+	for _, r := range args.Recipients {
+		if args.RecipientCmd == "add" {
+			err = kf.Add(r)
+		} else {
+			err = kf.Remove(r)
+		}
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcode.Usage)
+		}
+	}
+	if err = kf.Seal(key); err != nil {
+		tlog.Fatal.Printf("Encrypt key failed: %v", err)
+		os.Exit(exitcode.KeyFile)
+	}
+	if err = kf.Write(path); err != nil {
+		tlog.Fatal.Printf("Write key file failed: %v", err)
+		os.Exit(exitcode.KeyFile)
+	}
+	fmt.Printf("Recipients: %d\n", len(kf.Recipients))
+	if args.RecipientCmd == "remove" {
+		fmt.Println("Removed recipients can still unlock copies of the old key file, e.g. in backups.")
+	}
+}
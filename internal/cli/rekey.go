@@ -0,0 +1,266 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+	"github.com/declan94/cfcryptfs/corecrypter"
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/declan94/cfcryptfs/keycrypter"
+)
+
+const (
+	rekeyPhaseMove = "move"
+	rekeyPhaseSwap = "swap"
+	// rekeyJournalInfo binds the new key wrapped in the journal to its purpose
+	rekeyJournalInfo = "cfcryptfs rekey journal"
+	// rekeyJournalEvery is the count of moved entries between journal updates
+	rekeyJournalEvery = 100
+	// rekeyShareSuffix is appended to the paths of new split keyfiles until the swap phase,
+	// the old ones may be at the same paths and are needed to resume the move phase
+	rekeyShareSuffix = ".rekey"
+)
+
+// rekeyJournal records the progress of a rekey in the cipher directory
+type rekeyJournal struct {
+	// Phase is "move" while entries are re-encrypted into the rekey directory,
+	// "swap" once the new key is protected there and the rekey directory replaces the old one
+	Phase string
+	// Key is the new master key wrapped by the old one, only needed in the move phase
+	Key []byte `json:",omitempty"`
+	// Moved counts the re-encrypted entries
+	Moved int
+	// Shares are the paths of the new split keyfiles, written with rekeyShareSuffix and moved in place by the swap
+	Shares []string `json:",omitempty"`
+}
+
+func readRekeyJournal(cipherDir string) (*rekeyJournal, error) {
+	data, err := ioutil.ReadFile(filepath.Join(cipherDir, cffuse.RekeyJournal))
+	if err != nil {
+		return nil, err
+	}
+	var j rekeyJournal
+	if err = json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("Parse rekey journal failed: %v", err)
+	}
+	return &j, nil
+}
+
+// writeRekeyJournal saves the journal, the old one is replaced atomically
+func writeRekeyJournal(cipherDir string, j *rekeyJournal) {
+	data, err := json.Marshal(j)
+	if err == nil {
+		tmp := filepath.Join(cipherDir, cffuse.RekeyJournalTmp)
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, filepath.Join(cipherDir, cffuse.RekeyJournal))
+		}
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Write rekey journal failed: %v", err)
+		os.Exit(exitcode.CipherDir)
+	}
+}
+
+// rekeyInProgress checks whether a rekey of the cipher directory was started and not finished
+func rekeyInProgress(cipherDir string) bool {
+	_, err := os.Stat(filepath.Join(cipherDir, cffuse.RekeyJournal))
+	return err == nil
+}
+
+// RekeyCipherDir re-encrypts all contents and names of the cipher directory under a new master key,
+// which is protected the same way as the old one. The old key is unlocked with the command line options `opts`,
+// a password protected key is derived with kdf parameters kp.
+// The directory must not be mounted. An interrupted rekey is resumed by running it again.
+func RekeyCipherDir(cipherDir string, kp keycrypter.KDFParams, opts map[string]string) {
+	stage := filepath.Join(cipherDir, cffuse.RekeyDir)
+	j, err := readRekeyJournal(cipherDir)
+	if err != nil && !os.IsNotExist(err) {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcode.CipherDir)
+	}
+	if j != nil && j.Phase == rekeyPhaseSwap {
+		fmt.Println("Resume the rekey, the new key is already protected")
+		finishRekey(cipherDir, stage, j.Shares)
+		return
+	}
+	conf := LoadConf(cipherDir)
+	oldKey := LoadMasterKey(cipherDir, &conf, opts)
+	var newKey []byte
+	if j == nil {
+		fmt.Printf("Re-encrypt [%s] under a new master key? It must not be mounted until the rekey finishes. (y/N)", cipherDir)
+		var input string
+		fmt.Scanln(&input)
+		if strings.ToUpper(strings.Trim(input, " \t")) != "Y" {
+			return
+		}
+		if newKey, err = corecrypter.RandomKey(conf.CryptType); err != nil {
+			tlog.Fatal.Printf("Generate random key failed: %v", err)
+			os.Exit(exitcode.KeyFile)
+		}
+		wrapped, err := keycrypter.WrapKey(oldKey, newKey, rekeyJournalInfo)
+		if err != nil {
+			tlog.Fatal.Printf("Encrypt key failed: %v", err)
+			os.Exit(exitcode.KeyFile)
+		}
+		if err = os.Mkdir(stage, 0700); err != nil && !os.IsExist(err) {
+			tlog.Fatal.Printf("Create rekey directory failed: %v", err)
+			os.Exit(exitcode.CipherDir)
+		}
+		j = &rekeyJournal{Phase: rekeyPhaseMove, Key: wrapped}
+		writeRekeyJournal(cipherDir, j)
+	} else {
+		if newKey, err = keycrypter.UnwrapKey(oldKey, j.Key, rekeyJournalInfo); err != nil {
+			tlog.Fatal.Printf("Decrypt the new key of the rekey journal failed: %v", err)
+			os.Exit(exitcode.KeyFile)
+		}
+		fmt.Printf("Resume the rekey, %d entries were re-encrypted\n", j.Moved)
+	}
+
+	srcConf := cffuse.FsConfig{
+		CipherDir:  cipherDir,
+		CryptKey:   oldKey,
+		CryptType:  conf.CryptType,
+		PlainBS:    conf.PlainBS,
+		PlainPath:  conf.PlainPath,
+		FlatLayout: conf.FlatLayout,
+	}
+	if !conf.FlatLayout {
+		srcConf.Policy = LoadPolicy(cipherDir, oldKey)
+	}
+	dstConf := srcConf
+	dstConf.CipherDir, dstConf.CryptKey = stage, newKey
+	if dstConf.Policy != nil {
+		if err = cffuse.SavePolicy(stage, newKey, dstConf.Policy); err != nil {
+			tlog.Fatal.Printf("Save policy failed: %v", err)
+			os.Exit(exitcode.Config)
+		}
+	}
+	src, dst := cffuse.NewFS(srcConf, nil), cffuse.NewFS(dstConf, nil)
+	if src == nil || dst == nil {
+		os.Exit(exitcode.CipherDir)
+	}
+	err = cffuse.MoveTree(src, dst, func(path string) error {
+		j.Moved++
+		if j.Moved%rekeyJournalEvery == 0 {
+			writeRekeyJournal(cipherDir, j)
+			fmt.Printf("\r%d entries re-encrypted", j.Moved)
+		}
+		return nil
+	})
+	if err != nil {
+		tlog.Fatal.Printf("\nRe-encrypt failed: %v", err)
+		tlog.Info.Printf("Run -rekey again to resume")
+		writeRekeyJournal(cipherDir, j)
+		os.Exit(exitcode.CipherDir)
+	}
+	writeRekeyJournal(cipherDir, j)
+	fmt.Printf("\r%d entries re-encrypted\n", j.Moved)
+	checkRekeyLeftovers(cipherDir, conf.FlatLayout)
+
+	newConf := conf
+	newConf.KeyParams = nil
+	opts["share_suffix"] = rekeyShareSuffix
+	fmt.Printf("Protect the new key with %s\n", protectionName(&newConf))
+	promptKeyProtection(cipherDir, &newConf, opts)
+	saveKeyProtection(stage, newKey, &newConf, kp, opts)
+	if err = SaveConf(filepath.Join(stage, cffuse.ConfFile), newConf); err != nil {
+		tlog.Fatal.Printf("Write conf file failed: %v", err)
+		os.Exit(exitcode.Config)
+	}
+	swap := &rekeyJournal{Phase: rekeyPhaseSwap, Moved: j.Moved, Shares: optionList(opts, "staged_shares")}
+	writeRekeyJournal(cipherDir, swap)
+	finishRekey(cipherDir, stage, swap.Shares)
+}
+
+// checkRekeyLeftovers exits if entries which couldn't be decrypted are left in the root of the cipher directory
+func checkRekeyLeftovers(cipherDir string, flatLayout bool) {
+	infos, err := ioutil.ReadDir(cipherDir)
+	if err != nil {
+		tlog.Fatal.Printf("Read cipher directory failed: %v", err)
+		os.Exit(exitcode.CipherDir)
+	}
+	var left []string
+	for _, info := range infos {
+		n := info.Name()
+		if cffuse.IsNameReserved(n) || (flatLayout && n == cffuse.ObjectDir) {
+			continue
+		}
+		left = append(left, n)
+	}
+	if len(left) > 0 {
+		tlog.Fatal.Printf("Entries which can't be decrypted are left: %s", strings.Join(left, ", "))
+		tlog.Info.Printf("Resolve them (e.g. with -conflicts) and run -rekey again to resume")
+		os.Exit(exitcode.CipherDir)
+	}
+}
+
+// finishRekey moves the new split keyfiles `shares` in place and replaces the contents, key files and config
+// of the cipher directory with the rekey directory.
+// The config is replaced last, every step can be repeated after an interruption.
+func finishRekey(cipherDir string, stage string, shares []string) {
+	for _, p := range shares {
+		if err := os.Rename(p+rekeyShareSuffix, p); err != nil && !os.IsNotExist(err) {
+			tlog.Fatal.Printf("Replace split keyfile [%s] failed: %v", p, err)
+			tlog.Info.Printf("Run -rekey again to resume")
+			os.Exit(exitcode.CipherDir)
+		}
+	}
+	infos, err := ioutil.ReadDir(stage)
+	if err != nil && !os.IsNotExist(err) {
+		tlog.Fatal.Printf("Read rekey directory failed: %v", err)
+		os.Exit(exitcode.CipherDir)
+	}
+	for _, info := range infos {
+		n := info.Name()
+		if cffuse.IsNameReserved(n) {
+			continue
+		}
+		if n == cffuse.ObjectDir {
+			err = os.RemoveAll(filepath.Join(cipherDir, n))
+		}
+		if err == nil {
+			err = os.Rename(filepath.Join(stage, n), filepath.Join(cipherDir, n))
+		}
+		if err != nil {
+			tlog.Fatal.Printf("Move re-encrypted entry failed: %v", err)
+			tlog.Info.Printf("Run -rekey again to resume")
+			os.Exit(exitcode.CipherDir)
+		}
+	}
+	var names []string
+	for _, n := range cffuse.ReservedNames {
+		if n != cffuse.ConfFile {
+			names = append(names, n)
+		}
+	}
+	for _, n := range append(names, cffuse.ConfFile) {
+		if _, err = os.Lstat(filepath.Join(stage, n)); err != nil {
+			continue
+		}
+		if err = os.Rename(filepath.Join(stage, n), filepath.Join(cipherDir, n)); err != nil {
+			tlog.Fatal.Printf("Replace %s failed: %v", n, err)
+			tlog.Info.Printf("Run -rekey again to resume")
+			os.Exit(exitcode.CipherDir)
+		}
+	}
+	// A key cached in the kernel keyring is the old one
+	if conf := LoadConf(cipherDir); conf.VaultID != "" {
+		keycrypter.PurgeCachedKeys(conf.VaultID)
+	}
+	os.RemoveAll(stage)
+	os.Remove(filepath.Join(cipherDir, cffuse.RekeyJournal))
+	fmt.Printf("\nRekey finished: %s\n", cipherDir)
+	if len(shares) > 0 {
+		fmt.Println("Split keyfiles stored in:")
+		for _, p := range shares {
+			fmt.Printf("\t%s\n", p)
+		}
+	}
+	fmt.Println("Old emergency files, split keyfiles and key file backups can't decrypt it anymore, export a new emergency file with -export.")
+}
@@ -0,0 +1,118 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+)
+
+// rekeyFixture is a cipher directory in the swap phase of a rekey
+type rekeyFixture struct {
+	cipherDir string
+	stage     string
+	shares    []string
+}
+
+func newRekeyFixture(t *testing.T, dir string) *rekeyFixture {
+	f := &rekeyFixture{cipherDir: filepath.Join(dir, "cipher"), stage: filepath.Join(dir, "cipher", cffuse.RekeyDir)}
+	write := func(path string, content string) {
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []string{f.cipherDir, f.stage} {
+		content, bs := "old", 4096
+		if d == f.stage {
+			content, bs = "new", 8192
+		}
+		os.MkdirAll(d, 0700)
+		if err := SaveConf(filepath.Join(d, cffuse.ConfFile), CipherConfig{CryptTypeStr: "AES256", PlainBS: bs}); err != nil {
+			t.Fatal(err)
+		}
+		write(filepath.Join(d, cffuse.KeyFile), content)
+		write(filepath.Join(d, cffuse.ObjectDir, "object"), content)
+	}
+	write(filepath.Join(f.stage, "entry"), "new")
+	write(filepath.Join(f.stage, "dir", "entry"), "new")
+	write(filepath.Join(f.cipherDir, cffuse.RekeyJournal), "{}")
+	for _, n := range []string{"share1", "share2"} {
+		p := filepath.Join(dir, n)
+		write(p, "old")
+		write(p+rekeyShareSuffix, "new")
+		f.shares = append(f.shares, p)
+	}
+	return f
+}
+
+// steps are the changes of finishRekey in order
+func (f *rekeyFixture) steps() []func() error {
+	var steps []func() error
+	rename := func(from string, to string) {
+		steps = append(steps, func() error { return os.Rename(from, to) })
+	}
+	for _, p := range f.shares {
+		rename(p+rekeyShareSuffix, p)
+	}
+	for _, n := range []string{"dir", "entry", cffuse.ObjectDir} {
+		if n == cffuse.ObjectDir {
+			steps = append(steps, func() error { return os.RemoveAll(filepath.Join(f.cipherDir, cffuse.ObjectDir)) })
+		}
+		rename(filepath.Join(f.stage, n), filepath.Join(f.cipherDir, n))
+	}
+	for _, n := range []string{cffuse.KeyFile, cffuse.ConfFile} {
+		rename(filepath.Join(f.stage, n), filepath.Join(f.cipherDir, n))
+	}
+	return steps
+}
+
+func (f *rekeyFixture) check(t *testing.T) {
+	for _, p := range append([]string{
+		filepath.Join(f.cipherDir, cffuse.KeyFile),
+		filepath.Join(f.cipherDir, cffuse.ObjectDir, "object"),
+		filepath.Join(f.cipherDir, "entry"),
+		filepath.Join(f.cipherDir, "dir", "entry"),
+	}, f.shares...) {
+		if data, err := ioutil.ReadFile(p); err != nil || string(data) != "new" {
+			t.Errorf("%s: got %q, %v", p, data, err)
+		}
+	}
+	if conf := LoadConf(f.cipherDir); conf.PlainBS != 8192 {
+		t.Errorf("Old config left: %v", conf)
+	}
+	for _, p := range []string{f.stage, filepath.Join(f.cipherDir, cffuse.RekeyJournal), f.shares[0] + rekeyShareSuffix} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("%s is left: %v", p, err)
+		}
+	}
+}
+
+// TestFinishRekey interrupts finishRekey after every step and runs it again
+func TestFinishRekey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-finish-rekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for done := 0; ; done++ {
+		os.RemoveAll(dir)
+		f := newRekeyFixture(t, dir)
+		steps := f.steps()
+		if done > len(steps) {
+			break
+		}
+		for i := 0; i < done; i++ {
+			if err := steps[i](); err != nil {
+				t.Fatalf("Step %d: %v", i, err)
+			}
+		}
+		finishRekey(f.cipherDir, f.stage, f.shares)
+		f.check(t)
+		// The journal is removed last, a repeated finish changes nothing
+		finishRekey(f.cipherDir, f.stage, f.shares)
+		f.check(t)
+	}
+}
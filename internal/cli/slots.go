@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/declan94/cfcryptfs/keycrypter"
+)
+
+func readKeySlots(cipherDir string) *keycrypter.KeySlots {
+	ks, err := keycrypter.ReadKeySlots(filepath.Join(cipherDir, cffuse.KeyFile))
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcode.KeyFile)
+	}
+	return ks
+}
+
+// LoadKeyWithKeyFile load encryption key of the cipher directory from a keyfile slot
+func LoadKeyWithKeyFile(cipherDir string, keyfile string) ([]byte, error) {
+	key, _, err := keycrypter.UnlockKey(filepath.Join(cipherDir, cffuse.KeyFile), "", "", keyfile)
+	return key, err
+}
+
+// KeySlotCommand runs the key slot command (add/list/test/remove) in args.Slot
+func KeySlotCommand(args Args) {
+	conf := LoadConf(args.CipherDir)
+	if conf.KeyCryptType != KeyCryptTypePWD {
+		tlog.Fatal.Printf("Key slots only work with password protected key")
+		os.Exit(exitcode.Usage)
+	}
+	path := filepath.Join(args.CipherDir, cffuse.KeyFile)
+	ks := readKeySlots(args.CipherDir)
+	switch args.Slot {
+	case "list":
+		for _, s := range ks.Slots {
+			fmt.Printf("Slot %d: %s %q, %s\n", s.ID, s.Type, s.Label, s.KDF())
+		}
+		return
+	case "test":
+		_, id, err := keycrypter.UnlockKey(path, args.PwdFile, args.Password, args.KeyFile)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcode.KeyFile)
+		}
+		fmt.Printf("Unlocked key slot %d\n", id)
+		return
+	case "add", "remove":
+	default:
+		tlog.Fatal.Printf("Unknown key slot command: %s (add/list/test/remove)", args.Slot)
+		os.Exit(exitcode.Usage)
+	}
+
+	fmt.Println("Unlock with an existing password or keyfile")
+	key, _, err := ks.UnlockWith(args.PwdFile, args.Password, args.KeyFile)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcode.KeyFile)
+	}
+	if args.Slot == "remove" {
+		if err = ks.Remove(args.SlotID); err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcode.Usage)
+		}
+	} else {
+		typ := keycrypter.SlotPassword
+		var credential []byte
+		if args.NewKeyFile != "" {
+			typ = keycrypter.SlotKeyFile
+			if credential, err = ioutil.ReadFile(args.NewKeyFile); err != nil {
+				tlog.Fatal.Printf("Read keyfile failed: %v", err)
+				os.Exit(exitcode.KeyFile)
+			}
+		} else {
+			fmt.Println("Enter the password for the new key slot")
+			pwd, err := askNewPassword(args.Options)
+			if err != nil {
+				tlog.Fatal.Println(err)
+				os.Exit(keyProviderExit(err))
+			}
+			credential = []byte(pwd)
+		}
+		if args.SlotID, err = ks.Add(typ, args.SlotLabel, credential, key, args.KDF); err != nil {
+			tlog.Fatal.Printf("Encrypt key failed: %v", err)
+			os.Exit(exitcode.KeyFile)
+		}
+	}
+	if err = ks.Write(path); err != nil {
+		tlog.Fatal.Printf("Write key file failed: %v", err)
+		os.Exit(exitcode.KeyFile)
+	}
+	if args.Slot == "remove" {
+		fmt.Printf("Key slot %d removed\n", args.SlotID)
+	} else {
+		fmt.Printf("Key slot %d added\n", args.SlotID)
+	}
+}
@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+	"github.com/declan94/cfcryptfs/keycrypter"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// connectSSHAgent connects to the ssh-agent at $SSH_AUTH_SOCK
+func connectSSHAgent() (agent.ExtendedAgent, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("No ssh-agent running, SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("Connect to ssh-agent failed: %v", err)
+	}
+	return agent.NewClient(conn), nil
+}
+
+// askSSHKeys asks which ssh keys of the agent wrap the key,
+// option "ssh_keys" gives their SHA256 fingerprints without asking
+func askSSHKeys(ag agent.ExtendedAgent, opts map[string]string) ([]ssh.PublicKey, error) {
+	held, err := ag.List()
+	if err != nil {
+		return nil, fmt.Errorf("ssh-agent list keys failed: %v", err)
+	}
+	var keys []*agent.Key
+	for _, k := range held {
+		if keycrypter.SSHKeySupported(k) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("The ssh-agent holds no ed25519 or rsa key")
+	}
+	if fps := optionList(opts, "ssh_keys"); len(fps) > 0 {
+		var pubs []ssh.PublicKey
+		for _, fp := range fps {
+			var found ssh.PublicKey
+			for _, k := range keys {
+				if ssh.FingerprintSHA256(k) == strings.Trim(fp, " \t") {
+					found = k
+				}
+			}
+			if found == nil {
+				return nil, fmt.Errorf("The ssh-agent holds no supported key %s", fp)
+			}
+			pubs = append(pubs, found)
+		}
+		return pubs, nil
+	}
+	if len(keys) == 1 {
+		fmt.Printf("Using ssh key %s %s\n", ssh.FingerprintSHA256(keys[0]), keys[0].Comment)
+		return []ssh.PublicKey{keys[0]}, nil
+	}
+	if err = needOption(opts, "ssh_keys", "the fingerprints of the ssh keys"); err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		fmt.Printf("%d: %s %s\n", i+1, ssh.FingerprintSHA256(k), k.Comment)
+	}
+	for {
+		fmt.Printf("Choose ssh keys (e.g. 1,3): ")
+		var input string
+		fmt.Scanln(&input)
+		var pubs []ssh.PublicKey
+		for _, f := range strings.Split(input, ",") {
+			i, err := strconv.Atoi(strings.Trim(f, " \t"))
+			if err != nil || i < 1 || i > len(keys) {
+				pubs = nil
+				break
+			}
+			pubs = append(pubs, keys[i-1])
+		}
+		if len(pubs) > 0 {
+			return pubs, nil
+		}
+	}
+}
+
+// SaveKeySSH wraps the key with ssh keys held by the ssh-agent, chosen by `opts` or asked for
+func SaveKeySSH(cipherDir string, key []byte, opts map[string]string) error {
+	ag, err := connectSSHAgent()
+	if err != nil {
+		return err
+	}
+	keys, err := askSSHKeys(ag, opts)
+	if err != nil {
+		return err
+	}
+	return keycrypter.StoreKeySSH(filepath.Join(cipherDir, cffuse.SSHKeyFile), key, ag, keys)
+}
+
+// LoadKeySSH load encryption key of the cipher directory through the ssh-agent
+func LoadKeySSH(cipherDir string) ([]byte, error) {
+	ag, err := connectSSHAgent()
+	if err != nil {
+		return nil, err
+	}
+	return keycrypter.LoadKeySSH(filepath.Join(cipherDir, cffuse.SSHKeyFile), ag)
+}
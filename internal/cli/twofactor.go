@@ -0,0 +1,144 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/cffuse"
+	"github.com/declan94/cfcryptfs/corecrypter"
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/declan94/cfcryptfs/keycrypter"
+	"github.com/declan94/cfcryptfs/readpwd"
+)
+
+const twoFactorKeyFileLen = 64
+
+// readTwoFactorKeyFile reads the keyfile of two-factor protection at `p`, one with random content is created if it doesn't exist
+func readTwoFactorKeyFile(p string) ([]byte, error) {
+	content, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		content = corecrypter.RandBytes(twoFactorKeyFileLen)
+		if err = ioutil.WriteFile(p, content, 0400); err == nil {
+			fmt.Printf("Keyfile created: %s\n", p)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Keyfile [%s]: %v", p, err)
+	}
+	if len(content) < keycrypter.MinTwoFactorKeyFileLen {
+		return nil, fmt.Errorf("Keyfile too short, at least %d bytes are needed", keycrypter.MinTwoFactorKeyFileLen)
+	}
+	return content, nil
+}
+
+// askTwoFactorKeyFile asks for the keyfile of two-factor protection, a random one is created if it doesn't exist
+func askTwoFactorKeyFile() []byte {
+	for {
+		var p string
+		fmt.Printf("Path of the keyfile (created with random content if it doesn't exist): ")
+		fmt.Scanln(&p)
+		p = expandPath(strings.Trim(p, " \t"))
+		if p == "" {
+			continue
+		}
+		content, err := readTwoFactorKeyFile(p)
+		if err != nil {
+			tlog.Warn.Println(err)
+			continue
+		}
+		return content
+	}
+}
+
+// SaveKeyTwoFactor ask for password and keyfile, encrypted key using both of them and then save to file.
+// The password must satisfy the password policy of `opts`, the keyfile may be given by option "new_keyfile".
+func SaveKeyTwoFactor(cipherDir string, key []byte, kp keycrypter.KDFParams, opts map[string]string) error {
+	pwd, err := askNewPassword(opts)
+	if err != nil {
+		return err
+	}
+	var keyfile []byte
+	if opts["new_keyfile"] != "" {
+		if keyfile, err = readTwoFactorKeyFile(expandPath(opts["new_keyfile"])); err != nil {
+			return err
+		}
+	} else {
+		if err = needOption(opts, "new_keyfile", "the keyfile"); err != nil {
+			return err
+		}
+		keyfile = askTwoFactorKeyFile()
+	}
+	err = keycrypter.StoreKeyTwoFactor(filepath.Join(cipherDir, cffuse.KeyFile), pwd, keyfile, key, kp)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Both the password and the keyfile are needed to unlock, keep the keyfile apart from the cipher directory.")
+	return nil
+}
+
+// LoadKeyTwoFactor load encryption key of the cipher directory with a password and the keyfile given by `-keys`
+func LoadKeyTwoFactor(cipherDir string, opts map[string]string) ([]byte, error) {
+	if opts["keys"] == "" {
+		return nil, keyErrorf(exitcode.Usage, "This cipher directory is protected by password and keyfile, you should specify the keyfile with `-keys`")
+	}
+	return keycrypter.LoadKeyTwoFactor(filepath.Join(cipherDir, cffuse.KeyFile), opts["passfile"], opts["password"], expandPath(opts["keys"]))
+}
+
+// changeTwoFactor changes the password, the keyfile or both of a two-factor protected key,
+// the key is re-encrypted with kdf parameters kp
+func changeTwoFactor(cipherDir string, kp keycrypter.KDFParams, opts map[string]string) {
+	if opts["keys"] == "" {
+		tlog.Fatal.Println("Specify the current keyfile with `-keys`")
+		os.Exit(exitcode.Usage)
+	}
+	path := filepath.Join(cipherDir, cffuse.KeyFile)
+	ks := readKeySlots(cipherDir)
+	keyfile, err := ioutil.ReadFile(expandPath(opts["keys"]))
+	if err != nil {
+		tlog.Fatal.Printf("Read keyfile failed: %v", err)
+		os.Exit(exitcode.KeyFile)
+	}
+	fmt.Println("Enter your current password")
+	pwd, err := readpwd.Once("")
+	if err != nil {
+		tlog.Fatal.Printf("Read password failed: %v", err)
+		os.Exit(exitcode.KeyFile)
+	}
+	key, id, err := ks.Unlock(keycrypter.SlotTwoFactor, keycrypter.TwoFactorCredential(pwd, keyfile))
+	if err != nil {
+		tlog.Fatal.Printf("Decrypt master key failed: %v", err)
+		os.Exit(exitcode.KeyFile)
+	}
+	var change int
+	for change < 1 || change > 3 {
+		fmt.Printf("Change (1: Password, 2: Keyfile, 3: Both): ")
+		fmt.Scanf("%d\n", &change)
+	}
+	if change != 2 {
+		fmt.Println("Enter your new password")
+		if pwd, err = askNewPassword(opts); err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(keyProviderExit(err))
+		}
+	}
+	if change != 1 {
+		fmt.Println("Choose the new keyfile")
+		keyfile = askTwoFactorKeyFile()
+	}
+	if err = ks.Update(id, keycrypter.TwoFactorCredential(pwd, keyfile), key, kp); err != nil {
+		tlog.Fatal.Printf("Encrypt key failed: %v", err)
+		os.Exit(exitcode.KeyFile)
+	}
+	if err = ks.Write(path); err != nil {
+		tlog.Fatal.Printf("Store new keyfile failed: %v", err)
+		os.Exit(exitcode.KeyFile)
+	}
+	fmt.Printf("\n%s changed: %s\n", map[int]string{1: "Password", 2: "Keyfile", 3: "Password and keyfile"}[change], cipherDir)
+	if change != 1 {
+		fmt.Println("The old keyfile doesn't unlock anymore.")
+	}
+}
@@ -3,29 +3,37 @@ package contcrypter
 import (
 	"log"
 	"sync"
+
+	"github.com/declan94/cfcryptfs/internal/secmem"
 )
 
 // bPool is a byte slice pool
 type bPool struct {
 	sync.Pool
 	sliceLen int
+	// wipe zeroes slices put back, for pools of plaintext
+	wipe bool
 }
 
-func newBPool(sliceLen int) bPool {
+func newBPool(sliceLen int, wipe bool) bPool {
 	return bPool{
 		Pool: sync.Pool{
 			New: func() interface{} { return make([]byte, sliceLen) },
 		},
 		sliceLen: sliceLen,
+		wipe:     wipe,
 	}
 }
 
-// Put grows the slice "s" to its maximum capacity and puts it into the pool.
+// Put grows the slice "s" to its maximum capacity and puts it into the pool, wiped if it is a plaintext pool.
 func (b *bPool) Put(s []byte) {
 	s = s[:cap(s)]
 	if len(s) != b.sliceLen {
 		log.Panicf("wrong len=%d, want=%d", len(s), b.sliceLen)
 	}
+	if b.wipe {
+		secmem.Wipe(s)
+	}
 	b.Pool.Put(s)
 }
 
@@ -44,15 +44,22 @@ func NewContentCrypter(core corecrypter.CoreCrypter, plainBS int) *ContentCrypte
 		plainBS:      plainBS,
 		cipherBS:     cipherBS,
 		allZeroBlock: make([]byte, cipherBS),
-		cBlockPool:   newBPool(cipherBS),
-		PBlockPool:   newBPool(plainBS),
-		CReqPool:     newBPool(cReqSize),
-		PReqPool:     newBPool(fuse.MAX_KERNEL_WRITE),
+		cBlockPool:   newBPool(cipherBS, false),
+		PBlockPool:   newBPool(plainBS, true),
+		CReqPool:     newBPool(cReqSize, false),
+		PReqPool:     newBPool(fuse.MAX_KERNEL_WRITE, true),
 	}
 
 	return cc
 }
 
+// Wipe zeroes the key of the core crypter if it supports it
+func (cc *ContentCrypter) Wipe() {
+	if w, ok := cc.core.(corecrypter.Wiper); ok {
+		w.Wipe()
+	}
+}
+
 func (cc *ContentCrypter) makeSign(data []byte, blockNo uint64, fileID []byte) []byte {
 	key := make([]byte, 8)
 	binary.BigEndian.PutUint64(key, blockNo)
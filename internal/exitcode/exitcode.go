@@ -19,4 +19,10 @@ const (
 	Fuse
 	// ForkChild means failed to fork child process
 	ForkChild
+	// KMS means the remote KMS failed to wrap or unwrap the key
+	KMS
+	// ReadPassword means reading the password from -extpass, -env_file, a credential or pinentry failed
+	ReadPassword
+	// WeakPassword means a new password was rejected by the password policy
+	WeakPassword
 )
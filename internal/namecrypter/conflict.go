@@ -0,0 +1,105 @@
+package namecrypter
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Sync clients rename conflicted files by adding a suffix to the (cipher) name,
+// before the file extension if there is one.
+// 	Syncthing:         NAME.sync-conflict-20060102-150405-DEVICE.ext
+// 	Dropbox/Nextcloud: NAME (xxx conflicted copy xxx).ext
+// 	ownCloud:          NAME_conflict-20060102-150405.ext
+// 	OneDrive:          NAME-COMPUTERNAME.ext
+// The file content is not affected, so the conflicted copy can still be decrypted.
+// Only the default Windows computer names (DESKTOP-XXXXXXX, LAPTOP-XXXXXXX) are recognized for OneDrive,
+// any other would match ordinary names like "2026-01-01.log" or "foo-1.js".
+
+var conflictSuffixes = []*regexp.Regexp{
+	regexp.MustCompile(`^(\.sync-conflict-\d{8}-\d{6}(?:-[A-Z0-9]{7})?)(\.[^.]*)?$`),
+	regexp.MustCompile(`^( \([^()]*conflicted copy[^()]*\))(\.[^.]*)?$`),
+	regexp.MustCompile(`^(_conflict-\d{8}-\d{6})(\.[^.]*)?$`),
+	regexp.MustCompile(`^(-(?:DESKTOP|LAPTOP)-[A-Z0-9]{7})(\.[^.]*)?$`),
+}
+
+// ConflictName is a name split into the original name and the conflict suffix
+type ConflictName struct {
+	// Base is the name without conflict suffix
+	Base string
+	// Suffix is the conflict suffix added by the sync client
+	Suffix string
+}
+
+// ConflictCandidates returns all possible ways to split "name" into
+// an original name and a sync conflict suffix.
+func ConflictCandidates(name string) []ConflictName {
+	var cands []ConflictName
+	for i := 1; i < len(name); i++ {
+		switch name[i] {
+		case '.', ' ', '_', '-':
+		default:
+			continue
+		}
+		for _, re := range conflictSuffixes {
+			m := re.FindStringSubmatchIndex(name[i:])
+			if m == nil {
+				continue
+			}
+			ext := ""
+			if m[4] >= 0 {
+				ext = name[i+m[4] : i+m[5]]
+			}
+			cands = append(cands, ConflictName{
+				Base:   name[:i] + ext,
+				Suffix: name[i+m[2] : i+m[3]],
+			})
+		}
+	}
+	return cands
+}
+
+// HasConflictName checks whether any component of "path" may be a sync conflict name
+func HasConflictName(path string) bool {
+	for _, n := range strings.Split(path, "/") {
+		if len(ConflictCandidates(n)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// JoinConflictName inserts the conflict suffix into name before its extension,
+// the way sync clients do for plaintext files.
+func JoinConflictName(name string, suffix string) string {
+	ext := filepath.Ext(name)
+	if ext == name {
+		// Dot files like .bashrc
+		return name + suffix
+	}
+	return name[:len(name)-len(ext)] + suffix + ext
+}
+
+// DecryptConflictName decrypts a cipher name renamed by a sync client.
+// path is the plaintext path of the parent directory used for the IV,
+// the decrypted name is verified to make sure the suffix is not part of a valid cipher name.
+// Returns the decrypted original name and the conflict suffix.
+func (nc *NameCrypter) DecryptConflictName(path string, name string) (string, string, error) {
+	for _, c := range ConflictCandidates(name) {
+		// Skip what can't be a cipher name, DecryptName would complain
+		if len(c.Base) <= base64.URLEncoding.EncodedLen(md5.Size) {
+			continue
+		}
+		plain, err := nc.DecryptName(c.Base)
+		if err != nil || strings.Contains(plain, "/") {
+			continue
+		}
+		if nc.EncryptName(filepath.Join(path, plain), plain) == c.Base {
+			return plain, c.Suffix, nil
+		}
+	}
+	return "", "", errors.New("not a sync conflict name")
+}
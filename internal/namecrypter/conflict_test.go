@@ -0,0 +1,48 @@
+package namecrypter
+
+import (
+	"testing"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+)
+
+func TestConflictName(t *testing.T) {
+	key, _ := corecrypter.RandomKey(corecrypter.AES256)
+	nc := NewNameCrypter(key)
+	suffixes := []string{
+		".sync-conflict-20260101-123456-ABCDEF7",
+		" (conflicted copy 2026-01-01 123456)",
+		" (Someone's conflicted copy 2026-01-01)",
+		"_conflict-20260101-123456",
+		"-DESKTOP-1A2B3C4",
+	}
+	for _, suffix := range suffixes {
+		cname := nc.EncryptName("dir/report.txt", "report.txt") + suffix
+		base, s, err := nc.DecryptConflictName("dir", cname)
+		if err != nil {
+			t.Errorf("Decrypt conflict name %s failed: %v", cname, err)
+			continue
+		}
+		if base != "report.txt" || s != suffix {
+			t.Errorf("Wrong conflict name: %s, %s", base, s)
+		}
+		presented := JoinConflictName(base, s)
+		found := false
+		for _, c := range ConflictCandidates(presented) {
+			if c.Base == base && c.Suffix == suffix {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Presented name %s not recognized", presented)
+		}
+	}
+	if _, _, err := nc.DecryptConflictName("dir", nc.EncryptName("dir/a-B", "a-B")); err == nil {
+		t.Error("Normal name taken as conflict name")
+	}
+	for _, name := range []string{"2026-01-01.log", "foo-1.js", "v1-2.tar", "README-FINAL.md", "my_conflict.txt"} {
+		if c := ConflictCandidates(name); len(c) > 0 {
+			t.Errorf("Ordinary name %s taken as conflict name: %v", name, c)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"errors"
 
 	"github.com/declan94/cfcryptfs/corecrypter"
+	"github.com/declan94/cfcryptfs/internal/secmem"
 	"github.com/declan94/cfcryptfs/internal/tlog"
 )
 
@@ -23,8 +24,12 @@ type NameCrypter struct {
 
 // NewNameCrypter create a new name crypter
 func NewNameCrypter(key []byte) *NameCrypter {
-	for len(key) < corecrypter.AES256KeySize {
-		key = append(key, key...)
+	if len(key) < corecrypter.AES256KeySize {
+		for len(key) < corecrypter.AES256KeySize {
+			key = append(key, key...)
+		}
+		// The repeated key is a copy
+		secmem.Lock(key)
 	}
 	key = key[:corecrypter.AES256KeySize]
 	return &NameCrypter{
@@ -33,6 +38,12 @@ func NewNameCrypter(key []byte) *NameCrypter {
 	}
 }
 
+// Wipe zeroes the key of the name crypter, it can't be used afterwards
+func (nc *NameCrypter) Wipe() {
+	nc.AesCrypter.Wipe()
+	secmem.Wipe(nc.key)
+}
+
 // EncryptName encrypt the filename
 // 	path is the fullpath of the file relative to the filesystem,
 //	used for determine the initial vector (IV)
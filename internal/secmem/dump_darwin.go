@@ -0,0 +1,10 @@
+// +build darwin
+
+package secmem
+
+import "golang.org/x/sys/unix"
+
+// DisableCoreDumps disables core dumps of the process, darwin has no PR_SET_DUMPABLE
+func DisableCoreDumps() error {
+	return unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{})
+}
@@ -0,0 +1,11 @@
+// +build linux
+
+package secmem
+
+import "golang.org/x/sys/unix"
+
+// DisableCoreDumps makes the process not dumpable: no core dumps,
+// and other processes of the user can't ptrace it or read its memory
+func DisableCoreDumps() error {
+	return unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0)
+}
@@ -0,0 +1,44 @@
+// Package secmem keeps key material and plaintext out of swap and core dumps.
+// Go never moves heap memory, so locking the pages of a heap slice keeps them locked.
+package secmem
+
+import (
+	"sync"
+
+	"github.com/declan94/cfcryptfs/internal/tlog"
+	"golang.org/x/sys/unix"
+)
+
+var lockWarn sync.Once
+
+// Lock locks the pages of "b" into RAM, so they are never written to swap.
+// A failure (e.g. a low "ulimit -l") is only warned about once.
+func Lock(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	if err := unix.Mlock(b); err != nil {
+		lockWarn.Do(func() {
+			tlog.Warn.Printf("Locking key memory failed, it may be swapped out: %v", err)
+		})
+	}
+}
+
+// Unlock unlocks the pages of "b" locked by Lock
+func Unlock(b []byte) {
+	if len(b) != 0 {
+		unix.Munlock(b)
+	}
+}
+
+// Wipe zeroes "b"
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// LockAll locks all current and future memory of the process into RAM
+func LockAll() error {
+	return unix.Mlockall(unix.MCL_CURRENT | unix.MCL_FUTURE)
+}
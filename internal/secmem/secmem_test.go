@@ -0,0 +1,61 @@
+package secmem
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockedKB returns VmLck of the process in kB, -1 if unknown
+func lockedKB() int {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if fields := strings.Fields(s.Text()); len(fields) >= 2 && fields[0] == "VmLck:" {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return -1
+}
+
+func TestLock(t *testing.T) {
+	var lim unix.Rlimit
+	if lockedKB() < 0 || unix.Getrlimit(unix.RLIMIT_MEMLOCK, &lim) != nil || (lim.Cur < 1<<20 && os.Geteuid() != 0) {
+		t.Skip("Can't check locked memory")
+	}
+	// Empty slices are ignored
+	Lock(nil)
+	Unlock(nil)
+	before := lockedKB()
+	b := make([]byte, 256*1024)
+	Lock(b)
+	if got := lockedKB(); got < before+256 {
+		t.Errorf("VmLck %d kB after locking 256 kB, was %d kB", got, before)
+	}
+	Unlock(b)
+	if got := lockedKB(); got != before {
+		t.Errorf("VmLck %d kB after unlocking, want %d kB", got, before)
+	}
+}
+
+func TestWipe(t *testing.T) {
+	b := []byte("secret key material")
+	Wipe(b[:6])
+	if string(b[6:]) != " key material" {
+		t.Errorf("Wiped past the slice: %q", b)
+	}
+	for i, c := range b[:6] {
+		if c != 0 {
+			t.Errorf("Byte %d not wiped: %q", i, b)
+		}
+	}
+}
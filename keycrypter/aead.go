@@ -0,0 +1,82 @@
+package keycrypter
+
+// Authenticated wrapping of keys with AES-256-GCM.
+// | nonce | sealed key with tag |
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// errUnwrap is returned when the wrapped key fails authentication
+var errUnwrap = errors.New("Authentication of the wrapped key failed")
+
+func newGCM(wrapKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealKey wraps key with wrapKey, "aad" is authenticated but not stored
+func sealKey(wrapKey []byte, key []byte, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, key, aad), nil
+}
+
+// openKey unwraps the key sealed by sealKey
+func openKey(wrapKey []byte, sealed []byte, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, errors.New("Wrapped key too short")
+	}
+	key, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+	if err != nil {
+		return nil, errUnwrap
+	}
+	return key, nil
+}
+
+// WrapKey wraps `key` with a key derived from `masterKey` for the purpose `info`,
+// to keep a key next to the data encrypted with the master key
+func WrapKey(masterKey []byte, key []byte, info string) ([]byte, error) {
+	wrapKey, err := deriveWrapKey(masterKey, info)
+	if err != nil {
+		return nil, err
+	}
+	return sealKey(wrapKey, key, []byte(info))
+}
+
+// UnwrapKey unwraps the key wrapped by WrapKey
+func UnwrapKey(masterKey []byte, wrapped []byte, info string) ([]byte, error) {
+	wrapKey, err := deriveWrapKey(masterKey, info)
+	if err != nil {
+		return nil, err
+	}
+	return openKey(wrapKey, wrapped, []byte(info))
+}
+
+func deriveWrapKey(masterKey []byte, info string) ([]byte, error) {
+	wrapKey := make([]byte, wrapKeyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, nil, []byte(info)), wrapKey); err != nil {
+		return nil, err
+	}
+	return wrapKey, nil
+}
@@ -0,0 +1,406 @@
+package keycrypter
+
+// provides encryption in the age v1 format (https://age-encryption.org/v1) to X25519 recipients or
+// with a passphrase, so the output can also be decrypted with the age tool:
+// | age-encryption.org/v1 | -> X25519 or scrypt stanzas | --- header MAC | nonce | STREAM payload |
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	ageIntro          = "age-encryption.org/v1"
+	ageX25519Label    = "age-encryption.org/v1/X25519"
+	ageScryptLabel    = "age-encryption.org/v1/scrypt"
+	ageRecipientHRP   = "age"
+	ageIdentityHRP    = "AGE-SECRET-KEY-"
+	ageFileKeyLen     = 16
+	ageNonceLen       = 16
+	ageChunkSize      = 64 * 1024
+	ageColumns        = 64
+	ageScryptLogN     = 18
+	ageMaxScryptLogN  = 22
+	ageScryptSaltLen  = 16
+	ageX25519Type     = "X25519"
+	ageScryptType     = "scrypt"
+	ageWrappedKeySize = ageFileKeyLen + chacha20poly1305.Overhead
+)
+
+var ageB64 = base64.RawStdEncoding
+
+// ErrAgeNoIdentity is returned when none of the identities can decrypt the age file
+var ErrAgeNoIdentity = errors.New("No identity matched any of the recipients")
+
+type ageStanza struct {
+	typ  string
+	args []string
+	body []byte
+}
+
+// IsAge checks whether data is in the age format
+func IsAge(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageIntro+"\n"))
+}
+
+// GenerateAgeIdentity generates an X25519 identity, returns it and its recipient
+func GenerateAgeIdentity() (string, string, error) {
+	secret := corecrypter.RandBytes(curve25519.ScalarSize)
+	identity, err := bech32Encode(ageIdentityHRP, secret)
+	if err != nil {
+		return "", "", err
+	}
+	recipient, err := AgeRecipientOf(strings.ToUpper(identity))
+	return strings.ToUpper(identity), recipient, err
+}
+
+// AgeRecipientOf returns the recipient of an identity
+func AgeRecipientOf(identity string) (string, error) {
+	secret, err := parseAgeIdentity(identity)
+	if err != nil {
+		return "", err
+	}
+	pub, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return bech32Encode(ageRecipientHRP, pub)
+}
+
+// ParseAgeRecipient parses an "age1..." recipient, returns the X25519 public key
+func ParseAgeRecipient(recipient string) ([]byte, error) {
+	hrp, pub, err := bech32Decode(recipient)
+	if err != nil || hrp != ageRecipientHRP || len(pub) != curve25519.PointSize {
+		return nil, fmt.Errorf("Invalid age recipient: %s", recipient)
+	}
+	return pub, nil
+}
+
+func parseAgeIdentity(identity string) ([]byte, error) {
+	hrp, secret, err := bech32Decode(identity)
+	if err != nil || hrp != strings.ToLower(ageIdentityHRP) || len(secret) != curve25519.ScalarSize {
+		return nil, errors.New("Invalid age identity")
+	}
+	return secret, nil
+}
+
+// ParseAgeIdentities parses the content of an identity file, one "AGE-SECRET-KEY-1..." per line.
+// Empty lines and lines starting with # are ignored.
+func ParseAgeIdentities(data []byte) ([][]byte, error) {
+	var ids [][]byte
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secret, err := parseAgeIdentity(line)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", i+1, err)
+		}
+		ids = append(ids, secret)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("No age identity found")
+	}
+	return ids, nil
+}
+
+func ageHKDF(ikm, salt []byte, info string) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte(info)), key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// ageWrap encrypts the file key with a zero nonce, every wrapping key is used once
+func ageWrap(key, fileKey []byte) []byte {
+	aead, _ := chacha20poly1305.New(key)
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+}
+
+func ageUnwrap(key, body []byte) ([]byte, error) {
+	if len(body) != ageWrappedKeySize {
+		return nil, errors.New("Invalid age stanza body")
+	}
+	aead, _ := chacha20poly1305.New(key)
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), body, nil)
+}
+
+func ageX25519Key(shared, share, pub []byte) []byte {
+	return ageHKDF(shared, append(append([]byte{}, share...), pub...), ageX25519Label)
+}
+
+func ageScryptKey(passphrase string, salt []byte, logN int) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), append([]byte(ageScryptLabel), salt...), 1<<uint(logN), 8, 1, chacha20poly1305.KeySize)
+}
+
+// EncryptAge encrypts data to the "age1..." recipients
+func EncryptAge(data []byte, recipients []string) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("No age recipient")
+	}
+	fileKey := corecrypter.RandBytes(ageFileKeyLen)
+	stanzas := make([]ageStanza, 0, len(recipients))
+	for _, r := range recipients {
+		pub, err := ParseAgeRecipient(r)
+		if err != nil {
+			return nil, err
+		}
+		ephemeral := corecrypter.RandBytes(curve25519.ScalarSize)
+		share, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := curve25519.X25519(ephemeral, pub)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, ageStanza{
+			typ:  ageX25519Type,
+			args: []string{ageB64.EncodeToString(share)},
+			body: ageWrap(ageX25519Key(shared, share, pub), fileKey),
+		})
+	}
+	return ageSeal(data, fileKey, stanzas), nil
+}
+
+// EncryptAgePassphrase encrypts data with a passphrase
+func EncryptAgePassphrase(data []byte, passphrase string) ([]byte, error) {
+	fileKey := corecrypter.RandBytes(ageFileKeyLen)
+	salt := corecrypter.RandBytes(ageScryptSaltLen)
+	key, err := ageScryptKey(passphrase, salt, ageScryptLogN)
+	if err != nil {
+		return nil, err
+	}
+	stanza := ageStanza{
+		typ:  ageScryptType,
+		args: []string{ageB64.EncodeToString(salt), strconv.Itoa(ageScryptLogN)},
+		body: ageWrap(key, fileKey),
+	}
+	return ageSeal(data, fileKey, []ageStanza{stanza}), nil
+}
+
+func ageSeal(data []byte, fileKey []byte, stanzas []ageStanza) []byte {
+	var hdr bytes.Buffer
+	hdr.WriteString(ageIntro + "\n")
+	for _, s := range stanzas {
+		hdr.WriteString("-> " + s.typ + " " + strings.Join(s.args, " ") + "\n")
+		body := ageB64.EncodeToString(s.body)
+		for len(body) >= ageColumns {
+			hdr.WriteString(body[:ageColumns] + "\n")
+			body = body[ageColumns:]
+		}
+		hdr.WriteString(body + "\n")
+	}
+	hdr.WriteString("---")
+	mac := ageHeaderMAC(fileKey, hdr.Bytes())
+	hdr.WriteString(" " + ageB64.EncodeToString(mac) + "\n")
+	nonce := corecrypter.RandBytes(ageNonceLen)
+	hdr.Write(nonce)
+	aead, _ := chacha20poly1305.New(ageHKDF(fileKey, nonce, "payload"))
+	for i := 0; ; i++ {
+		n := len(data)
+		last := n <= ageChunkSize
+		if !last {
+			n = ageChunkSize
+		}
+		hdr.Write(aead.Seal(nil, ageChunkNonce(i, last), data[:n], nil))
+		data = data[n:]
+		if last {
+			break
+		}
+	}
+	return hdr.Bytes()
+}
+
+func ageHeaderMAC(fileKey []byte, header []byte) []byte {
+	h := hmac.New(sha256.New, ageHKDF(fileKey, nil, "header"))
+	h.Write(header)
+	return h.Sum(nil)
+}
+
+func ageChunkNonce(i int, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	for j := 10; j >= 0 && i > 0; j-- {
+		nonce[j] = byte(i)
+		i >>= 8
+	}
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// parseAgeHeader parses the header, returns the stanzas, the header up to "---", the MAC and the payload
+func parseAgeHeader(data []byte) ([]ageStanza, []byte, []byte, []byte, error) {
+	errHeader := errors.New("Invalid age header")
+	if !IsAge(data) {
+		return nil, nil, nil, nil, errors.New("Not in age format")
+	}
+	var stanzas []ageStanza
+	rest := data[len(ageIntro)+1:]
+	readLine := func() (string, bool) {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			return "", false
+		}
+		line := string(rest[:i])
+		rest = rest[i+1:]
+		return line, true
+	}
+	for {
+		pos := len(data) - len(rest)
+		line, ok := readLine()
+		if !ok {
+			return nil, nil, nil, nil, errHeader
+		}
+		if strings.HasPrefix(line, "--- ") {
+			mac, err := ageB64.DecodeString(line[4:])
+			if err != nil {
+				return nil, nil, nil, nil, errHeader
+			}
+			return stanzas, data[:pos+3], mac, rest, nil
+		}
+		if !strings.HasPrefix(line, "-> ") {
+			return nil, nil, nil, nil, errHeader
+		}
+		fields := strings.Split(line[3:], " ")
+		s := ageStanza{typ: fields[0], args: fields[1:]}
+		for {
+			bl, ok := readLine()
+			if !ok {
+				return nil, nil, nil, nil, errHeader
+			}
+			b, err := ageB64.DecodeString(bl)
+			if err != nil {
+				return nil, nil, nil, nil, errHeader
+			}
+			s.body = append(s.body, b...)
+			if len(bl) < ageColumns {
+				break
+			}
+		}
+		stanzas = append(stanzas, s)
+	}
+}
+
+// AgeNeedsPassphrase checks whether the age data is encrypted with a passphrase
+func AgeNeedsPassphrase(data []byte) bool {
+	stanzas, _, _, _, err := parseAgeHeader(data)
+	return err == nil && len(stanzas) == 1 && stanzas[0].typ == ageScryptType
+}
+
+// DecryptAge decrypts age data with the identities, or the passphrase when encrypted with one
+func DecryptAge(data []byte, identities [][]byte, passphrase string) ([]byte, error) {
+	stanzas, header, mac, payload, err := parseAgeHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	var fileKey []byte
+	for _, s := range stanzas {
+		switch s.typ {
+		case ageScryptType:
+			if len(stanzas) != 1 {
+				return nil, errors.New("Invalid age header, scrypt stanza must be alone")
+			}
+			fileKey, err = ageUnwrapScrypt(s, passphrase)
+			if err != nil {
+				return nil, err
+			}
+		case ageX25519Type:
+			fileKey = ageUnwrapX25519(s, identities)
+		}
+		if fileKey != nil {
+			break
+		}
+	}
+	if fileKey == nil {
+		return nil, ErrAgeNoIdentity
+	}
+	if !hmac.Equal(mac, ageHeaderMAC(fileKey, header)) {
+		return nil, errors.New("Age header MAC mismatch")
+	}
+	if len(payload) < ageNonceLen {
+		return nil, errors.New("Age payload too short")
+	}
+	aead, _ := chacha20poly1305.New(ageHKDF(fileKey, payload[:ageNonceLen], "payload"))
+	payload = payload[ageNonceLen:]
+	var plain []byte
+	for i := 0; ; i++ {
+		n := len(payload)
+		last := n <= ageChunkSize+aead.Overhead()
+		if !last {
+			n = ageChunkSize + aead.Overhead()
+		}
+		chunk, err := aead.Open(nil, ageChunkNonce(i, last), payload[:n], nil)
+		if err != nil {
+			return nil, errors.New("Age payload authentication failed")
+		}
+		plain = append(plain, chunk...)
+		payload = payload[n:]
+		if last {
+			return plain, nil
+		}
+	}
+}
+
+func ageUnwrapScrypt(s ageStanza, passphrase string) ([]byte, error) {
+	if len(s.args) != 2 {
+		return nil, errors.New("Invalid age scrypt stanza")
+	}
+	salt, err := ageB64.DecodeString(s.args[0])
+	if err != nil || len(salt) != ageScryptSaltLen {
+		return nil, errors.New("Invalid age scrypt stanza")
+	}
+	logN, err := strconv.Atoi(s.args[1])
+	if err != nil || logN <= 0 || logN > ageMaxScryptLogN {
+		return nil, errors.New("Invalid age scrypt work factor")
+	}
+	key, err := ageScryptKey(passphrase, salt, logN)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := ageUnwrap(key, s.body)
+	if err != nil {
+		return nil, errors.New("Wrong passphrase")
+	}
+	return fileKey, nil
+}
+
+func ageUnwrapX25519(s ageStanza, identities [][]byte) []byte {
+	if len(s.args) != 1 {
+		return nil
+	}
+	share, err := ageB64.DecodeString(s.args[0])
+	if err != nil || len(share) != curve25519.PointSize {
+		return nil
+	}
+	for _, id := range identities {
+		shared, err := curve25519.X25519(id, share)
+		if err != nil {
+			continue
+		}
+		pub, err := curve25519.X25519(id, curve25519.Basepoint)
+		if err != nil {
+			continue
+		}
+		if fileKey, err := ageUnwrap(ageX25519Key(shared, share, pub), s.body); err == nil {
+			return fileKey
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package keycrypter
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+)
+
+func TestAgeRecipientOf(t *testing.T) {
+	// Identity of 32 bytes 0x42 from the age test vectors
+	r, err := AgeRecipientOf("AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX")
+	if err != nil || r != "age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj" {
+		t.Errorf("Wrong recipient %s: %v", r, err)
+	}
+}
+
+func TestAge(t *testing.T) {
+	data := corecrypter.RandBytes(ageChunkSize + 100)
+	id1, r1, err := GenerateAgeIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, r2, _ := GenerateAgeIdentity()
+	id3, _, _ := GenerateAgeIdentity()
+	enc, err := EncryptAge(data, []string{r1, r2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsAge(enc) || AgeNeedsPassphrase(enc) {
+		t.Error("Wrong age format detected")
+	}
+	ids, err := ParseAgeIdentities([]byte("# comment\n" + id3 + "\n" + id2 + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := DecryptAge(enc, ids, ""); err != nil || !bytes.Equal(dec, data) {
+		t.Errorf("Decrypt with identity failed: %v", err)
+	}
+	ids, _ = ParseAgeIdentities([]byte(id3))
+	if _, err := DecryptAge(enc, ids, ""); err != ErrAgeNoIdentity {
+		t.Errorf("Decrypted with wrong identity: %v", err)
+	}
+	ids, _ = ParseAgeIdentities([]byte(id1))
+	enc[len(enc)-1] ^= 1
+	if _, err := DecryptAge(enc, ids, ""); err == nil {
+		t.Error("Decrypted tampered payload")
+	}
+
+	enc, err = EncryptAgePassphrase(data[:32], "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !AgeNeedsPassphrase(enc) {
+		t.Error("Passphrase not detected")
+	}
+	if dec, err := DecryptAge(enc, nil, "passphrase"); err != nil || !bytes.Equal(dec, data[:32]) {
+		t.Errorf("Decrypt with passphrase failed: %v", err)
+	}
+	if _, err := DecryptAge(enc, nil, "wrong"); err == nil {
+		t.Error("Decrypted with wrong passphrase")
+	}
+}
+
+func TestAgeKeyFile(t *testing.T) {
+	key := corecrypter.RandBytes(32)
+	id1, r1, _ := GenerateAgeIdentity()
+	id2, r2, _ := GenerateAgeIdentity()
+	path := filepath.Join(t.TempDir(), "key")
+	if err := StoreKeyAge(path, key, []string{r1}); err != nil {
+		t.Fatal(err)
+	}
+	kf, err := ReadAgeKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = kf.Add(r2); err != nil {
+		t.Fatal(err)
+	}
+	if err = kf.Remove(r1); err != nil {
+		t.Fatal(err)
+	}
+	if err = kf.Remove(r2); err == nil {
+		t.Error("Removed the last recipient")
+	}
+	if err = kf.Seal(key); err != nil {
+		t.Fatal(err)
+	}
+	if err = kf.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	ids, _ := ParseAgeIdentities([]byte(id2))
+	if k, err := LoadKeyAge(path, ids); err != nil || !bytes.Equal(k, key) {
+		t.Errorf("Load key failed: %v", err)
+	}
+	ids, _ = ParseAgeIdentities([]byte(id1))
+	if _, err := LoadKeyAge(path, ids); err == nil {
+		t.Error("Removed recipient unlocked the key")
+	}
+}
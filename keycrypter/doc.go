@@ -3,6 +3,8 @@ Package keycrypter provides two ways to safely store secret encryption keys.
 
 1) Password protection.
 - Ask user for password and encrypt the key using the password before storing.
+The password key is derived with Argon2id (or scrypt for older key files), the kdf and its parameters are recorded in the key file.
+A key file holds several key slots, each wrapping the same key with its own password or keyfile, so credentials can be added and revoked independently.
 
 2) Shamir's Secret Sharing.
 - Use Shamir's Secret Sharing algorithm to split the key into several parts and store in different places(media).
@@ -0,0 +1,187 @@
+package keycrypter
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// maxKDFMemory is the most memory in KiB the kdf may use
+	maxKDFMemory = 4 * 1024 * 1024
+	// maxKDFPasses is the most Argon2id passes and scrypt parallelization
+	maxKDFPasses = 64
+)
+
+// KDFParams are the kdf and its cost parameters for deriving the password key
+type KDFParams struct {
+	KDF int
+	// scrypt
+	N int
+	R int
+	P int
+	// Argon2id, Memory in KiB
+	Time    int
+	Memory  int
+	Threads int
+}
+
+// DefaultKDFParams returns the default cost parameters of kdf
+func DefaultKDFParams(kdf int) KDFParams {
+	switch kdf {
+	case KDFScrypt:
+		return KDFParams{KDF: kdf, N: 16384, R: 8, P: 1}
+	default:
+		return KDFParams{KDF: kdf, Time: 3, Memory: 64 * 1024, Threads: 4}
+	}
+}
+
+// ParseKDF parses the kdf name (scrypt/argon2id)
+func ParseKDF(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "scrypt":
+		return KDFScrypt, nil
+	case "argon2id":
+		return KDFArgon2id, nil
+	default:
+		return 0, fmt.Errorf("Unknown kdf: %s (scrypt/argon2id)", name)
+	}
+}
+
+// Validate checks the cost parameters. They are bounded, so parameters read from
+// a tampered key file can't exhaust the memory or keep the cpu busy before the password is checked.
+func (kp KDFParams) Validate() error {
+	switch kp.KDF {
+	case KDFScrypt:
+		if kp.N <= 1 || kp.N&(kp.N-1) != 0 {
+			return errors.New("scrypt N must be a power of 2 greater than 1")
+		}
+		if kp.R <= 0 || kp.P <= 0 || uint64(kp.R)*uint64(kp.P) >= 1<<30 {
+			return errors.New("scrypt r and p must be positive and r*p < 2^30")
+		}
+		// scrypt uses 128*r*N bytes
+		if uint64(kp.R)*uint64(kp.N)/8 > maxKDFMemory {
+			return fmt.Errorf("scrypt r*N must be at most %d", maxKDFMemory*8)
+		}
+		if kp.P > maxKDFPasses {
+			return fmt.Errorf("scrypt p must be at most %d", maxKDFPasses)
+		}
+	case KDFArgon2id:
+		if kp.Time < 1 || kp.Time > maxKDFPasses {
+			return fmt.Errorf("Argon2id time must be 1~%d", maxKDFPasses)
+		}
+		if kp.Threads < 1 || kp.Threads > 255 {
+			return errors.New("Argon2id threads must be 1~255")
+		}
+		if kp.Memory < 8*kp.Threads {
+			return errors.New("Argon2id memory must be at least 8KiB per thread")
+		}
+		if kp.Memory > maxKDFMemory {
+			return fmt.Errorf("Argon2id memory must be at most %dKiB", maxKDFMemory)
+		}
+	default:
+		return fmt.Errorf("Unknown kdf: %d", kp.KDF)
+	}
+	return nil
+}
+
+func (kp KDFParams) String() string {
+	return encryptParam{kdf: kp.KDF, N: kp.N, r: kp.R, p: kp.P, time: kp.Time, memory: kp.Memory, threads: kp.Threads}.String()
+}
+
+// newParam creates the encryption param with a random salt
+func (kp KDFParams) newParam() (encryptParam, error) {
+	if err := kp.Validate(); err != nil {
+		return encryptParam{}, err
+	}
+	p := encryptParam{
+		salt:    make([]byte, saltLen),
+		kdf:     kp.KDF,
+		wrap:    wrapAEAD,
+		N:       kp.N,
+		r:       kp.R,
+		p:       kp.P,
+		time:    kp.Time,
+		memory:  kp.Memory,
+		threads: kp.Threads,
+		keyLen:  32,
+	}
+	if _, err := io.ReadFull(rand.Reader, p.salt); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// BenchmarkKDF measures the time of deriving one key with kp on this machine
+func BenchmarkKDF(kp KDFParams) (time.Duration, error) {
+	p, err := kp.newParam()
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err = deriveKey("cfcryptfs-calibrate", p); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Calibrate benchmarks this machine and proposes cost parameters of kdf for unlocking in about
+// "target" time, using at most maxMemory KiB. Returns the parameters and the estimated unlock time.
+func Calibrate(kdf int, target time.Duration, maxMemory int) (KDFParams, time.Duration, error) {
+	kp := DefaultKDFParams(kdf)
+	if maxMemory > maxKDFMemory {
+		maxMemory = maxKDFMemory
+	}
+	switch kdf {
+	case KDFScrypt:
+		// Memory used by scrypt is 128 * r * N bytes
+		for kp.N > 1<<10 && 128*kp.R*kp.N/1024 > maxMemory {
+			kp.N /= 2
+		}
+		d, err := BenchmarkKDF(kp)
+		if err != nil {
+			return kp, 0, err
+		}
+		// Time is linear in N
+		for d*2 <= target && 128*kp.R*kp.N*2/1024 <= maxMemory && kp.N < 1<<30 {
+			kp.N *= 2
+			d *= 2
+		}
+		for d > target && kp.N > 1<<10 {
+			kp.N /= 2
+			d /= 2
+		}
+		return kp, d, nil
+	case KDFArgon2id:
+		kp.Threads = runtime.NumCPU()
+		if kp.Threads > 4 {
+			kp.Threads = 4
+		}
+		kp.Time = 1
+		kp.Memory = maxMemory
+		for {
+			d, err := BenchmarkKDF(kp)
+			if err != nil {
+				return kp, 0, err
+			}
+			// Reduce memory until one pass fits the target, then add passes
+			if d > target && kp.Memory/2 >= 8*1024 {
+				kp.Memory /= 2
+				continue
+			}
+			if d > 0 && int(target/d) > 1 {
+				kp.Time = int(target / d)
+			}
+			if kp.Time > maxKDFPasses {
+				kp.Time = maxKDFPasses
+			}
+			return kp, d * time.Duration(kp.Time), nil
+		}
+	default:
+		return kp, 0, fmt.Errorf("Unknown kdf: %d", kdf)
+	}
+}
@@ -0,0 +1,21 @@
+package keycrypter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalibrate(t *testing.T) {
+	for _, kdf := range []int{KDFScrypt, KDFArgon2id} {
+		kp, d, err := Calibrate(kdf, 50*time.Millisecond, 16*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kp.Validate(); err != nil {
+			t.Errorf("Invalid calibrated params %s: %v", kp, err)
+		}
+		if d <= 0 {
+			t.Errorf("Wrong estimated time: %v", d)
+		}
+	}
+}
@@ -3,17 +3,20 @@ package keycrypter
 import (
 	"bytes"
 	"crypto/md5"
-	"crypto/rand"
 	"encoding/binary"
 	"errors"
-	"io"
+	"fmt"
 
 	"github.com/declan94/cfcryptfs/corecrypter"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/scrypt"
 )
 
 // provides safe ways to store encryption key in file with password
-// | encrypt param serialize | plain key md5 | encrypted key |
+// | encrypt param serialize | nonce | AES-GCM sealed key |
+// The param block is authenticated as additional data. Keys encrypted before AEAD wrapping are
+// | encrypt param serialize | plain key md5 | AES encrypted key |
+// which are still decrypted, and replaced the next time they are written.
 
 const (
 	saltLen  = 32
@@ -21,52 +24,105 @@ const (
 	hashLen  = md5.Size
 )
 
+const (
+	// KDFScrypt derives the password key with scrypt
+	KDFScrypt = 0
+	// KDFArgon2id derives the password key with Argon2id
+	KDFArgon2id = 1
+)
+
+const (
+	wrapLegacy = 0
+	wrapAEAD   = 1
+)
+
+// DefaultKDF is used for newly encrypted keys
+var DefaultKDF = KDFArgon2id
+
+// encryptParam is serialized as | salt | N or time | r or memory | p or threads | kdf (byte) wrap (byte) keyLen (2 bytes) |
+// Key files written before Argon2id have a zero kdf byte, which is scrypt, and a zero wrap byte.
 type encryptParam struct {
-	salt   []byte
-	N      int
-	r      int
-	p      int
-	keyLen int
-}
+	salt []byte
+	kdf  int
+	wrap int
+	// scrypt
+	N int
+	r int
+	p int
+	// Argon2id, memory in KiB
+	time    int
+	memory  int
+	threads int
 
-var param = encryptParam{
-	salt:   make([]byte, saltLen),
-	N:      16384,
-	r:      8,
-	p:      1,
-	keyLen: 32,
+	keyLen int
 }
 
 func serializeParam(dest []byte, p encryptParam) {
 	copy(dest, p.salt)
-	binary.BigEndian.PutUint32(dest[saltLen:], uint32(p.N))
-	binary.BigEndian.PutUint32(dest[saltLen+4:], uint32(p.r))
-	binary.BigEndian.PutUint32(dest[saltLen+8:], uint32(p.p))
-	binary.BigEndian.PutUint32(dest[saltLen+12:], uint32(p.keyLen))
+	a, b, c := p.N, p.r, p.p
+	if p.kdf == KDFArgon2id {
+		a, b, c = p.time, p.memory, p.threads
+	}
+	binary.BigEndian.PutUint32(dest[saltLen:], uint32(a))
+	binary.BigEndian.PutUint32(dest[saltLen+4:], uint32(b))
+	binary.BigEndian.PutUint32(dest[saltLen+8:], uint32(c))
+	binary.BigEndian.PutUint32(dest[saltLen+12:], uint32(p.kdf)<<24|uint32(p.wrap)<<16|uint32(p.keyLen))
 }
 
 func parseParam(src []byte) (p encryptParam) {
 	p.salt = src[:saltLen]
-	p.N = int(binary.BigEndian.Uint32(src[saltLen : saltLen+4]))
-	p.r = int(binary.BigEndian.Uint32(src[saltLen+4 : saltLen+8]))
-	p.p = int(binary.BigEndian.Uint32(src[saltLen+8 : saltLen+12]))
-	p.keyLen = int(binary.BigEndian.Uint32(src[saltLen+12:]))
+	a := int(binary.BigEndian.Uint32(src[saltLen : saltLen+4]))
+	b := int(binary.BigEndian.Uint32(src[saltLen+4 : saltLen+8]))
+	c := int(binary.BigEndian.Uint32(src[saltLen+8 : saltLen+12]))
+	last := binary.BigEndian.Uint32(src[saltLen+12:])
+	p.kdf = int(last >> 24)
+	p.wrap = int(last >> 16 & 0xff)
+	p.keyLen = int(last & 0xffff)
+	if p.kdf == KDFArgon2id {
+		p.time, p.memory, p.threads = a, b, c
+	} else {
+		p.N, p.r, p.p = a, b, c
+	}
 	return
 }
 
-func encryptKey(key []byte, password string, p encryptParam) ([]byte, error) {
-	pwdKey, err := scrypt.Key([]byte(password), p.salt, p.N, p.r, p.p, p.keyLen)
-	if err != nil {
-		return nil, err
+func (p encryptParam) String() string {
+	switch p.kdf {
+	case KDFScrypt:
+		return fmt.Sprintf("scrypt (N=%d, r=%d, p=%d)", p.N, p.r, p.p)
+	case KDFArgon2id:
+		return fmt.Sprintf("Argon2id (time=%d, memory=%dKiB, threads=%d)", p.time, p.memory, p.threads)
+	default:
+		return fmt.Sprintf("Unknown kdf %d", p.kdf)
+	}
+}
+
+// kdfParams returns the kdf and cost parameters of p
+func (p encryptParam) kdfParams() KDFParams {
+	return KDFParams{KDF: p.kdf, N: p.N, R: p.r, P: p.p, Time: p.time, Memory: p.memory, Threads: p.threads}
+}
+
+// deriveKey derives the key for encrypting the master key from password
+func deriveKey(password string, p encryptParam) ([]byte, error) {
+	if err := p.kdfParams().Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid kdf parameters: %v", err)
+	}
+	if p.keyLen != 32 {
+		return nil, fmt.Errorf("Invalid key length: %d", p.keyLen)
+	}
+	switch p.kdf {
+	case KDFScrypt:
+		return scrypt.Key([]byte(password), p.salt, p.N, p.r, p.p, p.keyLen)
+	case KDFArgon2id:
+		return argon2.IDKey([]byte(password), p.salt, uint32(p.time), uint32(p.memory), uint8(p.threads), uint32(p.keyLen)), nil
+	default:
+		return nil, fmt.Errorf("Unknown kdf: %d", p.kdf)
 	}
-	crypter := corecrypter.NewAesCrypter(pwdKey)
-	dest := make([]byte, crypter.EncryptedLen(len(key)))
-	crypter.Encrypt(dest, key)
-	return dest, nil
 }
 
-func decryptKey(encKey []byte, password string, p encryptParam) ([]byte, error) {
-	pwdKey, err := scrypt.Key([]byte(password), p.salt, p.N, p.r, p.p, p.keyLen)
+// decryptKeyLegacy decrypts keys encrypted before AEAD wrapping
+func decryptKeyLegacy(encKey []byte, password string, p encryptParam) ([]byte, error) {
+	pwdKey, err := deriveKey(password, p)
 	if err != nil {
 		return nil, err
 	}
@@ -79,21 +135,33 @@ func decryptKey(encKey []byte, password string, p encryptParam) ([]byte, error)
 	return dest, nil
 }
 
-// EncryptKey encrypt the key using password
+// EncryptKey encrypt the key using password, the password key is derived with DefaultKDF
 func EncryptKey(key []byte, password string) ([]byte, error) {
-	if _, err := io.ReadFull(rand.Reader, param.salt); err != nil {
+	return EncryptKeyKDF(key, password, DefaultKDF)
+}
+
+// EncryptKeyKDF encrypt the key using password, the password key is derived with kdf and its default parameters
+func EncryptKeyKDF(key []byte, password string, kdf int) ([]byte, error) {
+	return EncryptKeyParams(key, password, DefaultKDFParams(kdf))
+}
+
+// EncryptKeyParams encrypt the key using password, the password key is derived with kdf parameters kp
+func EncryptKeyParams(key []byte, password string, kp KDFParams) ([]byte, error) {
+	param, err := kp.newParam()
+	if err != nil {
 		return nil, err
 	}
-	encKey, err := encryptKey(key, password, param)
+	pwdKey, err := deriveKey(password, param)
 	if err != nil {
 		return nil, err
 	}
-	final := make([]byte, paramLen+hashLen+len(encKey))
-	serializeParam(final[:paramLen], param)
-	hash := md5.Sum(key)
-	copy(final[paramLen:paramLen+hashLen], hash[:])
-	copy(final[paramLen+hashLen:], encKey)
-	return final, nil
+	header := make([]byte, paramLen)
+	serializeParam(header, param)
+	sealed, err := sealKey(pwdKey, key, header)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, sealed...), nil
 }
 
 // DecrytKey decrypt the key using password. Return error when the password is wrong.
@@ -102,8 +170,19 @@ func DecrytKey(cipherKey []byte, password string) ([]byte, error) {
 		return nil, errors.New("Encrypted key too short")
 	}
 	p := parseParam(cipherKey[:paramLen])
+	if p.wrap == wrapAEAD {
+		pwdKey, err := deriveKey(password, p)
+		if err != nil {
+			return nil, err
+		}
+		key, err := openKey(pwdKey, cipherKey[paramLen:], cipherKey[:paramLen])
+		if err != nil {
+			return nil, errors.New("Wrong password")
+		}
+		return key, nil
+	}
 	hash := cipherKey[paramLen : paramLen+hashLen]
-	key, err := decryptKey(cipherKey[paramLen+hashLen:], password, p)
+	key, err := decryptKeyLegacy(cipherKey[paramLen+hashLen:], password, p)
 	if err != nil {
 		return nil, err
 	}
@@ -113,3 +192,29 @@ func DecrytKey(cipherKey []byte, password string) ([]byte, error) {
 	}
 	return key, nil
 }
+
+// IsLegacyWrapped checks whether the encrypted key is wrapped without AEAD
+func IsLegacyWrapped(cipherKey []byte) bool {
+	return len(cipherKey) >= paramLen && parseParam(cipherKey[:paramLen]).wrap == wrapLegacy
+}
+
+// paramsOf returns the kdf parameters of the encrypted key
+func paramsOf(cipherKey []byte) KDFParams {
+	return parseParam(cipherKey[:paramLen]).kdfParams()
+}
+
+// KDFOf returns the kdf used by the encrypted key
+func KDFOf(cipherKey []byte) (int, error) {
+	if len(cipherKey) < paramLen {
+		return 0, errors.New("Encrypted key too short")
+	}
+	return parseParam(cipherKey[:paramLen]).kdf, nil
+}
+
+// DescribeKDF describes the kdf and its parameters used by the encrypted key
+func DescribeKDF(cipherKey []byte) string {
+	if len(cipherKey) < paramLen {
+		return "Unknown"
+	}
+	return parseParam(cipherKey[:paramLen]).String()
+}
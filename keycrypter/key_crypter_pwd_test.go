@@ -0,0 +1,79 @@
+package keycrypter
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+)
+
+// encryptKeyLegacy encrypts the key like key files before AEAD wrapping
+func encryptKeyLegacy(key []byte, password string) []byte {
+	kp := DefaultKDFParams(KDFScrypt)
+	p, _ := kp.newParam()
+	p.wrap = wrapLegacy
+	pwdKey, _ := deriveKey(password, p)
+	crypter := corecrypter.NewAesCrypter(pwdKey)
+	encKey := make([]byte, crypter.EncryptedLen(len(key)))
+	crypter.Encrypt(encKey, key)
+	final := make([]byte, paramLen, paramLen+hashLen+len(encKey))
+	serializeParam(final, p)
+	hash := md5.Sum(key)
+	return append(append(final, hash[:]...), encKey...)
+}
+
+func TestEncryptKeyKDF(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, kdf := range []int{KDFScrypt, KDFArgon2id} {
+		cipherKey, err := EncryptKeyKDF(key, "password", kdf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k, _ := KDFOf(cipherKey); k != kdf {
+			t.Errorf("Wrong kdf recorded: %d != %d", k, kdf)
+		}
+		key2, err := DecrytKey(cipherKey, "password")
+		if err != nil || !bytes.Equal(key, key2) {
+			t.Errorf("Decrypt key with kdf %d failed: %v", kdf, err)
+		}
+		if _, err := DecrytKey(cipherKey, "wrong"); err == nil {
+			t.Errorf("Decrypted key with wrong password, kdf %d", kdf)
+		}
+	}
+}
+
+func TestTamperedKDFParams(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, c := range []struct {
+		kdf   int
+		off   int
+		value uint32
+	}{
+		{KDFArgon2id, saltLen, 1 << 30},     // time
+		{KDFArgon2id, saltLen + 4, 1 << 31}, // memory
+		{KDFScrypt, saltLen, 1 << 31},       // N
+		{KDFScrypt, saltLen + 8, 1 << 20},   // p
+		{KDFScrypt, saltLen + 12, 0xffff},   // kdf, wrap and key length
+	} {
+		cipherKey, err := EncryptKeyKDF(key, "password", c.kdf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary.BigEndian.PutUint32(cipherKey[c.off:], c.value)
+		if _, err := DecrytKey(cipherKey, "password"); err == nil {
+			t.Errorf("Decrypted key with tampered kdf %d param at %d", c.kdf, c.off)
+		}
+	}
+}
+
+func TestParseOldParam(t *testing.T) {
+	// Key files before Argon2id: | salt | N | r | p | keyLen |
+	src := make([]byte, paramLen)
+	copy(src[saltLen:], []byte{0, 0, 0x40, 0, 0, 0, 0, 8, 0, 0, 0, 1, 0, 0, 0, 32})
+	p := parseParam(src)
+	if p.kdf != KDFScrypt || p.N != 16384 || p.r != 8 || p.p != 1 || p.keyLen != 32 {
+		t.Errorf("Wrong old param: %v", p)
+	}
+}
@@ -1,48 +1,285 @@
 package keycrypter
 
 import (
-	"crypto/md5"
-
 	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
 
 	"github.com/codahale/sss"
+	"github.com/declan94/cfcryptfs/corecrypter"
 )
 
 // provides safe ways to store key in files with Shamir's Secret Sharing scheme
+//
+// A random wrapping key is split, every share also carries the master key sealed with it:
+// | magic | version | vault id (16 bytes) | n | k | share index | split epoch (4 bytes) | share len (2 bytes) |
+// | share | nonce | AES-GCM sealed key | crc32 of all above |
+// The header except share index and share len is authenticated with the sealed key. Resharing
+// increases the split epoch so shares of an old split are rejected.
+// The version is increased whenever the layout changes.
+// Shares created before AEAD wrapping are | share of key and its md5 | share index |
+
+const (
+	shareMagic     = "CFSS"
+	shareVersion   = 1
+	shareHdrLen    = len(shareMagic) + 1 + VaultIDLen + 9
+	shareChecksLen = crc32.Size
+	wrapKeyLen     = 32
+	// VaultIDLen is the length of a vault ID
+	VaultIDLen = 16
+)
+
+var errShareCheck = errors.New("Decrypted key check failed! Keyfile broken or not sufficent count of keys")
+
+// ErrShareEpoch is returned when key shares are not from the current split
+var ErrShareEpoch = errors.New("Key shares are from an old split of the key")
+
+// Split describes how a key is split into shares
+type Split struct {
+	// VaultID identifies the cipher directory, nil when unknown
+	VaultID []byte
+	// N - count of shares, K - threshold count to reconstruct the key, 0 when unknown
+	N, K  byte
+	Epoch uint32
+}
+
+// ShareInfo is the header of a key share
+type ShareInfo struct {
+	Split
+	// Version is 0 for shares created before AEAD wrapping
+	Version int
+	Index   byte
+}
+
+// NewVaultID generates a random vault ID in UUID format
+func NewVaultID() string {
+	b := corecrypter.RandBytes(VaultIDLen)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatVaultID(b)
+}
+
+// ParseVaultID parses a vault ID in UUID format
+func ParseVaultID(id string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.Replace(id, "-", "", -1))
+	if err != nil || len(b) != VaultIDLen {
+		return nil, fmt.Errorf("Invalid vault ID: %s", id)
+	}
+	return b, nil
+}
+
+func formatVaultID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (s *ShareInfo) String() string {
+	if s.Version == 0 {
+		return fmt.Sprintf("share #%d (legacy format)", s.Index)
+	}
+	return fmt.Sprintf("share #%d of %d (threshold %d), split %d, vault %s", s.Index, s.N, s.K, s.Epoch, formatVaultID(s.VaultID))
+}
+
+// aad returns the authenticated header of shares of this split
+func (s *ShareInfo) aad() []byte {
+	aad := make([]byte, 0, shareHdrLen)
+	aad = append(aad, shareMagic...)
+	aad = append(aad, byte(s.Version))
+	aad = append(aad, s.VaultID...)
+	aad = append(aad, s.N, s.K, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(aad[len(aad)-4:], s.Epoch)
+	return aad
+}
 
 // EncryptKeySSS encrypt key using Shamir's Secret Sharing scheme.
 // N is numbers of sharing parts to be created and k is the number threshold of parts for reconstructing key
 func EncryptKeySSS(key []byte, n, k byte) ([][]byte, error) {
-	hash := md5.Sum(key)
-	hashedKey := append(key, hash[:]...)
-	splits, err := sss.Split(n, k, hashedKey)
+	return EncryptKeySSSSplit(key, Split{N: n, K: k})
+}
+
+// EncryptKeySSSSplit works like EncryptKeySSS, the shares are created as described by `split`.
+// A nil vault ID is stored as zeros.
+func EncryptKeySSSSplit(key []byte, split Split) ([][]byte, error) {
+	if split.VaultID == nil {
+		split.VaultID = make([]byte, VaultIDLen)
+	}
+	if len(split.VaultID) != VaultIDLen {
+		return nil, errors.New("Invalid vault ID")
+	}
+	info := ShareInfo{Split: split, Version: shareVersion}
+	wrapKey := corecrypter.RandBytes(wrapKeyLen)
+	sealed, err := sealKey(wrapKey, key, info.aad())
+	if err != nil {
+		return nil, err
+	}
+	splits, err := sss.Split(split.N, split.K, wrapKey)
 	if err != nil {
 		return nil, err
 	}
-	results := make([][]byte, n)
-	i := 0
+	results := make([][]byte, 0, split.N)
 	for id, share := range splits {
-		results[i] = append(share, id)
-		i++
+		s := make([]byte, 0, shareHdrLen+len(share)+len(sealed)+shareChecksLen)
+		s = append(s, shareMagic...)
+		s = append(s, shareVersion)
+		s = append(s, split.VaultID...)
+		s = append(s, split.N, split.K, id, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(s[shareHdrLen-6:], split.Epoch)
+		binary.BigEndian.PutUint16(s[shareHdrLen-2:], uint16(len(share)))
+		s = append(s, share...)
+		s = append(s, sealed...)
+		s = append(s, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(s[len(s)-shareChecksLen:], crc32.ChecksumIEEE(s[:len(s)-shareChecksLen]))
+		results = append(results, s)
 	}
 	return results, nil
 }
 
+// keyShare is a parsed share
+type keyShare struct {
+	ShareInfo
+	share  []byte
+	sealed []byte
+}
+
+func isLegacyShare(s []byte) bool {
+	return len(s) <= len(shareMagic) || string(s[:len(shareMagic)]) != shareMagic
+}
+
+func parseShare(s []byte) (*keyShare, error) {
+	if isLegacyShare(s) {
+		if len(s) < 1 {
+			return nil, errors.New("Empty key share")
+		}
+		return &keyShare{ShareInfo: ShareInfo{Index: s[len(s)-1]}, share: s[:len(s)-1]}, nil
+	}
+	ks := &keyShare{}
+	ks.Version = int(s[len(shareMagic)])
+	if ks.Version != shareVersion {
+		return nil, fmt.Errorf("Unsupported key share version %d, created by a newer cfcryptfs?", ks.Version)
+	}
+	if len(s) < shareHdrLen+shareChecksLen {
+		return nil, errors.New("Key share too short")
+	}
+	body := s[:len(s)-shareChecksLen]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(s[len(body):]) {
+		return nil, errors.New("Key share corrupted, checksum mismatch")
+	}
+	s = body
+	p := len(shareMagic) + 1
+	ks.VaultID = s[p : p+VaultIDLen]
+	p += VaultIDLen
+	ks.N, ks.K, ks.Index = s[p], s[p+1], s[p+2]
+	ks.Epoch = binary.BigEndian.Uint32(s[shareHdrLen-6:])
+	l := int(binary.BigEndian.Uint16(s[shareHdrLen-2:]))
+	if len(s) < shareHdrLen+l {
+		return nil, errors.New("Key share too short")
+	}
+	ks.share = s[shareHdrLen : shareHdrLen+l]
+	ks.sealed = s[shareHdrLen+l:]
+	return ks, nil
+}
+
+// ParseShareInfo parses the header of a key share
+func ParseShareInfo(s []byte) (*ShareInfo, error) {
+	ks, err := parseShare(s)
+	if err != nil {
+		return nil, err
+	}
+	return &ks.ShareInfo, nil
+}
+
+// checkShares checks that the shares are from the same split and enough for reconstructing the key.
+// `names` names the shares in errors.
+func checkShares(shares []*keyShare, names []string) error {
+	first := shares[0]
+	seen := make(map[byte]int)
+	for i, s := range shares {
+		if j, ok := seen[s.Index]; ok {
+			return fmt.Errorf("[%s] is the same share #%d as [%s]", names[i], s.Index, names[j])
+		}
+		seen[s.Index] = i
+		if (s.Version == 0) != (first.Version == 0) {
+			return fmt.Errorf("[%s] and [%s] are from different splits of the key", names[i], names[0])
+		}
+		if s.VaultID != nil && first.VaultID != nil && !bytes.Equal(s.VaultID, first.VaultID) {
+			return fmt.Errorf("[%s] belongs to vault %s, [%s] to vault %s",
+				names[i], formatVaultID(s.VaultID), names[0], formatVaultID(first.VaultID))
+		}
+		if s.Epoch != first.Epoch || s.N != first.N || s.K != first.K {
+			return fmt.Errorf("[%s] and [%s] are from different splits of the key", names[i], names[0])
+		}
+	}
+	if first.K != 0 && len(shares) < int(first.K) {
+		return fmt.Errorf("%d of %d keyfiles are needed, only %d given", first.K, first.N, len(shares))
+	}
+	return nil
+}
+
 // DecryptKeySSS decrypt key using Shamir's Secret Sharing scheme.
 // Return error when the given sharing parts are broken or not enough.
 func DecryptKeySSS(shares [][]byte) ([]byte, error) {
+	key, _, err := DecryptKeySSSSplit(shares)
+	return key, err
+}
+
+// DecryptKeySSSSplit works like DecryptKeySSS, returns the split of the shares as well.
+// Shares from different splits are rejected.
+func DecryptKeySSSSplit(shares [][]byte) ([]byte, *Split, error) {
+	names := make([]string, len(shares))
+	for i := range shares {
+		names[i] = fmt.Sprintf("share %d", i+1)
+	}
+	return decryptKeySSS(shares, names)
+}
+
+func decryptKeySSS(shares [][]byte, names []string) ([]byte, *Split, error) {
+	if len(shares) == 0 {
+		return nil, nil, errShareCheck
+	}
+	parsed := make([]*keyShare, len(shares))
+	for i, share := range shares {
+		ks, err := parseShare(share)
+		if err != nil {
+			return nil, nil, fmt.Errorf("[%s]: %v", names[i], err)
+		}
+		parsed[i] = ks
+	}
+	if err := checkShares(parsed, names); err != nil {
+		return nil, nil, err
+	}
 	shareMap := make(map[byte][]byte)
-	for _, share := range shares {
-		id := share[len(share)-1]
-		shareMap[id] = share[:len(share)-1]
+	for _, ks := range parsed {
+		shareMap[ks.Index] = ks.share
+	}
+	first := parsed[0]
+	if first.Version == 0 {
+		key, err := decryptKeySSSLegacy(shareMap)
+		return key, &Split{}, err
+	}
+	wrapKey := sss.Combine(shareMap)
+	key, err := openKey(wrapKey, first.sealed, first.aad())
+	if err != nil {
+		return nil, nil, errShareCheck
 	}
+	split := first.Split
+	return key, &split, nil
+}
+
+// decryptKeySSSLegacy decrypt key from shares created before AEAD wrapping
+func decryptKeySSSLegacy(shareMap map[byte][]byte) ([]byte, error) {
 	hashedKey := sss.Combine(shareMap)
+	if len(hashedKey) < md5.Size {
+		return nil, errShareCheck
+	}
 	hash := hashedKey[len(hashedKey)-md5.Size:]
 	key := hashedKey[:len(hashedKey)-md5.Size]
 	curHash := md5.Sum(key)
 	if !bytes.Equal(curHash[:], hash) {
-		return nil, errors.New("Decrypted key check failed! Keyfile broken or not sufficent count of keys")
+		return nil, errShareCheck
 	}
 	return key, nil
 }
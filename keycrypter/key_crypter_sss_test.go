@@ -0,0 +1,82 @@
+package keycrypter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+func TestKeySSS(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := EncryptKeySSS(key, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, err := DecryptKeySSS(shares[1:4]); err != nil || !bytes.Equal(k, key) {
+		t.Errorf("Decrypt key from shares failed: %v", err)
+	}
+	if _, err := DecryptKeySSS(shares[:2]); err == nil {
+		t.Error("Decrypted key with insufficient shares")
+	}
+}
+
+func TestKeySSSSplit(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	vault, _ := ParseVaultID(NewVaultID())
+	old, err := EncryptKeySSSSplit(key, Split{VaultID: vault, N: 3, K: 2, Epoch: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := EncryptKeySSSSplit(key, Split{VaultID: vault, N: 4, K: 3, Epoch: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, split, err := DecryptKeySSSSplit(shares[:3])
+	if err != nil || split.Epoch != 2 || split.K != 3 || !bytes.Equal(k, key) {
+		t.Errorf("Decrypt key from shares failed: %v", err)
+	}
+	if info, err := ParseShareInfo(shares[1]); err != nil || info.Index == 0 || !bytes.Equal(info.VaultID, vault) || info.N != 4 {
+		t.Errorf("Parse share info failed: %v", err)
+	}
+	if _, _, err := DecryptKeySSSSplit([][]byte{old[0], shares[1], shares[2]}); err == nil {
+		t.Error("Decrypted key with shares of different splits")
+	}
+	if _, _, err := DecryptKeySSSSplit([][]byte{shares[0], shares[1], shares[0]}); err == nil {
+		t.Error("Decrypted key with duplicated shares")
+	}
+	if _, _, err := DecryptKeySSSSplit(shares[:2]); err == nil {
+		t.Error("Decrypted key with insufficient shares")
+	}
+	broken := append([]byte{}, shares[2]...)
+	broken[shareHdrLen] ^= 1
+	if _, _, err := DecryptKeySSSSplit([][]byte{shares[0], shares[1], broken}); err == nil {
+		t.Error("Decrypted key with corrupted share")
+	}
+	// Relabeled old shares can't open the sealed key
+	for _, s := range old {
+		binary.BigEndian.PutUint32(s[shareHdrLen-6:], 2)
+		binary.BigEndian.PutUint32(s[len(s)-shareChecksLen:], crc32.ChecksumIEEE(s[:len(s)-shareChecksLen]))
+	}
+	if _, _, err := DecryptKeySSSSplit(old[:2]); err == nil {
+		t.Error("Decrypted key with relabeled shares")
+	}
+}
+
+func TestKeySSSUnknownVersion(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := EncryptKeySSS(key, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := ParseShareInfo(shares[0]); err != nil || info.Version != shareVersion {
+		t.Errorf("New share version: %v, %v", info, err)
+	}
+	for _, s := range shares {
+		s[len(shareMagic)] = shareVersion + 1
+	}
+	if _, err := DecryptKeySSS(shares[:2]); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("Shares of an unknown version accepted: %v", err)
+	}
+}
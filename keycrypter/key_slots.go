@@ -0,0 +1,198 @@
+package keycrypter
+
+// provides LUKS-style key slots: every slot wraps the same master key with its own kdf and credential,
+// so credentials can be added and revoked independently.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/declan94/cfcryptfs/internal/secmem"
+)
+
+const (
+	// SlotPassword - slot unlocked with a password
+	SlotPassword = "password"
+	// SlotKeyFile - slot unlocked with the content of a keyfile
+	SlotKeyFile = "keyfile"
+	// SlotTwoFactor - slot unlocked with a password and the content of a keyfile together
+	SlotTwoFactor = "password+keyfile"
+)
+
+// ErrNoSlotMatched is returned when no key slot can be unlocked with the credential
+var ErrNoSlotMatched = errors.New("No key slot matched, wrong password or keyfile")
+
+// KeySlot wraps the master key with one credential
+type KeySlot struct {
+	ID    int
+	Type  string
+	Label string `json:",omitempty"`
+	// Key is the master key encrypted by EncryptKeyParams with the credential
+	Key []byte
+}
+
+// KDF describes the kdf and its parameters of the slot
+func (s *KeySlot) KDF() string {
+	return DescribeKDF(s.Key)
+}
+
+// KeySlots is the content of a key file
+type KeySlots struct {
+	Slots []KeySlot
+	// unlocked is the last unlocked slot, migrated to AEAD wrapping when written
+	unlocked *unlockedSlot
+}
+
+// unlockedSlot keeps copies of the credential and key locked in RAM until wiped
+type unlockedSlot struct {
+	id         int
+	credential []byte
+	key        []byte
+}
+
+func newUnlockedSlot(id int, credential []byte, key []byte) *unlockedSlot {
+	u := &unlockedSlot{id: id, credential: append([]byte{}, credential...), key: append([]byte{}, key...)}
+	secmem.Lock(u.credential)
+	secmem.Lock(u.key)
+	return u
+}
+
+func (u *unlockedSlot) wipe() {
+	for _, b := range [][]byte{u.credential, u.key} {
+		secmem.Wipe(b)
+		secmem.Unlock(b)
+	}
+}
+
+// Wipe zeroes the credential and key kept from the last Unlock, Write doesn't migrate the slot afterwards.
+// Write wipes them as well.
+func (ks *KeySlots) Wipe() {
+	if ks.unlocked != nil {
+		ks.unlocked.wipe()
+		ks.unlocked = nil
+	}
+}
+
+// ParseKeySlots parses the content of a key file.
+// Key files before key slots contain a single encrypted key, which is taken as password slot 0.
+func ParseKeySlots(data []byte) (*KeySlots, error) {
+	var ks KeySlots
+	if err := json.Unmarshal(data, &ks); err == nil && len(ks.Slots) > 0 {
+		return &ks, nil
+	}
+	if len(data) < paramLen+hashLen {
+		return nil, errors.New("Key file broken")
+	}
+	return &KeySlots{Slots: []KeySlot{{ID: 0, Type: SlotPassword, Key: data}}}, nil
+}
+
+// ReadKeySlots reads the key file located at `path`
+func ReadKeySlots(path string) (*KeySlots, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Read key file failed: %v", err)
+	}
+	return ParseKeySlots(data)
+}
+
+// Write writes the key slots to `path` atomically
+func (ks *KeySlots) Write(path string) error {
+	if u := ks.unlocked; u != nil {
+		defer ks.Wipe()
+		if s := ks.Slot(u.id); s != nil && IsLegacyWrapped(s.Key) {
+			encKey, err := EncryptKeyParams(u.key, string(u.credential), paramsOf(s.Key))
+			if err != nil {
+				return err
+			}
+			s.Key = encKey
+		}
+	}
+	js, err := json.MarshalIndent(ks, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(js, '\n'), 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Unlock tries every slot of type `typ` with the credential, returns the master key and the unlocked slot ID
+func (ks *KeySlots) Unlock(typ string, credential []byte) ([]byte, int, error) {
+	for _, s := range ks.Slots {
+		if s.Type != typ {
+			continue
+		}
+		if key, err := DecrytKey(s.Key, string(credential)); err == nil {
+			ks.Wipe()
+			ks.unlocked = newUnlockedSlot(s.ID, credential, key)
+			return key, s.ID, nil
+		}
+	}
+	return nil, -1, ErrNoSlotMatched
+}
+
+// Slot gets the slot with `id`
+func (ks *KeySlots) Slot(id int) *KeySlot {
+	for i := range ks.Slots {
+		if ks.Slots[i].ID == id {
+			return &ks.Slots[i]
+		}
+	}
+	return nil
+}
+
+// Add wraps `key` with the credential into a new slot, returns the slot ID
+func (ks *KeySlots) Add(typ string, label string, credential []byte, key []byte, kp KDFParams) (int, error) {
+	if typ != SlotPassword && typ != SlotKeyFile && typ != SlotTwoFactor {
+		return -1, fmt.Errorf("Unknown slot type: %s", typ)
+	}
+	encKey, err := EncryptKeyParams(key, string(credential), kp)
+	if err != nil {
+		return -1, err
+	}
+	id := 0
+	for _, s := range ks.Slots {
+		if s.ID >= id {
+			id = s.ID + 1
+		}
+	}
+	ks.Slots = append(ks.Slots, KeySlot{ID: id, Type: typ, Label: label, Key: encKey})
+	return id, nil
+}
+
+// Update re-wraps `key` in slot `id` with a new credential
+func (ks *KeySlots) Update(id int, credential []byte, key []byte, kp KDFParams) error {
+	s := ks.Slot(id)
+	if s == nil {
+		return fmt.Errorf("No key slot %d", id)
+	}
+	encKey, err := EncryptKeyParams(key, string(credential), kp)
+	if err != nil {
+		return err
+	}
+	s.Key = encKey
+	return nil
+}
+
+// Remove removes slot `id`, the last slot can't be removed
+func (ks *KeySlots) Remove(id int) error {
+	if ks.Slot(id) == nil {
+		return fmt.Errorf("No key slot %d", id)
+	}
+	if len(ks.Slots) == 1 {
+		return errors.New("Can't remove the last key slot")
+	}
+	for i := range ks.Slots {
+		if ks.Slots[i].ID == id {
+			ks.Slots = append(ks.Slots[:i], ks.Slots[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package keycrypter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestKeySlotsWipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-slots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	credential := []byte("pwd")
+	ks, err := ParseKeySlots(encryptKeyLegacy(key, string(credential)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, _, err := ks.Unlock(SlotPassword, credential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := ks.unlocked
+	if u == nil || !bytes.Equal(u.key, key) || !bytes.Equal(u.credential, credential) {
+		t.Fatal("Unlocked slot not kept for migration")
+	}
+	// The slot keeps copies, wiping them leaves the caller's buffers alone
+	if err = ks.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	if ks.unlocked != nil || !isZero(u.key) || !isZero(u.credential) {
+		t.Errorf("Unlocked slot not wiped after Write: %x %x", u.key, u.credential)
+	}
+	if !bytes.Equal(k, key) || string(credential) != "pwd" {
+		t.Errorf("Caller's key or credential wiped: %x %q", k, credential)
+	}
+	ks, err = ReadKeySlots(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsLegacyWrapped(ks.Slots[0].Key) {
+		t.Error("Slot not migrated")
+	}
+
+	// Wiped without writing, e.g. after only unlocking
+	if _, _, err = ks.Unlock(SlotPassword, credential); err != nil {
+		t.Fatal(err)
+	}
+	u = ks.unlocked
+	ks.Wipe()
+	if ks.unlocked != nil || !isZero(u.key) || !isZero(u.credential) {
+		t.Errorf("Unlocked slot not wiped: %x %x", u.key, u.credential)
+	}
+}
+
+func TestKeySlots(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	legacy := encryptKeyLegacy(key, "old")
+	ks, err := ParseKeySlots(legacy)
+	if err != nil || len(ks.Slots) != 1 {
+		t.Fatalf("Parse legacy key file failed: %v", err)
+	}
+	id, err := ks.Add(SlotKeyFile, "recovery", []byte("keyfile content"), key, DefaultKDFParams(KDFScrypt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, i, err := ks.Unlock(SlotKeyFile, []byte("keyfile content")); err != nil || i != id || !bytes.Equal(k, key) {
+		t.Errorf("Unlock keyfile slot failed: %v", err)
+	}
+	if _, _, err := ks.Unlock(SlotPassword, []byte("keyfile content")); err != ErrNoSlotMatched {
+		t.Errorf("Keyfile unlocked a password slot: %v", err)
+	}
+	if err = ks.Remove(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ks.Unlock(SlotPassword, []byte("old")); err != ErrNoSlotMatched {
+		t.Errorf("Removed slot still unlocks: %v", err)
+	}
+	if err = ks.Remove(id); err == nil {
+		t.Error("Removed the last slot")
+	}
+}
+
+func TestKeyTwoFactor(t *testing.T) {
+	dir := t.TempDir()
+	path, keyfile, other := filepath.Join(dir, "key"), filepath.Join(dir, "usb"), filepath.Join(dir, "other")
+	ioutil.WriteFile(keyfile, []byte("0123456789abcdef usb"), 0600)
+	ioutil.WriteFile(other, []byte("0123456789abcdef other"), 0600)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := StoreKeyTwoFactor(path, "pwd", []byte("short"), key, DefaultKDFParams(KDFScrypt)); err == nil {
+		t.Error("Stored key with a short keyfile")
+	}
+	if err := StoreKeyTwoFactor(path, "pwd", []byte("0123456789abcdef usb"), key, DefaultKDFParams(KDFScrypt)); err != nil {
+		t.Fatal(err)
+	}
+	if k, err := LoadKeyTwoFactor(path, "", "pwd", keyfile); err != nil || !bytes.Equal(k, key) {
+		t.Errorf("Unlock with both factors failed: %v", err)
+	}
+	for _, c := range []struct{ pwd, keyfile string }{{"wrong", keyfile}, {"pwd", other}, {"pwd", ""}} {
+		if _, err := LoadKeyTwoFactor(path, "", c.pwd, c.keyfile); err == nil {
+			t.Errorf("Unlocked with password %q and keyfile %q", c.pwd, c.keyfile)
+		}
+	}
+	if _, err := LoadKey(path, "", "pwd"); err == nil {
+		t.Error("Unlocked a two-factor slot with the password only")
+	}
+}
+
+func TestMigrateLegacyKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfcryptfs-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	ioutil.WriteFile(path, encryptKeyLegacy(key, "pwd"), 0600)
+
+	ks, _ := ReadKeySlots(path)
+	if k, _, err := ks.UnlockWith("", "pwd", ""); err != nil || !bytes.Equal(k, key) {
+		t.Fatalf("Unlock legacy key failed: %v", err)
+	}
+	if err = ks.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	ks, _ = ReadKeySlots(path)
+	if IsLegacyWrapped(ks.Slots[0].Key) {
+		t.Error("Legacy key not migrated")
+	}
+	if k, _, err := ks.UnlockWith("", "pwd", ""); err != nil || !bytes.Equal(k, key) {
+		t.Errorf("Unlock migrated key failed: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package keycrypter
+
+// provides a key file unlocked with private keys: the key is encrypted in age format to every
+// recipient, the recipients are listed so the key can be re-encrypted when they change.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// AgeKeyFile is the content of a key file encrypted to recipients
+type AgeKeyFile struct {
+	// Recipients are "age1..." X25519 recipients
+	Recipients []string
+	// Key is the master key encrypted to all recipients in age format
+	Key []byte
+}
+
+// ReadAgeKeyFile reads the age key file located at `path`
+func ReadAgeKeyFile(path string) (*AgeKeyFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Read key file failed: %v", err)
+	}
+	var kf AgeKeyFile
+	if err = json.Unmarshal(data, &kf); err != nil || !IsAge(kf.Key) {
+		return nil, errors.New("Key file broken")
+	}
+	return &kf, nil
+}
+
+// Unlock decrypts the key with the identities
+func (kf *AgeKeyFile) Unlock(identities [][]byte) ([]byte, error) {
+	return DecryptAge(kf.Key, identities, "")
+}
+
+// Seal encrypts key to the recipients of the key file
+func (kf *AgeKeyFile) Seal(key []byte) error {
+	if len(kf.Recipients) == 0 {
+		return errors.New("No recipient")
+	}
+	enc, err := EncryptAge(key, kf.Recipients)
+	if err != nil {
+		return err
+	}
+	kf.Key = enc
+	return nil
+}
+
+// Add adds a recipient, the key must be sealed again
+func (kf *AgeKeyFile) Add(recipient string) error {
+	if _, err := ParseAgeRecipient(recipient); err != nil {
+		return err
+	}
+	for _, r := range kf.Recipients {
+		if r == recipient {
+			return fmt.Errorf("Recipient exists: %s", recipient)
+		}
+	}
+	kf.Recipients = append(kf.Recipients, recipient)
+	return nil
+}
+
+// Remove removes a recipient, the key must be sealed again. The last recipient can't be removed.
+func (kf *AgeKeyFile) Remove(recipient string) error {
+	for i, r := range kf.Recipients {
+		if r != recipient {
+			continue
+		}
+		if len(kf.Recipients) == 1 {
+			return errors.New("Can't remove the last recipient")
+		}
+		kf.Recipients = append(kf.Recipients[:i], kf.Recipients[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("No recipient %s", recipient)
+}
+
+// Write writes the key file to `path` atomically
+func (kf *AgeKeyFile) Write(path string) error {
+	js, err := json.MarshalIndent(kf, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(js, '\n'), 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// StoreKeyAge encrypts `key` to the recipients and writes the key file to `path`
+func StoreKeyAge(path string, key []byte, recipients []string) error {
+	kf := &AgeKeyFile{}
+	for _, r := range recipients {
+		if err := kf.Add(r); err != nil {
+			return err
+		}
+	}
+	if err := kf.Seal(key); err != nil {
+		return fmt.Errorf("Encrypt key failed: %v", err)
+	}
+	if err := kf.Write(path); err != nil {
+		return fmt.Errorf("Write key file failed: %v", err)
+	}
+	return nil
+}
+
+// LoadKeyAge loads key from the age key file located at `path` with the identities
+func LoadKeyAge(path string, identities [][]byte) ([]byte, error) {
+	kf, err := ReadAgeKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := kf.Unlock(identities)
+	if err != nil {
+		return nil, fmt.Errorf("Decrypt master key failed: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,212 @@
+package keycrypter
+
+// provides a key file whose key is wrapped by a remote KMS with the HashiCorp Vault transit API:
+// POST /v1/<mount>/encrypt/<key> {"plaintext": base64} -> {"data": {"ciphertext": "vault:v1:..."}}
+// POST /v1/<mount>/decrypt/<key> {"ciphertext": "vault:v1:..."} -> {"data": {"plaintext": base64}}
+// authenticated with the X-Vault-Token header.
+// The key file is stored with the untrusted cipher directory, so the address of the KMS is given at unlock
+// instead of being read from it, and the unwrapped key is checked with a key check value.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultKMSMount is the default mount path of the transit secrets engine
+const DefaultKMSMount = "transit"
+
+const (
+	kmsTimeout  = 30 * time.Second
+	kmsCheckKey = "cfcryptfs kms key check"
+)
+
+// KMSConfig locates the transit key wrapping the master key
+type KMSConfig struct {
+	// Address of the Vault server, e.g. https://vault.example.com:8200
+	Address string
+	Mount   string
+	KeyName string
+}
+
+// KMSKeyFile is the content of a key file wrapped by a KMS
+type KMSKeyFile struct {
+	// KMS is where the key was wrapped, the address is only informational
+	KMS        KMSConfig
+	Ciphertext string
+	// KeyCheck is the HMAC-SHA256 of a constant keyed by the master key
+	KeyCheck string
+}
+
+func kmsKeyCheck(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(kmsCheckKey))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CheckKMSAddress checks that the KMS is reached over https, the token is sent to it
+func CheckKMSAddress(address string) error {
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("Invalid KMS address %q", address)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("KMS address %q is not https, the token would be sent in plaintext", address)
+	}
+	return nil
+}
+
+// KMSError is returned when the KMS fails to wrap or unwrap the key
+type KMSError struct {
+	Op  string
+	Err error
+}
+
+func (e *KMSError) Error() string {
+	return fmt.Sprintf("KMS %s failed: %v", e.Op, e.Err)
+}
+
+// KMSClient talks to the transit API
+type KMSClient struct {
+	Config KMSConfig
+	Token  string
+	HTTP   *http.Client
+}
+
+// NewKMSClient creates a client of the KMS with `token`
+func NewKMSClient(conf KMSConfig, token string) *KMSClient {
+	if conf.Mount == "" {
+		conf.Mount = DefaultKMSMount
+	}
+	return &KMSClient{Config: conf, Token: token, HTTP: &http.Client{Timeout: kmsTimeout}}
+}
+
+type kmsResponse struct {
+	Data struct {
+		Ciphertext string `json:"ciphertext"`
+		Plaintext  string `json:"plaintext"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+func (c *KMSClient) call(op string, req interface{}) (*kmsResponse, error) {
+	if err := CheckKMSAddress(c.Config.Address); err != nil {
+		return nil, &KMSError{op, err}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", strings.TrimRight(c.Config.Address, "/"),
+		strings.Trim(c.Config.Mount, "/"), op, c.Config.KeyName)
+	hreq, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, &KMSError{op, err}
+	}
+	hreq.Header.Set("X-Vault-Token", c.Token)
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTP.Do(hreq)
+	if err != nil {
+		return nil, &KMSError{op, err}
+	}
+	defer resp.Body.Close()
+	var r kmsResponse
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, &KMSError{op, fmt.Errorf("invalid response: %v", err)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg := resp.Status
+		if len(r.Errors) > 0 {
+			msg += ": " + strings.Join(r.Errors, "; ")
+		}
+		return nil, &KMSError{op, errors.New(msg)}
+	}
+	return &r, nil
+}
+
+// Encrypt wraps the key
+func (c *KMSClient) Encrypt(key []byte) (string, error) {
+	r, err := c.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)})
+	if err != nil {
+		return "", err
+	}
+	if r.Data.Ciphertext == "" {
+		return "", &KMSError{"encrypt", errors.New("no ciphertext in response")}
+	}
+	return r.Data.Ciphertext, nil
+}
+
+// Decrypt unwraps the key
+func (c *KMSClient) Decrypt(ciphertext string) ([]byte, error) {
+	r, err := c.call("decrypt", map[string]string{"ciphertext": ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(r.Data.Plaintext)
+	if err != nil || len(key) == 0 {
+		return nil, &KMSError{"decrypt", errors.New("invalid plaintext in response")}
+	}
+	return key, nil
+}
+
+// ReadKMSKeyFile reads the key file located at `path`
+func ReadKMSKeyFile(path string) (*KMSKeyFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Read key file failed: %v", err)
+	}
+	var kf KMSKeyFile
+	if err = json.Unmarshal(data, &kf); err != nil || kf.Ciphertext == "" || kf.KMS.KeyName == "" || kf.KeyCheck == "" {
+		return nil, errors.New("Key file broken")
+	}
+	return &kf, nil
+}
+
+// StoreKeyKMS wraps `key` with the KMS and writes the key file to `path`
+func StoreKeyKMS(path string, key []byte, c *KMSClient) error {
+	ct, err := c.Encrypt(key)
+	if err != nil {
+		return err
+	}
+	js, err := json.MarshalIndent(&KMSKeyFile{KMS: c.Config, Ciphertext: ct, KeyCheck: kmsKeyCheck(key)}, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(js, '\n'), 0600); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Write key file failed: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadKeyKMS loads key from the key file located at `path`, unwrapped by the KMS at the address of `c`
+// with the transit key named in the key file. KMS failures are returned as *KMSError.
+func LoadKeyKMS(path string, c *KMSClient) ([]byte, error) {
+	kf, err := ReadKMSKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c.Config.Mount, c.Config.KeyName = kf.KMS.Mount, kf.KMS.KeyName
+	if c.Config.Mount == "" {
+		c.Config.Mount = DefaultKMSMount
+	}
+	key, err := c.Decrypt(kf.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(kmsKeyCheck(key)), []byte(kf.KeyCheck)) {
+		return nil, &KMSError{"decrypt", errors.New("unwrapped key doesn't match the key check of the key file")}
+	}
+	return key, nil
+}
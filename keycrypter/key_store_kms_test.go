@@ -0,0 +1,104 @@
+package keycrypter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+)
+
+// transitStub mimics the transit API of a key named "vault-key", ciphertexts are the plaintexts prefixed
+func transitStub(t *testing.T, token string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/vault-key":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"ciphertext": "vault:v1:" + req["plaintext"]}})
+		case "/v1/transit/decrypt/vault-key":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": strings.TrimPrefix(req["ciphertext"], "vault:v1:")}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+}
+
+func newTestKMSClient(srv *httptest.Server, conf KMSConfig, token string) *KMSClient {
+	conf.Address = srv.URL
+	c := NewKMSClient(conf, token)
+	c.HTTP = srv.Client()
+	return c
+}
+
+func TestKeyKMS(t *testing.T) {
+	srv := transitStub(t, "token")
+	defer srv.Close()
+	key := corecrypter.RandBytes(32)
+	path := filepath.Join(t.TempDir(), "key")
+	conf := KMSConfig{KeyName: "vault-key"}
+	if err := StoreKeyKMS(path, key, newTestKMSClient(srv, conf, "token")); err != nil {
+		t.Fatal(err)
+	}
+	if k, err := LoadKeyKMS(path, newTestKMSClient(srv, KMSConfig{}, "token")); err != nil || !bytes.Equal(k, key) {
+		t.Errorf("Load key failed: %v", err)
+	}
+	_, err := LoadKeyKMS(path, newTestKMSClient(srv, KMSConfig{}, "wrong"))
+	if _, ok := err.(*KMSError); !ok || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Wrong error with a wrong token: %v", err)
+	}
+	conf.KeyName = "other"
+	if err := StoreKeyKMS(path, key, newTestKMSClient(srv, conf, "token")); err == nil {
+		t.Error("Stored key with an unknown transit key")
+	}
+}
+
+// TestKeyKMSUntrustedFile edits the key file like a malicious storage provider
+func TestKeyKMSUntrustedFile(t *testing.T) {
+	srv := transitStub(t, "token")
+	defer srv.Close()
+	key := corecrypter.RandBytes(32)
+	path := filepath.Join(t.TempDir(), "key")
+	if err := StoreKeyKMS(path, key, newTestKMSClient(srv, KMSConfig{KeyName: "vault-key"}, "token")); err != nil {
+		t.Fatal(err)
+	}
+	edit := func(change func(kf *KMSKeyFile)) {
+		kf, err := ReadKMSKeyFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		change(kf)
+		data, _ := json.Marshal(kf)
+		if err = ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The address in the key file is not where the token goes
+	edit(func(kf *KMSKeyFile) { kf.KMS.Address = "https://attacker.example.com" })
+	if k, err := LoadKeyKMS(path, newTestKMSClient(srv, KMSConfig{}, "token")); err != nil || !bytes.Equal(k, key) {
+		t.Errorf("Load key failed: %v", err)
+	}
+	// A key of the attacker's choice is rejected
+	edit(func(kf *KMSKeyFile) {
+		kf.Ciphertext = "vault:v1:" + base64.StdEncoding.EncodeToString(corecrypter.RandBytes(32))
+	})
+	if _, err := LoadKeyKMS(path, newTestKMSClient(srv, KMSConfig{}, "token")); err == nil {
+		t.Error("Loaded a key not matching the key check")
+	}
+	c := NewKMSClient(KMSConfig{Address: "http://vault.example.com:8200", KeyName: "vault-key"}, "token")
+	if _, err := c.Encrypt(key); err == nil || !strings.Contains(err.Error(), "https") {
+		t.Errorf("Used a plain http KMS: %v", err)
+	}
+}
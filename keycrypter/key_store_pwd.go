@@ -1,41 +1,149 @@
 package keycrypter
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
 
 	"github.com/declan94/cfcryptfs/readpwd"
 )
 
-// LoadKey loads key from the password encrypted key file located at `path`, with `password` or password reading from the `pwdfile`
+const twoFactorInfo = "cfcryptfs two-factor keyfile"
+
+// MinTwoFactorKeyFileLen is the minimum length of the keyfile of two-factor slots
+const MinTwoFactorKeyFileLen = 16
+
+// LoadKey loads key from the password encrypted key file located at `path`, with `password` or password reading from the `pwdfile`.
+// Every password slot of the key file is tried.
 func LoadKey(path string, pwdfile string, password string) ([]byte, error) {
-	encKey, err := ioutil.ReadFile(path)
+	key, _, err := UnlockKey(path, pwdfile, password, "")
+	return key, err
+}
+
+// UnlockKey loads key from the key file located at `path` like LoadKey, returns the unlocked slot ID as well.
+// When `keyfile` is not empty, keyfile slots are tried with its content instead.
+func UnlockKey(path string, pwdfile string, password string, keyfile string) ([]byte, int, error) {
+	ks, err := ReadKeySlots(path)
 	if err != nil {
-		return nil, fmt.Errorf("Read key file failed: %v", err)
+		return nil, -1, err
 	}
-	if password == "" {
-		extpwd := pwdfile
-		if extpwd != "" {
-			extpwd = "/bin/cat -- " + extpwd
+	defer ks.Wipe()
+	return ks.UnlockWith(pwdfile, password, keyfile)
+}
+
+// UnlockWith unlocks the key slots with `password`, password reading from the `pwdfile`,
+// or the content of `keyfile` if not empty. Returns the key and the unlocked slot ID.
+func (ks *KeySlots) UnlockWith(pwdfile string, password string, keyfile string) ([]byte, int, error) {
+	var err error
+	typ := SlotPassword
+	var credential []byte
+	if keyfile != "" {
+		typ = SlotKeyFile
+		if credential, err = ioutil.ReadFile(keyfile); err != nil {
+			return nil, -1, fmt.Errorf("Read keyfile failed: %v", err)
+		}
+	} else {
+		if password, err = readPassword(pwdfile, password); err != nil {
+			return nil, -1, err
 		}
-		password, err = readpwd.Once(extpwd)
+		credential = []byte(password)
+	}
+	key, id, err := ks.Unlock(typ, credential)
+	if err != nil {
+		return nil, -1, fmt.Errorf("Decrypt master key failed: %v", err)
 	}
+	return key, id, nil
+}
+
+// readPassword returns `password`, or reads one from the `pwdfile` or the terminal when empty
+func readPassword(pwdfile string, password string) (string, error) {
+	if password != "" {
+		return password, nil
+	}
+	extpwd := pwdfile
+	if extpwd != "" {
+		extpwd = "/bin/cat -- " + extpwd
+	}
+	password, err := readpwd.Once(extpwd)
 	if err != nil {
-		return nil, fmt.Errorf("Read password failed: %v", err)
+		return "", fmt.Errorf("Read password failed: %v", err)
+	}
+	return password, nil
+}
+
+// TwoFactorCredential mixes the content of a keyfile into the password, it is the kdf input of two-factor slots.
+// The keyfile digest has a fixed length, so neither factor can be moved into the other.
+func TwoFactorCredential(password string, keyfile []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(twoFactorInfo))
+	h.Write(keyfile)
+	return append(append([]byte(password), 0), h.Sum(nil)...)
+}
 
+// UnlockTwoFactor unlocks the two-factor slots with `password` or password reading from the `pwdfile`,
+// together with the content of `keyfile`. Returns the key and the unlocked slot ID.
+func (ks *KeySlots) UnlockTwoFactor(pwdfile string, password string, keyfile string) ([]byte, int, error) {
+	if keyfile == "" {
+		return nil, -1, errors.New("Both a password and a keyfile are needed")
+	}
+	content, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, -1, fmt.Errorf("Read keyfile failed: %v", err)
+	}
+	if password, err = readPassword(pwdfile, password); err != nil {
+		return nil, -1, err
 	}
-	key, err := DecrytKey(encKey, password)
+	key, id, err := ks.Unlock(SlotTwoFactor, TwoFactorCredential(password, content))
 	if err != nil {
-		return nil, fmt.Errorf("Decrypt master key failed: %v", err)
+		return nil, -1, fmt.Errorf("Decrypt master key failed: %v", err)
+	}
+	return key, id, nil
+}
+
+// LoadKeyTwoFactor loads key from the key file located at `path` with a password and the content of `keyfile`,
+// the password is `password` or read from the `pwdfile`
+func LoadKeyTwoFactor(path string, pwdfile string, password string, keyfile string) ([]byte, error) {
+	ks, err := ReadKeySlots(path)
+	if err != nil {
+		return nil, err
+	}
+	defer ks.Wipe()
+	key, _, err := ks.UnlockTwoFactor(pwdfile, password, keyfile)
+	return key, err
+}
+
+// StoreKeyTwoFactor encrypts `key` with password `pwd` and the keyfile content together,
+// the key file is written with a two-factor slot as its only slot
+func StoreKeyTwoFactor(path string, pwd string, keyfile []byte, key []byte, kp KDFParams) error {
+	if err := kp.Validate(); err != nil {
+		return err
 	}
-	return key, nil
+	if len(keyfile) < MinTwoFactorKeyFileLen {
+		return fmt.Errorf("Keyfile too short, at least %d bytes are needed", MinTwoFactorKeyFileLen)
+	}
+	ks := &KeySlots{}
+	if _, err := ks.Add(SlotTwoFactor, "", TwoFactorCredential(pwd, keyfile), key, kp); err != nil {
+		return fmt.Errorf("Encrypt key failed: %v", err)
+	}
+	if err := ks.Write(path); err != nil {
+		return fmt.Errorf("Write key file failed: %v", err)
+	}
+	return nil
 }
 
 // StoreKey encrypt `key` using password `pwd`, then write encrypted key to file located at `path`.
 // When pwd is empty, will ask user to enter a password in cli.
 func StoreKey(path string, pwd string, key []byte) error {
-	var encKey []byte
+	return StoreKeyParams(path, pwd, key, DefaultKDFParams(DefaultKDF))
+}
+
+// StoreKeyParams works like StoreKey, the password key is derived with kdf parameters `kp`.
+// The key file is written with the password as its only slot.
+func StoreKeyParams(path string, pwd string, key []byte, kp KDFParams) error {
+	if err := kp.Validate(); err != nil {
+		return err
+	}
 	if pwd == "" {
 		for true {
 			var err error
@@ -48,14 +156,12 @@ func StoreKey(path string, pwd string, key []byte) error {
 			}
 		}
 	}
-	encKey, err := EncryptKey(key, pwd)
-	if err != nil {
+	ks := &KeySlots{}
+	if _, err := ks.Add(SlotPassword, "", []byte(pwd), key, kp); err != nil {
 		return fmt.Errorf("Encrypt key failed: %v", err)
 	}
-	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return fmt.Errorf("Open key file failed: %s", err)
+	if err := ks.Write(path); err != nil {
+		return fmt.Errorf("Write key file failed: %v", err)
 	}
-	_, err = fd.Write(encKey)
-	return err
+	return nil
 }
@@ -0,0 +1,181 @@
+package keycrypter
+
+// provides a key file unlocked through an ssh-agent: for every ssh key the file stores a random challenge,
+// the master key is wrapped with a key derived from the agent's signature over it.
+// Ed25519 and RSA (PKCS#1 v1.5) signatures are deterministic, so the derived key is repeatable.
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	sshChallengeLen = 32
+	sshWrapInfo     = "cfcryptfs ssh-agent key wrap"
+)
+
+// ErrSSHNoKey is returned when the agent holds none of the ssh keys of the key file
+var ErrSSHNoKey = errors.New("The ssh-agent holds none of the keys that unlock this key file")
+
+// SSHKeySlot wraps the master key with one ssh key
+type SSHKeySlot struct {
+	// PublicKey is in authorized_keys format
+	PublicKey string
+	Challenge []byte
+	// Key is the master key sealed with the key derived from the signature
+	Key []byte
+}
+
+// SSHKeyFile is the content of a key file unlocked through an ssh-agent
+type SSHKeyFile struct {
+	Slots []SSHKeySlot
+}
+
+// SSHKeySupported checks whether signatures of the ssh key are deterministic
+func SSHKeySupported(pub ssh.PublicKey) bool {
+	t := pub.Type()
+	return t == ssh.KeyAlgoED25519 || t == ssh.KeyAlgoRSA
+}
+
+// sshWrapKey asks the agent to sign the challenge and derives the wrapping key from the signature
+func sshWrapKey(ag agent.ExtendedAgent, pub ssh.PublicKey, challenge []byte) ([]byte, error) {
+	if !SSHKeySupported(pub) {
+		return nil, fmt.Errorf("Unsupported ssh key type %s, use ed25519 or rsa", pub.Type())
+	}
+	var flags agent.SignatureFlags
+	if pub.Type() == ssh.KeyAlgoRSA {
+		flags = agent.SignatureFlagRsaSha256
+	}
+	sig, err := ag.SignWithFlags(pub, challenge, flags)
+	if err != nil {
+		return nil, fmt.Errorf("ssh-agent sign failed: %v", err)
+	}
+	wrapKey := make([]byte, wrapKeyLen)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, sig.Blob, challenge, []byte(sshWrapInfo)), wrapKey); err != nil {
+		return nil, err
+	}
+	return wrapKey, nil
+}
+
+func sshAAD(s *SSHKeySlot) []byte {
+	return append(append([]byte{}, s.Challenge...), s.PublicKey...)
+}
+
+// Add wraps the key with the ssh key `pub` held by the agent
+func (kf *SSHKeyFile) Add(ag agent.ExtendedAgent, pub ssh.PublicKey, key []byte) error {
+	s := SSHKeySlot{
+		PublicKey: string(ssh.MarshalAuthorizedKey(pub)),
+		Challenge: corecrypter.RandBytes(sshChallengeLen),
+	}
+	for _, o := range kf.Slots {
+		if o.PublicKey == s.PublicKey {
+			return fmt.Errorf("ssh key exists: %s", ssh.FingerprintSHA256(pub))
+		}
+	}
+	wrapKey, err := sshWrapKey(ag, pub, s.Challenge)
+	if err != nil {
+		return err
+	}
+	if s.Key, err = sealKey(wrapKey, key, sshAAD(&s)); err != nil {
+		return err
+	}
+	kf.Slots = append(kf.Slots, s)
+	return nil
+}
+
+// Unlock unwraps the key with the first ssh key of the key file held by the agent
+func (kf *SSHKeyFile) Unlock(ag agent.ExtendedAgent) ([]byte, error) {
+	held, err := ag.List()
+	if err != nil {
+		return nil, fmt.Errorf("ssh-agent list keys failed: %v", err)
+	}
+	for i := range kf.Slots {
+		s := &kf.Slots[i]
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.PublicKey))
+		if err != nil {
+			return nil, errors.New("Key file broken")
+		}
+		for _, h := range held {
+			if string(h.Marshal()) != string(pub.Marshal()) {
+				continue
+			}
+			wrapKey, err := sshWrapKey(ag, pub, s.Challenge)
+			if err != nil {
+				return nil, err
+			}
+			key, err := openKey(wrapKey, s.Key, sshAAD(s))
+			if err != nil {
+				return nil, fmt.Errorf("Unwrap key with ssh key %s failed, its signatures may not be deterministic", ssh.FingerprintSHA256(pub))
+			}
+			return key, nil
+		}
+	}
+	return nil, ErrSSHNoKey
+}
+
+// ReadSSHKeyFile reads the key file located at `path`
+func ReadSSHKeyFile(path string) (*SSHKeyFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Read key file failed: %v", err)
+	}
+	var kf SSHKeyFile
+	if err = json.Unmarshal(data, &kf); err != nil || len(kf.Slots) == 0 {
+		return nil, errors.New("Key file broken")
+	}
+	return &kf, nil
+}
+
+// Write writes the key file to `path` atomically
+func (kf *SSHKeyFile) Write(path string) error {
+	js, err := json.MarshalIndent(kf, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(js, '\n'), 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// StoreKeySSH wraps `key` with the ssh keys `pubs` held by the agent and writes the key file to `path`
+func StoreKeySSH(path string, key []byte, ag agent.ExtendedAgent, pubs []ssh.PublicKey) error {
+	if len(pubs) == 0 {
+		return errors.New("No ssh key")
+	}
+	kf := &SSHKeyFile{}
+	for _, pub := range pubs {
+		if err := kf.Add(ag, pub, key); err != nil {
+			return err
+		}
+	}
+	if err := kf.Write(path); err != nil {
+		return fmt.Errorf("Write key file failed: %v", err)
+	}
+	return nil
+}
+
+// LoadKeySSH loads key from the key file located at `path` through the agent
+func LoadKeySSH(path string, ag agent.ExtendedAgent) ([]byte, error) {
+	kf, err := ReadSSHKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := kf.Unlock(ag)
+	if err != nil {
+		return nil, fmt.Errorf("Decrypt master key failed: %v", err)
+	}
+	return key, nil
+}
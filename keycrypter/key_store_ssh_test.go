@@ -0,0 +1,51 @@
+package keycrypter
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"path/filepath"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestKeySSH(t *testing.T) {
+	ag := agent.NewKeyring().(agent.ExtendedAgent)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var pubs []ssh.PublicKey
+	for _, k := range []interface{}{edKey, rsaKey, ecKey} {
+		if err := ag.Add(agent.AddedKey{PrivateKey: k}); err != nil {
+			t.Fatal(err)
+		}
+		signer, _ := ssh.NewSignerFromKey(k)
+		pubs = append(pubs, signer.PublicKey())
+	}
+	key := corecrypter.RandBytes(32)
+	path := filepath.Join(t.TempDir(), "key")
+	if err := StoreKeySSH(path, key, ag, pubs); err == nil {
+		t.Error("Stored key with an ecdsa key")
+	}
+	if err := StoreKeySSH(path, key, ag, pubs[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if k, err := LoadKeySSH(path, ag); err != nil || !bytes.Equal(k, key) {
+		t.Errorf("Load key failed: %v", err)
+	}
+	// Only the rsa key left in the agent
+	ag.Remove(pubs[0])
+	if k, err := LoadKeySSH(path, ag); err != nil || !bytes.Equal(k, key) {
+		t.Errorf("Load key with rsa key failed: %v", err)
+	}
+	ag.RemoveAll()
+	if _, err := LoadKeySSH(path, ag); err == nil {
+		t.Error("Loaded key without ssh keys")
+	}
+}
@@ -1,6 +1,7 @@
 package keycrypter
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -8,22 +9,76 @@ import (
 
 // LoadKeySSS loads key from the sharing key files
 func LoadKeySSS(paths []string) ([]byte, error) {
+	key, _, err := LoadKeySSSSplit(paths, nil)
+	return key, err
+}
+
+// readShare reads a key share from `path`, "-" reads a paper backup typed in.
+// Paper backups are decoded.
+func readShare(path string) ([]byte, error) {
+	var s []byte
+	var err error
+	if path == "-" {
+		fmt.Println("Type in the paper backup of a keyfile, ending with its END line:")
+		s, err = ReadPaper(os.Stdin)
+	} else {
+		s, err = ioutil.ReadFile(path)
+	}
+	if err != nil || !IsPaper(s) {
+		return s, err
+	}
+	kind, s, err := DecodePaper(s)
+	if err == nil && kind != PaperShare {
+		err = fmt.Errorf("Paper backup of %s, not a keyfile", kind)
+	}
+	return s, err
+}
+
+// LoadKeySSSSplit loads key from the sharing key files, returns the split of them as well.
+// Key files may be paper backups, path "-" reads one typed in.
+// When `expect` is not nil, key files of another vault or split epoch are reported.
+func LoadKeySSSSplit(paths []string, expect *Split) ([]byte, *Split, error) {
 	shares := make([][]byte, len(paths))
+	names := make([]string, len(paths))
 	for i, path := range paths {
-		s, err := ioutil.ReadFile(path)
+		names[i] = path
+		if path == "-" {
+			names[i] = fmt.Sprintf("typed-in keyfile %d", i+1)
+		}
+		s, err := readShare(path)
 		if err != nil {
-			return nil, fmt.Errorf("Read key file [%s] failed: %v", path, err)
+			return nil, nil, fmt.Errorf("Read key file [%s] failed: %v", names[i], err)
 		}
 		shares[i] = s
+		if expect == nil {
+			continue
+		}
+		info, err := ParseShareInfo(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("[%s]: %v", names[i], err)
+		}
+		if info.VaultID != nil && expect.VaultID != nil && !bytes.Equal(info.VaultID, expect.VaultID) {
+			return nil, nil, fmt.Errorf("[%s] is a keyfile of another vault (%s)", names[i], formatVaultID(info.VaultID))
+		}
+		if info.Epoch != expect.Epoch {
+			return nil, nil, fmt.Errorf("[%s]: %v", names[i], ErrShareEpoch)
+		}
 	}
-	return DecryptKeySSS(shares)
+	return decryptKeySSS(shares, names)
 }
 
 // StoreKeySSS encrypt the key using Shamir's Secret Sharing scheme, then write key shares to files.
 // `k` is the threshold number of sharing key parts to reconstruct.
 func StoreKeySSS(paths []string, k byte, key []byte) error {
-	n := byte(len(paths))
-	shares, err := EncryptKeySSS(key, n, k)
+	return StoreKeySSSSplit(paths, key, Split{N: byte(len(paths)), K: k})
+}
+
+// StoreKeySSSSplit works like StoreKeySSS, the shares are created as described by `split`.
+func StoreKeySSSSplit(paths []string, key []byte, split Split) error {
+	if int(split.N) != len(paths) {
+		return fmt.Errorf("%d key files for %d shares", len(paths), split.N)
+	}
+	shares, err := EncryptKeySSSSplit(key, split)
 	if err != nil {
 		return fmt.Errorf("Encrypt key failed: %v", err)
 	}
@@ -33,6 +88,7 @@ func StoreKeySSS(paths []string, k byte, key []byte) error {
 			return fmt.Errorf("Open key file [%s] failed: %v", path, err)
 		}
 		_, err = fd.Write(shares[i])
+		fd.Close()
 		if err != nil {
 			return fmt.Errorf("Write key file [%s] failed: %s", path, err)
 		}
@@ -0,0 +1,91 @@
+package keycrypter
+
+// caches unlocked master keys in the kernel keyring for remounts without unlocking again.
+// The keys are wrapped with a random key kept in the session keyring, so a cached key is only usable
+// from the login session that cached it, even when it is stored in the user keyring.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+)
+
+const (
+	// KeyringUser is the keyring shared by all sessions of the user
+	KeyringUser = "user"
+	// KeyringSession is the keyring of the login session
+	KeyringSession = "session"
+
+	keyringPrefix     = "cfcryptfs:"
+	keyringSessionKey = keyringPrefix + "session"
+	keyringWrapInfo   = "cfcryptfs keyring cache"
+)
+
+var (
+	// ErrKeyringUnsupported is returned when the system has no kernel keyring
+	ErrKeyringUnsupported = errors.New("Kernel keyring is only supported on Linux")
+	// ErrNotCached is returned when the keyring holds no key of the vault
+	ErrNotCached = errors.New("Key not cached")
+)
+
+func keyringDesc(vaultID string) string {
+	return keyringPrefix + vaultID
+}
+
+// CacheKey stores the master key of vault `vaultID` in `keyring` (KeyringUser or KeyringSession),
+// it expires after `timeout`, zero keeps it until purged or the keyring is gone
+func CacheKey(keyring string, vaultID string, key []byte, timeout time.Duration) error {
+	if keyring != KeyringUser && keyring != KeyringSession {
+		return fmt.Errorf("Unknown keyring %q, use %s or %s", keyring, KeyringUser, KeyringSession)
+	}
+	sessionKey, err := keyringRead(keyringSessionKey)
+	if err == ErrNotCached {
+		sessionKey, err = corecrypter.RandBytes(wrapKeyLen), nil
+	}
+	if err != nil {
+		return err
+	}
+	// Adding it again also narrows the permission of a session key cached by older versions
+	if err = keyringAdd(KeyringSession, keyringSessionKey, sessionKey, 0); err != nil {
+		return err
+	}
+	wrapped, err := WrapKey(sessionKey, key, keyringWrapInfo+" "+vaultID)
+	if err != nil {
+		return err
+	}
+	return keyringAdd(keyring, keyringDesc(vaultID), wrapped, timeout)
+}
+
+// CachedKey returns the master key of vault `vaultID` cached by this session, ErrNotCached if there is none
+func CachedKey(vaultID string) ([]byte, error) {
+	wrapped, err := keyringRead(keyringDesc(vaultID))
+	if err != nil {
+		return nil, err
+	}
+	sessionKey, err := keyringRead(keyringSessionKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := UnwrapKey(sessionKey, wrapped, keyringWrapInfo+" "+vaultID)
+	if err != nil {
+		// Cached by another session
+		return nil, ErrNotCached
+	}
+	return key, nil
+}
+
+// PurgeCachedKeys removes the cached key of vault `vaultID` from the user and session keyrings,
+// or all cached keys and the session wrapping key if `vaultID` is empty. It returns the count of removed keys.
+func PurgeCachedKeys(vaultID string) (int, error) {
+	if vaultID == "" {
+		return keyringPurge(func(desc string) bool {
+			return strings.HasPrefix(desc, keyringPrefix)
+		})
+	}
+	return keyringPurge(func(desc string) bool {
+		return desc == keyringDesc(vaultID)
+	})
+}
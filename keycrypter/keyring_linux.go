@@ -0,0 +1,125 @@
+// +build linux
+
+package keycrypter
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// keyringPerm allows the possessor everything, and the user only to see the cached keys,
+	// e.g. for -purge_keys from another session
+	keyringPerm = 0x3f010000
+	// keyringSessionPerm allows only the possessor everything on the session wrapping key
+	keyringSessionPerm = 0x3f000000
+)
+
+var keyringSpecs = map[string]int{
+	KeyringSession: unix.KEY_SPEC_SESSION_KEYRING,
+	KeyringUser:    unix.KEY_SPEC_USER_KEYRING,
+}
+
+// keyringID resolves the keyring without creating a new session keyring for a process that has none,
+// the user session keyring is used instead, so later processes find the keys as well
+func keyringID(spec int) (int, error) {
+	return unix.KeyctlInt(unix.KEYCTL_GET_KEYRING_ID, spec, 0, 0, 0)
+}
+
+func keyringAdd(keyring string, desc string, payload []byte, timeout time.Duration) error {
+	ring, err := keyringID(keyringSpecs[keyring])
+	if err != nil {
+		return err
+	}
+	id, err := unix.AddKey("user", desc, payload, ring)
+	if err != nil {
+		return err
+	}
+	// Setting the timeout needs the setattr permission, which is only given to the possessor
+	if timeout > 0 {
+		if _, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, int((timeout+time.Second-1)/time.Second), 0, 0); err != nil {
+			return err
+		}
+	}
+	if desc == keyringSessionKey {
+		return unix.KeyctlSetperm(id, keyringSessionPerm)
+	}
+	return unix.KeyctlSetperm(id, keyringPerm)
+}
+
+// keyringRead reads the key `desc` from the session or the user keyring
+func keyringRead(desc string) ([]byte, error) {
+	id, err := keyringSearch(desc)
+	if err != nil {
+		return nil, err
+	}
+	return keyctlRead(id)
+}
+
+// keyringSearch returns the ID of the key `desc` in the session or the user keyring
+func keyringSearch(desc string) (int, error) {
+	for _, spec := range []int{unix.KEY_SPEC_SESSION_KEYRING, unix.KEY_SPEC_USER_KEYRING} {
+		ring, err := keyringID(spec)
+		if err != nil {
+			return 0, err
+		}
+		id, err := unix.KeyctlSearch(ring, "user", desc, 0)
+		if err == unix.ENOKEY || err == unix.EKEYEXPIRED || err == unix.EKEYREVOKED || err == unix.EACCES {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return id, nil
+	}
+	return 0, ErrNotCached
+}
+
+func keyctlRead(id int) ([]byte, error) {
+	var buf []byte
+	for {
+		n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		if n <= len(buf) {
+			return buf[:n], nil
+		}
+		buf = make([]byte, n)
+	}
+}
+
+// keyringPurge unlinks the keys whose description matches from the session and user keyrings
+func keyringPurge(match func(desc string) bool) (int, error) {
+	var count int
+	for _, spec := range []int{unix.KEY_SPEC_SESSION_KEYRING, unix.KEY_SPEC_USER_KEYRING} {
+		ring, err := keyringID(spec)
+		if err != nil {
+			return count, err
+		}
+		list, err := keyctlRead(ring)
+		if err != nil {
+			return count, err
+		}
+		for i := 0; i+4 <= len(list); i += 4 {
+			id := int(int32(binary.NativeEndian.Uint32(list[i:])))
+			// "type;uid;gid;perm;description"
+			info, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+			if err != nil {
+				continue
+			}
+			fields := strings.SplitN(info, ";", 5)
+			if len(fields) < 5 || fields[0] != "user" || !match(fields[4]) {
+				continue
+			}
+			if _, err = unix.KeyctlInt(unix.KEYCTL_UNLINK, id, ring, 0, 0); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,61 @@
+// +build linux
+
+package keycrypter
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+	"golang.org/x/sys/unix"
+)
+
+const keyringChildEnv = "CFCRYPTFS_KEYRING_TEST_IDS"
+
+// TestKeyringOtherSession reads the cached key by its ID, as found in /proc/keys, from a new session
+func TestKeyringOtherSession(t *testing.T) {
+	if ids := os.Getenv(keyringChildEnv); ids != "" {
+		keyringTestChild(t, ids)
+		return
+	}
+	vaultID := NewVaultID()
+	if err := CacheKey(KeyringUser, vaultID, corecrypter.RandBytes(32), time.Minute); err != nil {
+		t.Skipf("Kernel keyring unavailable: %v", err)
+	}
+	defer PurgeCachedKeys(vaultID)
+	var ids []string
+	for _, desc := range []string{keyringSessionKey, keyringDesc(vaultID)} {
+		id, err := keyringSearch(desc)
+		if err != nil {
+			t.Fatalf("Search %s failed: %v", desc, err)
+		}
+		ids = append(ids, strconv.Itoa(id))
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestKeyringOtherSession$", "-test.v")
+	cmd.Env = append(os.Environ(), keyringChildEnv+"="+strings.Join(ids, ",")+","+vaultID)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Another session read the cached key: %v\n%s", err, out)
+	}
+}
+
+func keyringTestChild(t *testing.T, ids string) {
+	runtime.LockOSThread()
+	if _, err := unix.KeyctlJoinSessionKeyring("cfcryptfs-test-" + strconv.Itoa(os.Getpid())); err != nil {
+		t.Skipf("Join a new session keyring failed: %v", err)
+	}
+	fields := strings.Split(ids, ",")
+	for _, f := range fields[:2] {
+		id, _ := strconv.Atoi(f)
+		if _, err := keyctlRead(id); err != unix.EACCES {
+			t.Errorf("Read key %d from another session: %v", id, err)
+		}
+	}
+	if _, err := CachedKey(fields[2]); err == nil {
+		t.Error("Unwrapped the cached key in another session")
+	}
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package keycrypter
+
+import "time"
+
+func keyringAdd(keyring string, desc string, payload []byte, timeout time.Duration) error {
+	return ErrKeyringUnsupported
+}
+
+func keyringRead(desc string) ([]byte, error) {
+	return nil, ErrKeyringUnsupported
+}
+
+func keyringPurge(match func(desc string) bool) (int, error) {
+	return 0, ErrKeyringUnsupported
+}
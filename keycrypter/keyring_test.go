@@ -0,0 +1,31 @@
+package keycrypter
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+)
+
+func TestKeyringCache(t *testing.T) {
+	vaultID := NewVaultID()
+	key := corecrypter.RandBytes(32)
+	if err := CacheKey(KeyringUser, vaultID, key, time.Minute); err != nil {
+		// Not on Linux, or keyctl is filtered (e.g. in containers)
+		t.Skipf("Kernel keyring unavailable: %v", err)
+	}
+	defer PurgeCachedKeys(vaultID)
+	if k, err := CachedKey(vaultID); err != nil || !bytes.Equal(k, key) {
+		t.Errorf("Read cached key failed: %v", err)
+	}
+	if _, err := CachedKey(NewVaultID()); err != ErrNotCached {
+		t.Errorf("Key of another vault: %v", err)
+	}
+	if n, err := PurgeCachedKeys(vaultID); err != nil || n != 1 {
+		t.Errorf("Purge removed %d keys: %v", n, err)
+	}
+	if _, err := CachedKey(vaultID); err != ErrNotCached {
+		t.Errorf("Key cached after purge: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package keycrypter
+
+// provides a human-transcribable text form of key material for paper backups:
+//
+//	-----BEGIN CFCRYPTFS SHARE-----
+//	# comment
+//	01  XXXX XXXX XXXX XXXX XXXX XXXX  CC
+//	...
+//	-----END CFCRYPTFS SHARE-----
+//
+// Every line holds up to 15 bytes in base32 groups, CC is a checksum of the line number and its data,
+// so typos are reported with the line they are in. 0, 1 and 8 are read as O, I and B.
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	paperBegin     = "-----BEGIN CFCRYPTFS "
+	paperEnd       = "-----END CFCRYPTFS "
+	paperDash      = "-----"
+	paperLineBytes = 15
+	paperGroupLen  = 4
+)
+
+const (
+	// PaperShare - paper backup of a key share
+	PaperShare = "SHARE"
+	// PaperEmergency - paper backup of an emergency file
+	PaperEmergency = "EMERGENCY"
+)
+
+var paperEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var paperMisread = strings.NewReplacer("0", "O", "1", "I", "8", "B")
+
+func paperLineSum(no int, data []byte) string {
+	h := crc32.NewIEEE()
+	h.Write([]byte{byte(no)})
+	h.Write(data)
+	sum := h.Sum32() & 0x3ff
+	return paperEncoding.EncodeToString([]byte{byte(sum >> 2), byte(sum << 6)})[:2]
+}
+
+// EncodePaper encodes data of `kind` in paper backup text, `comments` are written as comment lines
+func EncodePaper(kind string, data []byte, comments ...string) string {
+	var b strings.Builder
+	b.WriteString(paperBegin + kind + paperDash + "\n")
+	for _, c := range comments {
+		b.WriteString("# " + c + "\n")
+	}
+	for no := 1; len(data) > 0; no++ {
+		n := paperLineBytes
+		if len(data) < n {
+			n = len(data)
+		}
+		enc := paperEncoding.EncodeToString(data[:n])
+		fmt.Fprintf(&b, "%02d ", no)
+		for i := 0; i < len(enc); i += paperGroupLen {
+			end := i + paperGroupLen
+			if end > len(enc) {
+				end = len(enc)
+			}
+			b.WriteString(" " + enc[i:end])
+		}
+		b.WriteString("  " + paperLineSum(no, data[:n]) + "\n")
+		data = data[n:]
+	}
+	b.WriteString(paperEnd + kind + paperDash + "\n")
+	return b.String()
+}
+
+// IsPaper checks whether the content is paper backup text
+func IsPaper(text []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(text), []byte(paperBegin))
+}
+
+// DecodePaper decodes paper backup text, returns its kind and data
+func DecodePaper(text []byte) (string, []byte, error) {
+	var kind string
+	var data []byte
+	no := 0
+	for _, line := range strings.Split(string(text), "\n") {
+		line = strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, paperBegin):
+			kind = strings.TrimSuffix(strings.TrimPrefix(line, paperBegin), paperDash)
+			continue
+		case strings.HasPrefix(line, paperEnd):
+			if kind == "" {
+				return "", nil, errors.New("Paper backup has no begin line")
+			}
+			if no == 0 {
+				return "", nil, errors.New("Paper backup is empty")
+			}
+			return kind, data, nil
+		case kind == "":
+			return "", nil, errors.New("Paper backup has no begin line")
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return "", nil, fmt.Errorf("Line %q: too short", line)
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return "", nil, fmt.Errorf("Line %q: no line number", line)
+		}
+		if n != no+1 {
+			return "", nil, fmt.Errorf("Line %02d: expected line %02d, lines missing or out of order", n, no+1)
+		}
+		no = n
+		lineData, err := paperEncoding.DecodeString(paperMisread.Replace(strings.Join(fields[1:len(fields)-1], "")))
+		if err != nil {
+			return "", nil, fmt.Errorf("Line %02d: invalid characters", no)
+		}
+		if paperMisread.Replace(fields[len(fields)-1]) != paperLineSum(no, lineData) {
+			return "", nil, fmt.Errorf("Line %02d: checksum mismatch, check for typos", no)
+		}
+		data = append(data, lineData...)
+	}
+	return "", nil, errors.New("Paper backup has no end line")
+}
+
+// ReadPaper reads paper backup text from r up to its end line.
+// r is read byte by byte, so nothing after the end line is consumed.
+func ReadPaper(r io.Reader) ([]byte, error) {
+	var text []byte
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 0 && err == nil {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				return append(text, line...), nil
+			}
+			return nil, err
+		}
+		line = append(line, b[0])
+		if b[0] != '\n' {
+			continue
+		}
+		text = append(text, line...)
+		if strings.HasPrefix(strings.TrimSpace(string(line)), paperEnd) {
+			return text, nil
+		}
+		line = line[:0]
+	}
+}
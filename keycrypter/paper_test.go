@@ -0,0 +1,46 @@
+package keycrypter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/declan94/cfcryptfs/corecrypter"
+)
+
+func TestPaper(t *testing.T) {
+	data := corecrypter.RandBytes(100)
+	text := EncodePaper(PaperShare, data, "comment")
+	if !IsPaper([]byte(text)) {
+		t.Fatal("Paper backup not detected")
+	}
+	// Misread characters and lower case are accepted
+	typed := strings.Split(strings.ToLower(text), "\n")
+	typed[2] = strings.NewReplacer("o", "0", "i", "1").Replace(typed[2])
+	kind, decoded, err := DecodePaper([]byte(strings.Join(typed, "\n")))
+	if err != nil || kind != PaperShare || !bytes.Equal(decoded, data) {
+		t.Fatalf("Decode paper failed: %v", err)
+	}
+	lines := strings.Split(text, "\n")
+	// A typo in line 03
+	l := []byte(lines[4])
+	if l[4] == 'A' {
+		l[4] = 'B'
+	} else {
+		l[4] = 'A'
+	}
+	lines[4] = string(l)
+	if _, _, err := DecodePaper([]byte(strings.Join(lines, "\n"))); err == nil || !strings.Contains(err.Error(), "Line 03") {
+		t.Errorf("Typo not reported: %v", err)
+	}
+	// A missing line
+	lines = strings.Split(text, "\n")
+	lines = append(lines[:3], lines[4:]...)
+	if _, _, err := DecodePaper([]byte(strings.Join(lines, "\n"))); err == nil {
+		t.Error("Missing line not reported")
+	}
+	r, err := ReadPaper(strings.NewReader(text + "rest"))
+	if err != nil || string(r) != text {
+		t.Errorf("Read paper failed: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package keycrypter
+
+// provides a registry of key providers, each one protects the master key of a cipher directory in its own way:
+// a password, split keyfiles, an emergency file, or any unlock method an application adds.
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// KeyEnv is what a key provider gets to protect or unlock the master key of a cipher directory
+type KeyEnv struct {
+	CipherDir string
+	// Options are the command line options set by the user by flag name, e.g. "keys" or "identity"
+	Options map[string]string
+	// KDF is the parameters for password based key derivation of new key files
+	KDF KDFParams
+	// Params are the provider's parameters saved in the config of the cipher directory, Protect may set them
+	Params map[string]string
+	// Config is the config of the cipher directory owned by the application, nil if it has none
+	Config interface{}
+}
+
+// KeyProvider initializes, unlocks and re-protects the master key of a cipher directory
+type KeyProvider interface {
+	// Protect stores `key` protected by the provider, at init or when converting from another provider
+	Protect(env *KeyEnv, key []byte) error
+	// Unlock returns the master key
+	Unlock(env *KeyEnv) ([]byte, error)
+	// KeyFiles returns the names of the files the provider stores in the cipher directory
+	KeyFiles() []string
+	// Describe returns lines about the protected key for showing the info of the cipher directory,
+	// e.g. "Recipients: 2"
+	Describe(env *KeyEnv) []string
+	// Prompt prepares protecting the key of an existing cipher directory again, when recovering or
+	// rekeying it, and returns what the user is asked for. It may keep settings of the current
+	// protection in env.Options or env.Config.
+	Prompt(env *KeyEnv) string
+}
+
+// ErrNoKeyProvider is returned when looking up a name not registered
+var ErrNoKeyProvider = errors.New("No such key provider")
+
+var (
+	providersMu   sync.RWMutex
+	providers     = map[string]KeyProvider{}
+	providerNames []string
+)
+
+// RegisterKeyProvider makes a key provider available by `name`, it panics if the name is registered twice
+func RegisterKeyProvider(name string, p KeyProvider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if p == nil {
+		panic("keycrypter: RegisterKeyProvider provider is nil")
+	}
+	if _, dup := providers[name]; dup {
+		panic("keycrypter: RegisterKeyProvider called twice for " + name)
+	}
+	providers[name] = p
+	providerNames = append(providerNames, name)
+}
+
+// LookupKeyProvider returns the key provider registered by `name`
+func LookupKeyProvider(name string) (KeyProvider, error) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%v: %s", ErrNoKeyProvider, name)
+	}
+	return p, nil
+}
+
+// KeyProviders returns the names of the registered key providers in the order of registration
+func KeyProviders() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	return append([]string{}, providerNames...)
+}
@@ -0,0 +1,59 @@
+package keycrypter
+
+import (
+	"bytes"
+	"testing"
+)
+
+type staticProvider struct{ key []byte }
+
+func (p *staticProvider) Protect(env *KeyEnv, key []byte) error {
+	p.key = key
+	env.Params["static"] = "1"
+	return nil
+}
+
+func (p *staticProvider) Unlock(env *KeyEnv) ([]byte, error) {
+	return p.key, nil
+}
+
+func (p *staticProvider) KeyFiles() []string {
+	return nil
+}
+
+func (p *staticProvider) Describe(env *KeyEnv) []string {
+	return []string{"Static: " + env.Params["static"]}
+}
+
+func (p *staticProvider) Prompt(env *KeyEnv) string {
+	return ""
+}
+
+func TestKeyProviderRegistry(t *testing.T) {
+	RegisterKeyProvider("static-test", &staticProvider{})
+	p, err := LookupKeyProvider("static-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &KeyEnv{Params: map[string]string{}}
+	key := []byte("0123456789abcdef")
+	p.Protect(env, key)
+	if k, _ := p.Unlock(env); !bytes.Equal(k, key) || env.Params["static"] != "1" {
+		t.Error("Registered provider not returned")
+	}
+	if lines := p.Describe(env); len(lines) != 1 || lines[0] != "Static: 1" {
+		t.Errorf("Wrong description: %v", lines)
+	}
+	if names := KeyProviders(); names[len(names)-1] != "static-test" {
+		t.Errorf("Wrong provider names: %v", names)
+	}
+	if _, err = LookupKeyProvider("missing"); err == nil {
+		t.Error("Looked up an unregistered provider")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Registered a provider twice")
+		}
+	}()
+	RegisterKeyProvider("static-test", &staticProvider{})
+}
@@ -14,7 +14,9 @@ import (
 	"github.com/declan94/cfcryptfs/cffuse"
 	"github.com/declan94/cfcryptfs/internal/cli"
 	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/secmem"
 	"github.com/declan94/cfcryptfs/internal/tlog"
+	"github.com/declan94/cfcryptfs/readpwd"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
@@ -22,9 +24,35 @@ import (
 
 func main() {
 	var args = cli.ParseArgs()
+	pwdSource := readpwd.Source{Extpass: args.Extpass, EnvFile: args.EnvFile, Pinentry: args.Pinentry}
+	if args.Init && args.PwdFile != "" && pwdSource.Extpass == "" {
+		// The password file holds the new password
+		pwdSource.Extpass = "/bin/cat -- " + args.PwdFile
+	}
+	readpwd.SetSource(pwdSource)
+
+	if args.Calibrate {
+		cli.CalibrateKDF(args.KDF.KDF, args.UnlockTime, args.KDF.Memory)
+		return
+	}
+
+	if args.Paper != "" {
+		cli.PrintPaper(args.Paper)
+		return
+	}
+
+	if args.KeyGen != "" {
+		cli.GenerateIdentity(args.KeyGen)
+		return
+	}
+
+	if args.PurgeKeys {
+		cli.PurgeCachedKeys(args.CipherDir)
+		return
+	}
 
 	if args.Init {
-		cli.InitCipherDir(args.CipherDir)
+		cli.InitCipherDir(args.CipherDir, args.KDF, args.Options)
 		return
 	}
 
@@ -34,17 +62,52 @@ func main() {
 	}
 
 	if args.ChangePwd {
-		cli.ChangeCipherPwd(args.CipherDir)
+		cli.ChangeCipherPwd(args.CipherDir, args.KDF, args.Options)
 		return
 	}
 
 	if args.Export {
-		cli.ExportEmergencyFile(args.CipherDir, args.Emergency)
+		cli.ExportEmergencyFile(args.CipherDir, args.Options)
 		return
 	}
 
 	if args.Recover {
-		cli.RecoverCipherDir(args.CipherDir, args.Emergency)
+		cli.RecoverCipherDir(args.CipherDir, args.KDF, args.Options)
+		return
+	}
+
+	if args.Conflicts {
+		cli.ResolveConflicts(args.CipherDir, args.Options)
+		return
+	}
+
+	if args.Convert {
+		cli.ConvertKeyProtection(args.CipherDir, args.KDF, args.Options)
+		return
+	}
+
+	if args.Reshare {
+		cli.ReshareKeys(args.CipherDir, args.KeyFiles, args.Options)
+		return
+	}
+
+	if args.Rekey {
+		cli.RekeyCipherDir(args.CipherDir, args.KDF, args.Options)
+		return
+	}
+
+	if args.Slot != "" {
+		cli.KeySlotCommand(args)
+		return
+	}
+
+	if args.RecipientCmd != "" {
+		cli.RecipientCommand(args)
+		return
+	}
+
+	if args.Policy != "" {
+		cli.SetPolicy(args.CipherDir, args.Options, args.Policy)
 		return
 	}
 
@@ -52,18 +115,17 @@ func main() {
 		os.Exit(forkChild())
 	}
 
-	var conf cli.CipherConfig
-	var key []byte
-	if args.Emergency != "" {
-		conf, key = cli.LoadEmergencyFile(args.Emergency)
-	} else {
-		conf = cli.LoadConf(args.CipherDir)
-		if conf.KeyCryptType == cli.KeyCryptTypePWD {
-			key = cli.LoadKey(args.CipherDir, args.PwdFile, args.Password)
-		} else {
-			key = cli.LoadKeySSS(args.KeyFiles)
+	// Keep the key out of core dumps and away from other processes of the user
+	if err := secmem.DisableCoreDumps(); err != nil {
+		tlog.Warn.Printf("Disable core dumps failed: %v", err)
+	}
+	if args.MlockAll {
+		if err := secmem.LockAll(); err != nil {
+			tlog.Fatal.Printf("Lock all memory failed (check \"ulimit -l\"): %v", err)
+			os.Exit(exitcode.Fuse)
 		}
 	}
+	conf, key := cli.UnlockCipherDir(args.CipherDir, args.Options)
 	// Check mountpoint
 	// We cannot mount "/home/user/.cipher" at "/home/user" because the mount
 	// will hide ".cipher" also for us.
@@ -79,6 +141,11 @@ func main() {
 		CryptType:  conf.CryptType,
 		PlainBS:    conf.PlainBS,
 		PlainPath:  conf.PlainPath,
+		FlatLayout: conf.FlatLayout,
+		LostFound:  args.LostFound,
+	}
+	if !conf.FlatLayout {
+		fsConf.Policy = cli.LoadPolicy(args.CipherDir, key)
 	}
 	var fs = cffuse.NewFS(fsConf, nil)
 	var finalFs pathfs.FileSystem
@@ -121,7 +188,7 @@ func main() {
 	// Wait for SIGINT in the background and unmount ourselves if we get it.
 	// This prevents a dangling "Transport endpoint is not connected"
 	// mountpoint if the user hits CTRL-C.
-	handleSigint(srv, args.MountPoint)
+	handleSigint(srv, args.MountPoint, fs.WipeKeys)
 
 	if args.ParentPid > 0 {
 		// Chdir to the root directory so we don't block unmounting the CWD
@@ -144,10 +211,10 @@ func main() {
 
 	fmt.Println("Filesystem Mounted")
 	srv.Serve()
-
+	fs.WipeKeys()
 }
 
-func handleSigint(srv *fuse.Server, mountpoint string) {
+func handleSigint(srv *fuse.Server, mountpoint string, wipe func()) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, syscall.SIGTERM)
@@ -165,6 +232,7 @@ func handleSigint(srv *fuse.Server, mountpoint string) {
 				cmd.Run()
 			}
 		}
+		wipe()
 		os.Exit(0)
 	}()
 }
@@ -0,0 +1,162 @@
+package readpwd
+
+// a minimal client of the Assuan protocol spoken by pinentry programs, see
+// https://www.gnupg.org/documentation/manuals/assuan/ and the pinentry documentation
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/internal/tlog"
+)
+
+var pinentryDescs = map[string]string{
+	purposeUnlock: "Enter the password of the cfcryptfs cipher directory",
+	purposeNew:    "Enter a new password for the cfcryptfs cipher directory",
+}
+
+type assuanConn struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+// assuanEscape percent-escapes the characters that can't appear in a command line
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+func assuanUnescape(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", errors.New("pinentry: bad escape in data")
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New("pinentry: bad escape in data")
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// response reads the lines of a response up to OK, and returns the data lines
+func (c *assuanConn) response() (string, error) {
+	var data string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("pinentry: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data, nil
+		case strings.HasPrefix(line, "ERR "):
+			// "ERR code description"
+			fields := strings.SplitN(line, " ", 3)
+			if len(fields) == 3 {
+				return "", fmt.Errorf("pinentry: %s", fields[2])
+			}
+			return "", fmt.Errorf("pinentry: %s", line)
+		case strings.HasPrefix(line, "D "):
+			d, err := assuanUnescape(line[2:])
+			if err != nil {
+				return "", err
+			}
+			data += d
+		case strings.HasPrefix(line, "INQUIRE "):
+			// Nothing to provide
+			if _, err = io.WriteString(c.w, "CAN\n"); err != nil {
+				return "", fmt.Errorf("pinentry: %v", err)
+			}
+		}
+		// Status "S" and comment "#" lines are ignored
+		if len(data) > maxPasswordLen {
+			return "", fmt.Errorf("Maximum password length of %d bytes exceeded", maxPasswordLen)
+		}
+	}
+}
+
+func (c *assuanConn) command(cmd string, arg string) (string, error) {
+	line := cmd
+	if arg != "" {
+		line += " " + assuanEscape(arg)
+	}
+	if _, err := io.WriteString(c.w, line+"\n"); err != nil {
+		return "", fmt.Errorf("pinentry: %v", err)
+	}
+	return c.response()
+}
+
+// readPasswordPinentry asks for the password for `purpose` with the pinentry `program`,
+// the password is asked again to confirm it if `repeat` is set
+func readPasswordPinentry(program string, purpose string, repeat bool) (string, error) {
+	tlog.Info.Printf("Reading password from %s", program)
+	cmd := exec.Command(program)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return "", fmt.Errorf("pinentry pipe setup failed: %v", err)
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("pinentry pipe setup failed: %v", err)
+	}
+	if err = cmd.Start(); err != nil {
+		return "", fmt.Errorf("pinentry start failed: %v", err)
+	}
+	defer func() {
+		w.Close()
+		cmd.Wait()
+	}()
+	c := &assuanConn{w: w, r: bufio.NewReader(r)}
+	// Greeting
+	if _, err = c.response(); err != nil {
+		return "", err
+	}
+	// Curses pinentries need the terminal, it is set the way gpg-agent does
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		c.command("OPTION", "ttyname="+tty)
+		if term := os.Getenv("TERM"); term != "" {
+			c.command("OPTION", "ttytype="+term)
+		}
+	}
+	for _, kv := range [][2]string{{"SETTITLE", "cfcryptfs"}, {"SETDESC", pinentryDescs[purpose]}, {"SETPROMPT", "Password:"}} {
+		if _, err = c.command(kv[0], kv[1]); err != nil {
+			return "", err
+		}
+	}
+	p, err := c.command("GETPIN", "")
+	if err != nil {
+		return "", err
+	}
+	if repeat {
+		if _, err = c.command("SETPROMPT", "Repeat:"); err != nil {
+			return "", err
+		}
+		p2, err := c.command("GETPIN", "")
+		if err != nil {
+			return "", err
+		}
+		if p != p2 {
+			return "", errMismatch
+		}
+	}
+	c.command("BYE", "")
+	if len(p) == 0 {
+		return "", errors.New("pinentry: password is empty")
+	}
+	return p, nil
+}
@@ -33,6 +33,7 @@ import (
 	"os/exec"
 	"strings"
 
+	"github.com/declan94/cfcryptfs/internal/exitcode"
 	"github.com/declan94/cfcryptfs/internal/tlog"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -43,11 +44,19 @@ const (
 	maxPasswordLen = 2048
 )
 
-// Once tries to get a password from the user, either from the terminal, extpass
-// or stdin.
+var errMismatch = errors.New("Passwords do not match")
+
+// Once tries to get a password from the user, either from the terminal, extpass,
+// the source set by SetSource or stdin.
 func Once(extpass string) (string, error) {
 	if extpass != "" {
-		return readPasswordExtpass(extpass)
+		return readPasswordExtpass(extpass, purposeUnlock)
+	}
+	if p, ok := readPasswordSource(purposeUnlock); ok {
+		return p, nil
+	}
+	if source.Pinentry != "" {
+		return pinentry(purposeUnlock, false)
 	}
 	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
 		return readPasswordStdin()
@@ -56,10 +65,16 @@ func Once(extpass string) (string, error) {
 }
 
 // Twice is the same as Once but will prompt twice if we get the password from
-// the terminal.
+// the terminal or pinentry. It asks for a new password, which the source may hold apart.
 func Twice(extpass string) (string, error) {
 	if extpass != "" {
-		return readPasswordExtpass(extpass)
+		return readPasswordExtpass(extpass, purposeNew)
+	}
+	if p, ok := readPasswordSource(purposeNew); ok {
+		return p, nil
+	}
+	if source.Pinentry != "" {
+		return pinentry(purposeNew, true)
 	}
 	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
 		return readPasswordStdin()
@@ -73,11 +88,25 @@ func Twice(extpass string) (string, error) {
 		return "", err
 	}
 	if p1 != p2 {
-		return "", errors.New("Passwords do not match")
+		return "", errMismatch
 	}
 	return p1, nil
 }
 
+// pinentry reads the password with the pinentry program of the source.
+// Only mismatching passwords are returned as errors, prompting again can't fix other ones.
+func pinentry(purpose string, repeat bool) (string, error) {
+	p, err := readPasswordPinentry(source.Pinentry, purpose, repeat)
+	if err == errMismatch {
+		return "", err
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcode.ReadPassword)
+	}
+	return p, nil
+}
+
 // readPasswordTerminal reads a line from the terminal.
 // Exits on read error or empty result.
 func readPasswordTerminal(prompt string) (string, error) {
@@ -110,9 +139,9 @@ func readPasswordStdin() (string, error) {
 }
 
 // readPasswordExtpass executes the "extpass" program and returns the first line
-// of the output.
+// of the output. EnvPurpose tells the program which password is asked for.
 // Exits on read error or empty result.
-func readPasswordExtpass(extpass string) (string, error) {
+func readPasswordExtpass(extpass string, purpose string) (string, error) {
 	tlog.Info.Println("Reading password from extpass program")
 	var parts []string
 	// The option "-passfile=FILE" gets transformed to
@@ -125,6 +154,7 @@ func readPasswordExtpass(extpass string) (string, error) {
 		parts = strings.Split(extpass, " ")
 	}
 	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd.Env = append(os.Environ(), EnvPurpose+"="+purpose)
 	cmd.Stderr = os.Stderr
 	pipe, err := cmd.StdoutPipe()
 	if err != nil {
@@ -0,0 +1,94 @@
+package readpwd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the test binary as a fake pinentry when FAKE_PINENTRY is set,
+// it answers GETPIN with the variable's value and "cancel" with an error
+func TestMain(m *testing.M) {
+	if pin := os.Getenv("FAKE_PINENTRY"); pin != "" {
+		fmt.Println("OK Pleased to meet you")
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			switch cmd := scanner.Text(); {
+			case cmd == "GETPIN" && pin == "cancel":
+				fmt.Println("ERR 83886179 Operation cancelled <Pinentry>")
+			case cmd == "GETPIN":
+				fmt.Printf("D %s\nOK\n", assuanEscape(pin))
+			case cmd == "BYE":
+				fmt.Println("OK closing connection")
+				os.Exit(0)
+			default:
+				fmt.Println("OK")
+			}
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestPinentry(t *testing.T) {
+	os.Setenv("FAKE_PINENTRY", "p%ss\nword")
+	defer os.Unsetenv("FAKE_PINENTRY")
+	p, err := readPasswordPinentry(os.Args[0], purposeNew, true)
+	if err != nil || p != "p%ss\nword" {
+		t.Errorf("Got %q: %v", p, err)
+	}
+	os.Setenv("FAKE_PINENTRY", "cancel")
+	if _, err = readPasswordPinentry(os.Args[0], purposeUnlock, false); err == nil || !strings.Contains(err.Error(), "Operation cancelled") {
+		t.Errorf("Cancel not reported: %v", err)
+	}
+}
+
+func TestEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "env")
+	ioutil.WriteFile(path, []byte("# comment\nexport "+EnvPassword+"=\"old pwd\"\nOTHER=x\n"), 0600)
+	for _, purpose := range []string{purposeUnlock, purposeNew} {
+		if p, err := readPasswordEnvFile(path, purpose); err != nil || p != "old pwd" {
+			t.Errorf("Purpose %s got %q: %v", purpose, p, err)
+		}
+	}
+	ioutil.WriteFile(path, []byte(EnvPassword+"=old\n"+EnvNewPassword+"='new'\n"), 0600)
+	if p, err := readPasswordEnvFile(path, purposeNew); err != nil || p != "new" {
+		t.Errorf("New password got %q: %v", p, err)
+	}
+	ioutil.WriteFile(path, []byte("OTHER=x\n"), 0600)
+	if _, err := readPasswordEnvFile(path, purposeUnlock); err == nil {
+		t.Error("Missing password not reported")
+	}
+}
+
+func TestScore(t *testing.T) {
+	for _, c := range []struct {
+		pwd   string
+		score int
+	}{
+		{"123456789", 0},
+		{"P@ssw0rd!", 0},
+		{"Summer2024", 0},
+		{"mypassword99", 0},
+		{"aaaaaaaaaaaa", 0},
+		{"qwertyuiop", 0},
+		{"kR9#mQ2v", 3},
+		{"correct horse battery staple", MaxScore},
+		{"x7$Rq!9zWm2&Lp4K", MaxScore},
+	} {
+		if s := Score(c.pwd); s != c.score {
+			t.Errorf("Score(%q) = %d, want %d", c.pwd, s, c.score)
+		}
+	}
+	policy := Policy{MinScore: DefaultMinScore, Denylist: []string{"Tr0ub4dor&3"}}
+	if err := policy.Check("tr0ub4dor&3"); err == nil {
+		t.Error("Denylisted password accepted")
+	}
+	if err := policy.Check("correct horse battery staple"); err != nil {
+		t.Error(err)
+	}
+}
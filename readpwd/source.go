@@ -0,0 +1,169 @@
+package readpwd
+
+// password sources for running without a terminal: an extpass command, an environment file,
+// systemd credentials and pinentry programs. They are configured once for the process by SetSource.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/declan94/cfcryptfs/internal/exitcode"
+	"github.com/declan94/cfcryptfs/internal/tlog"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// EnvPassword is the variable of the password in an environment file
+	EnvPassword = "CFCRYPTFS_PASSWORD"
+	// EnvNewPassword is the variable of a new password (-init, -chpwd) in an environment file,
+	// EnvPassword is used if it is missing
+	EnvNewPassword = "CFCRYPTFS_NEW_PASSWORD"
+	// EnvPurpose tells an extpass command which password is asked for: "unlock" or "new"
+	EnvPurpose = "CFCRYPTFS_PASSWORD_PURPOSE"
+	// CredentialName is the systemd credential holding the password, see LoadCredential= in systemd.exec(5)
+	CredentialName = "cfcryptfs.password"
+	// NewCredentialName is the systemd credential holding a new password, CredentialName is used if it is missing
+	NewCredentialName = "cfcryptfs.newpassword"
+
+	purposeUnlock = "unlock"
+	purposeNew    = "new"
+)
+
+// Source configures where Once and Twice read passwords from when they get no extpass.
+// The first configured one of Extpass, EnvFile, a systemd credential in $CREDENTIALS_DIRECTORY
+// and Pinentry is used, the zero Source reads from the terminal or stdin.
+type Source struct {
+	// Extpass is a command printing the password, EnvPurpose is set in its environment
+	Extpass string
+	// EnvFile is a file of KEY=VALUE lines holding EnvPassword or EnvNewPassword
+	EnvFile string
+	// Pinentry is a pinentry program to prompt with, e.g. "pinentry-gnome3"
+	Pinentry string
+}
+
+var source Source
+
+// SetSource sets the password source of the process
+func SetSource(s Source) {
+	source = s
+}
+
+// Interactive reports whether a new password is asked from a person, who can be asked again
+// when it is rejected, rather than read from a configured source
+func Interactive() bool {
+	if source.Extpass != "" || source.EnvFile != "" || credentialPath(purposeNew) != "" {
+		return false
+	}
+	return source.Pinentry != "" || terminal.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// readPasswordSource reads the password for `purpose` from the configured source.
+// It returns false if no source but pinentry or the terminal is configured,
+// and exits on errors, as prompting again can't fix them.
+func readPasswordSource(purpose string) (string, bool) {
+	var p string
+	var err error
+	if source.Extpass != "" {
+		p, err = readPasswordExtpass(source.Extpass, purpose)
+	} else if source.EnvFile != "" {
+		p, err = readPasswordEnvFile(source.EnvFile, purpose)
+	} else if path := credentialPath(purpose); path != "" {
+		p, err = readPasswordCredential(path)
+	} else {
+		return "", false
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcode.ReadPassword)
+	}
+	return p, true
+}
+
+// credentialPath returns the path of the systemd credential for `purpose`, empty if there is none
+func credentialPath(purpose string) string {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return ""
+	}
+	names := []string{CredentialName}
+	if purpose == purposeNew {
+		names = []string{NewCredentialName, CredentialName}
+	}
+	for _, n := range names {
+		path := filepath.Join(dir, n)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// readPasswordCredential returns the first line of the credential file at `path`
+func readPasswordCredential(path string) (string, error) {
+	tlog.Info.Printf("Reading password from credential %s", filepath.Base(path))
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Read credential failed: %v", err)
+	}
+	defer f.Close()
+	p, err := readLineUnbuffered(f)
+	if err != nil {
+		return "", err
+	}
+	if len(p) == 0 {
+		return "", fmt.Errorf("credential %s: password is empty", filepath.Base(path))
+	}
+	return p, nil
+}
+
+// readPasswordEnvFile returns the password for `purpose` from an environment file in the format of
+// systemd's EnvironmentFile=: KEY=VALUE lines, comments starting with #, values optionally quoted
+func readPasswordEnvFile(path string, purpose string) (string, error) {
+	tlog.Info.Println("Reading password from environment file")
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Read environment file failed: %v", err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Mode().Perm()&077 != 0 {
+		tlog.Warn.Printf("Environment file %s is accessible by other users", path)
+	}
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+		val := strings.TrimSpace(line[i+1:])
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+		vars[strings.TrimSpace(line[:i])] = val
+	}
+	if err = scanner.Err(); err != nil {
+		return "", fmt.Errorf("Read environment file failed: %v", err)
+	}
+	keys := []string{EnvPassword}
+	if purpose == purposeNew {
+		keys = []string{EnvNewPassword, EnvPassword}
+	}
+	for _, k := range keys {
+		if p := vars[k]; p != "" {
+			if len(p) > maxPasswordLen {
+				return "", fmt.Errorf("Maximum password length of %d bytes exceeded", maxPasswordLen)
+			}
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("environment file: %s is not set", keys[0])
+}
@@ -0,0 +1,195 @@
+package readpwd
+
+// estimates the strength of new passwords. The estimate is the entropy of the characters,
+// where characters repeating or continuing a sequence, a keyboard row or a common password count less.
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const (
+	// MaxScore is the score of strong passwords
+	MaxScore = 4
+	// DefaultMinScore is the minimum score of new passwords unless configured
+	DefaultMinScore = 2
+	// minWordLen is the minimum length of common passwords searched for inside a password
+	minWordLen = 4
+)
+
+// scoreBits are the estimated entropy bits needed for the scores 1 to 4
+var scoreBits = []float64{28, 36, 50, 64}
+
+// commonPasswords are frequently used passwords and bases of passwords
+var commonPasswords = strings.Fields(`
+password qwerty qwertyuiop asdfgh asdfghjkl zxcvbn zxcvbnm letmein welcome monkey dragon master login
+admin administrator princess sunshine football baseball soccer hockey iloveyou trustno shadow superman
+batman michael jennifer hunter ranger buster killer george charlie andrew daniel jordan harley thomas
+robert matthew pepper cheese summer winter spring autumn freedom whatever computer starwars secret
+access flower hello lovely silver ginger orange purple yellow banana cookie chocolate pokemon naruto
+liverpool chelsea arsenal changeme default guest root toor user love jesus money family friend
+mustang maggie tigger ashley nicole jessica bailey hannah passphrase cfcryptfs encrypt vault abc
+test god sex pass
+`)
+
+// keyboardRows are searched for characters typed next to each other
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+var leetReplacer = strings.NewReplacer("@", "a", "4", "a", "8", "b", "3", "e", "6", "g", "1", "i", "!", "i",
+	"0", "o", "$", "s", "5", "s", "7", "t", "+", "t", "2", "z")
+
+// Policy is the minimum strength of new passwords
+type Policy struct {
+	// MinScore is the minimum score from 0 to MaxScore
+	MinScore int
+	// Denylist are passwords rejected in addition to the common ones, compared case-insensitively
+	Denylist []string
+}
+
+// ReadDenylist reads a denylist file of one password per line, lines starting with # are comments
+func ReadDenylist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if w := strings.TrimSpace(scanner.Text()); w != "" && w[0] != '#' {
+			words = append(words, w)
+		}
+	}
+	return words, scanner.Err()
+}
+
+// Check returns an error describing why `pwd` doesn't satisfy the policy
+func (p Policy) Check(pwd string) error {
+	score, common := estimate(pwd, p.Denylist)
+	if common {
+		return fmt.Errorf("Password is a common or denylisted password")
+	}
+	if score < p.MinScore {
+		return fmt.Errorf("Password is too weak (score %d of %d, at least %d needed), use a longer one with more kinds of characters",
+			score, MaxScore, p.MinScore)
+	}
+	return nil
+}
+
+// Score rates the strength of `pwd` from 0 (easily guessed) to MaxScore
+func Score(pwd string) int {
+	score, _ := estimate(pwd, nil)
+	return score
+}
+
+// normalizePassword lower-cases `pwd` and undoes common character substitutions
+func normalizePassword(pwd string) string {
+	return leetReplacer.Replace(strings.ToLower(pwd))
+}
+
+// estimate returns the score of `pwd`, and whether it is a common or denylisted password
+// with at most digits and symbols around it
+func estimate(pwd string, denylist []string) (int, bool) {
+	words := commonPasswords
+	for _, w := range denylist {
+		words = append(words, normalizePassword(w))
+	}
+	lower := []rune(strings.ToLower(pwd))
+	norm := []rune(normalizePassword(pwd))
+	if len(norm) != len(lower) {
+		// Substitutions are single characters, this can't happen
+		norm = lower
+	}
+	base := strings.TrimFunc(strings.ToLower(pwd), func(r rune) bool { return !unicode.IsLetter(r) })
+	for _, w := range words {
+		if w == string(lower) || w == string(norm) || w == base || w == normalizePassword(base) {
+			return 0, true
+		}
+	}
+
+	// weight is how much each character counts
+	weight := make([]float64, len(lower))
+	for i := range lower {
+		weight[i] = 1
+		if i > 0 && (isSequence(lower[i-1], lower[i]) || isKeyboardNeighbour(lower[i-1], lower[i])) {
+			weight[i] = 0.25
+		}
+	}
+	// A common password inside counts as one character
+	for _, w := range words {
+		wr := []rune(w)
+		if len(wr) < minWordLen {
+			continue
+		}
+		for _, s := range [][]rune{lower, norm} {
+			for i := 0; i+len(wr) <= len(s); i++ {
+				if string(s[i:i+len(wr)]) != w {
+					continue
+				}
+				for j := i + 1; j < i+len(wr); j++ {
+					weight[j] = 0
+				}
+			}
+		}
+	}
+	var length float64
+	for _, w := range weight {
+		length += w
+	}
+	bits := length * math.Log2(float64(poolSize(pwd)))
+	score := 0
+	for score < MaxScore && bits >= scoreBits[score] {
+		score++
+	}
+	return score, false
+}
+
+// poolSize returns the count of characters of the kinds used in `pwd`
+func poolSize(pwd string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range pwd {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	pool := 1
+	for _, kind := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if kind.used {
+			pool += kind.size
+		}
+	}
+	return pool
+}
+
+// isSequence reports whether `r` repeats `prev` or continues a sequence like "abc" or "321"
+func isSequence(prev rune, r rune) bool {
+	d := r - prev
+	return d >= -1 && d <= 1
+}
+
+func isKeyboardNeighbour(prev rune, r rune) bool {
+	for _, row := range keyboardRows {
+		if i := strings.IndexRune(row, prev); i >= 0 {
+			if (i > 0 && rune(row[i-1]) == r) || (i+1 < len(row) && rune(row[i+1]) == r) {
+				return true
+			}
+		}
+	}
+	return false
+}